@@ -3,8 +3,11 @@ package agent
 import (
 	"context"
 	"github.com/MagalixTechnologies/uuid-go"
-	"golang.org/x/sync/errgroup"
+	"github.com/reconquest/sign-go"
 	"os"
+	"sync"
+	"syscall"
+	"time"
 )
 
 type LogLevel struct {
@@ -16,13 +19,30 @@ type Agent struct {
 	ClusterID uuid.UUID
 	AgentID   uuid.UUID
 
-	MetricsSource      MetricsSource
+	MetricsSource MetricsSource
+	// TelemetrySource metrics of the agent itself, optional
+	TelemetrySource    MetricsSource
 	EntitiesSource     EntitiesSource
 	AutomationExecutor AutomationExecutor
 	Gateway            Gateway
+	// Sinks destinations of metrics, deltas and resyncs in addition to the gateway
+	Sinks []Sink
 
 	changeLogLevel ChangeLogLevelHandler
 
+	// config the effective runtime configuration, updated by the gateway
+	config      AppliedConfig
+	configM     sync.Mutex
+	configStore ConfigStore
+
+	supervisor *Supervisor
+
+	// drainTimeout max time to send buffered data before exit
+	drainTimeout time.Duration
+	// sinkSyncTimeout max time each sink has to send buffered data before exit, separate from drainTimeout
+	// so sinks don't get only what the gateway left of it
+	sinkSyncTimeout time.Duration
+
 	cancelAll     context.CancelFunc
 	cancelSources context.CancelFunc
 	cancelSinks   context.CancelFunc
@@ -30,20 +50,33 @@ type Agent struct {
 
 func New(
 	metricsSource MetricsSource,
+	telemetrySource MetricsSource,
 	entitiesSource EntitiesSource,
 	automationExecutor AutomationExecutor,
 	gateway Gateway,
+	sinks []Sink,
 	logLevelHandler ChangeLogLevelHandler,
+	drainTimeout time.Duration,
 ) *Agent {
 	return &Agent{
 		MetricsSource:      metricsSource,
+		TelemetrySource:    telemetrySource,
 		EntitiesSource:     entitiesSource,
 		AutomationExecutor: automationExecutor,
 		Gateway:            gateway,
+		Sinks:              sinks,
 		changeLogLevel:     logLevelHandler,
+		drainTimeout:       drainTimeout,
+		sinkSyncTimeout:    defaultSinkSyncTimeout,
+		supervisor:         NewSupervisor(),
 	}
 }
 
+// SetSinkSyncTimeout sets the max time each sink has to send buffered data before exit
+func (a *Agent) SetSinkSyncTimeout(timeout time.Duration) {
+	a.sinkSyncTimeout = timeout
+}
+
 func (a *Agent) Start() error {
 	allCtx, cancelAll := context.WithCancel(context.Background())
 	a.cancelAll = cancelAll
@@ -58,6 +91,8 @@ func (a *Agent) Start() error {
 	a.Gateway.SetAutomationHandler(a.AutomationExecutor.SubmitAutomation)
 	a.Gateway.SetRestartHandler(a.handleRestart)
 	a.Gateway.SetChangeLogLevelHandler(a.handleLogLevelChange)
+	a.Gateway.SetConfigHandler(a.handleConfig)
+	a.Gateway.SetReadinessHandler(a.handleReadiness)
 
 	a.AutomationExecutor.SetAutomationFeedbackHandler(a.handleAutomationFeedback)
 
@@ -65,18 +100,60 @@ func (a *Agent) Start() error {
 	a.EntitiesSource.SetEntitiesResyncHandler(a.handleResync)
 
 	a.MetricsSource.SetMetricsHandler(a.handleMetrics)
+	if a.TelemetrySource != nil {
+		a.TelemetrySource.SetMetricsHandler(a.handleMetrics)
+	}
+
+	a.loadConfig()
+
+	go sign.Notify(func(os.Signal) bool {
+		a.handleTerminate()
+		return false
+	}, syscall.SIGTERM)
 
-	eg, _ := errgroup.WithContext(allCtx)
-	// Add a context to Gateway to manage the numerous go routines in the client
-	eg.Go(func() error { return a.Gateway.Start(sinksCtx) })
+	// components are supervised independently, only the gateway failing for good stops the agent
+	a.supervisor.Add("gateway", until(sinksCtx, a.Gateway.Start), ComponentOptions{Critical: true})
+	for _, sink := range a.Sinks {
+		a.supervisor.Add("sink/"+sink.Name(), until(sinksCtx, sink.Start), ComponentOptions{})
+	}
+	a.supervisor.Start(allCtx)
 	// Blocks until authorized
 	a.Gateway.WaitAuthorization()
 
-	eg.Go(func() error { return a.EntitiesSource.Start(sourcesCtx) })
-	eg.Go(func() error { return a.MetricsSource.Start(sourcesCtx) })
-	eg.Go(func() error { return a.AutomationExecutor.Start(sourcesCtx) })
+	a.supervisor.Add("entities", until(sourcesCtx, a.EntitiesSource.Start), ComponentOptions{})
+	a.supervisor.Add("metrics", until(sourcesCtx, a.MetricsSource.Start), ComponentOptions{})
+	a.supervisor.Add("executor", until(sourcesCtx, a.AutomationExecutor.Start), ComponentOptions{})
+	if a.TelemetrySource != nil {
+		a.supervisor.Add("telemetry", until(sourcesCtx, a.TelemetrySource.Start), ComponentOptions{})
+	}
+
+	return a.supervisor.Wait()
+}
 
-	return eg.Wait()
+// ComponentsHealth gets the health of supervised components by name
+func (a *Agent) ComponentsHealth() map[string]ComponentHealth {
+	return a.supervisor.Health()
+}
+
+// until runs a component with a context that is also done when stop is done,
+// the component is stopped rather than crashed if it returns after stop is done
+func until(stop context.Context, run ComponentRun) ComponentRun {
+	return func(ctx context.Context) error {
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		go func() {
+			select {
+			case <-stop.Done():
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+		err := run(ctx)
+		if stop.Err() != nil {
+			return nil
+		}
+		return err
+	}
 }
 
 func (a *Agent) stopSources() error {
@@ -50,4 +50,10 @@ type AutomationExecutor interface {
 	Stop() error
 	SubmitAutomation(automation *Automation) error
 	SetAutomationFeedbackHandler(handler AutomationFeedbackHandler)
+	// Pause stops executing automations until Resume is called, submitted automations are kept
+	Pause()
+	Resume()
+	// SetWorkers resizes the workers pool, automations being executed are completed
+	SetWorkers(workers int)
+	SetDryRun(dryRun bool)
 }
@@ -0,0 +1,224 @@
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/MagalixTechnologies/core/logger"
+)
+
+const (
+	minMetricsInterval = 10 * time.Second
+	maxExecutorWorkers = 100
+)
+
+var configLogLevels = []string{"debug", "info", "warn", "error"}
+
+// Config runtime configuration of the agent
+type Config struct {
+	MetricsInterval time.Duration `json:"metrics_interval"`
+	DryRun          bool          `json:"dry_run"`
+	ExecutorWorkers int           `json:"executor_workers"`
+	LogLevel        string        `json:"log_level"`
+}
+
+// AppliedConfig effective configuration and the version of the last applied update
+type AppliedConfig struct {
+	Version int64 `json:"version"`
+	Config
+}
+
+// ConfigUpdate a runtime configuration pushed by the gateway, nil fields keep their current value
+type ConfigUpdate struct {
+	Version         int64
+	MetricsInterval *time.Duration
+	DryRun          *bool
+	ExecutorWorkers *int
+	LogLevel        *string
+}
+
+// ConfigResult effective configuration after an update, errors are set if the update was rejected
+type ConfigResult struct {
+	AppliedConfig
+	Errors []string
+}
+
+type ConfigHandler func(update *ConfigUpdate) (*ConfigResult, error)
+
+// ConfigStore persists the last applied configuration
+type ConfigStore interface {
+	// Load gets the saved configuration, nil if nothing was saved
+	Load() (*AppliedConfig, error)
+	Save(config *AppliedConfig) error
+}
+
+// IntervalSetter a metrics source whose interval can be changed at runtime
+type IntervalSetter interface {
+	SetInterval(interval time.Duration)
+}
+
+// SetConfig sets the configuration the agent started with
+func (a *Agent) SetConfig(config Config) {
+	a.configM.Lock()
+	defer a.configM.Unlock()
+	a.config = AppliedConfig{Config: config}
+}
+
+// SetConfigStore sets where applied configurations are persisted, the saved configuration is applied on start
+func (a *Agent) SetConfigStore(store ConfigStore) {
+	a.configStore = store
+}
+
+// loadConfig applies the configuration saved by a previous run
+func (a *Agent) loadConfig() {
+	if a.configStore == nil {
+		return
+	}
+	saved, err := a.configStore.Load()
+	if err != nil {
+		logger.Errorw("unable to load saved config", "error", err)
+		return
+	}
+	if saved == nil {
+		return
+	}
+
+	result, err := a.handleConfig(&ConfigUpdate{
+		Version:         saved.Version,
+		MetricsInterval: &saved.MetricsInterval,
+		DryRun:          &saved.DryRun,
+		ExecutorWorkers: &saved.ExecutorWorkers,
+		LogLevel:        &saved.LogLevel,
+	})
+	if err != nil {
+		logger.Errorw("unable to apply saved config", "error", err)
+		return
+	}
+	if len(result.Errors) > 0 {
+		logger.Errorw("saved config is invalid", "version", saved.Version, "errors", result.Errors)
+	}
+}
+
+// handleConfig validates and applies a configuration update, an invalid update is rejected as a whole
+func (a *Agent) handleConfig(update *ConfigUpdate) (*ConfigResult, error) {
+	a.configM.Lock()
+	defer a.configM.Unlock()
+
+	if errs := a.validateConfig(update); len(errs) > 0 {
+		logger.Warnw("config has been rejected", "version", update.Version, "errors", errs)
+		return &ConfigResult{AppliedConfig: a.config, Errors: errs}, nil
+	}
+
+	config := a.config
+	config.Version = update.Version
+	if update.LogLevel != nil && *update.LogLevel != config.LogLevel {
+		if err := a.changeLogLevel(&LogLevel{Level: *update.LogLevel}); err != nil {
+			return &ConfigResult{AppliedConfig: a.config, Errors: []string{err.Error()}}, nil
+		}
+		config.LogLevel = *update.LogLevel
+	}
+	if update.MetricsInterval != nil && *update.MetricsInterval != config.MetricsInterval {
+		a.MetricsSource.(IntervalSetter).SetInterval(*update.MetricsInterval)
+		config.MetricsInterval = *update.MetricsInterval
+	}
+	if update.ExecutorWorkers != nil && *update.ExecutorWorkers != config.ExecutorWorkers {
+		a.AutomationExecutor.SetWorkers(*update.ExecutorWorkers)
+		config.ExecutorWorkers = *update.ExecutorWorkers
+	}
+	if update.DryRun != nil && *update.DryRun != config.DryRun {
+		a.AutomationExecutor.SetDryRun(*update.DryRun)
+		config.DryRun = *update.DryRun
+	}
+	a.config = config
+	logger.Infow("config has been applied", "version", config.Version, "config", config.Config)
+
+	if a.configStore != nil {
+		if err := a.configStore.Save(&config); err != nil {
+			logger.Errorw("unable to save config", "version", config.Version, "error", err)
+		}
+	}
+	return &ConfigResult{AppliedConfig: config}, nil
+}
+
+func (a *Agent) validateConfig(update *ConfigUpdate) []string {
+	var errs []string
+	if update.Version < a.config.Version {
+		errs = append(errs, fmt.Sprintf("version %d is older than the applied version %d", update.Version, a.config.Version))
+	}
+	if update.MetricsInterval != nil {
+		if _, ok := a.MetricsSource.(IntervalSetter); !ok {
+			errs = append(errs, "metrics interval can't be changed at runtime")
+		} else if *update.MetricsInterval < minMetricsInterval {
+			errs = append(errs, fmt.Sprintf("metrics interval %s is less than %s", *update.MetricsInterval, minMetricsInterval))
+		}
+	}
+	if update.ExecutorWorkers != nil && (*update.ExecutorWorkers < 1 || *update.ExecutorWorkers > maxExecutorWorkers) {
+		errs = append(errs, fmt.Sprintf("executor workers %d is not between 1 and %d", *update.ExecutorWorkers, maxExecutorWorkers))
+	}
+	if update.LogLevel != nil && !isConfigLogLevel(*update.LogLevel) {
+		errs = append(errs, fmt.Sprintf("unsupported log level %s", *update.LogLevel))
+	}
+	return errs
+}
+
+func isConfigLogLevel(level string) bool {
+	for _, item := range configLogLevels {
+		if item == level {
+			return true
+		}
+	}
+	return false
+}
+
+// FileConfigStore persists the applied configuration as a json file
+type FileConfigStore struct {
+	path string
+}
+
+// NewFileConfigStore creates a config store saving to the file path
+func NewFileConfigStore(path string) *FileConfigStore {
+	return &FileConfigStore{path: path}
+}
+
+func (s *FileConfigStore) Load() (*AppliedConfig, error) {
+	data, err := ioutil.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to read config file, error: %w", err)
+	}
+	var config AppliedConfig
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("unable to decode config file, error: %w", err)
+	}
+	return &config, nil
+}
+
+// Save writes the configuration to a temporary file renamed over the file, so a crash never leaves it partial
+func (s *FileConfigStore) Save(config *AppliedConfig) error {
+	data, err := json.Marshal(config)
+	if err != nil {
+		return fmt.Errorf("unable to encode config, error: %w", err)
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(s.path), filepath.Base(s.path)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("unable to create config file, error: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("unable to write config file, error: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("unable to write config file, error: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), s.path); err != nil {
+		return fmt.Errorf("unable to replace config file, error: %w", err)
+	}
+	return nil
+}
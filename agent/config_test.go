@@ -0,0 +1,138 @@
+package agent
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+type fakeMetricsSource struct {
+	interval time.Duration
+}
+
+func (s *fakeMetricsSource) Start(ctx context.Context) error          { return nil }
+func (s *fakeMetricsSource) Stop() error                              { return nil }
+func (s *fakeMetricsSource) SetMetricsHandler(handler MetricsHandler) {}
+func (s *fakeMetricsSource) SetInterval(interval time.Duration)       { s.interval = interval }
+
+type fakeExecutor struct {
+	workers int
+	dryRun  bool
+}
+
+func (e *fakeExecutor) Start(ctx context.Context) error                                { return nil }
+func (e *fakeExecutor) Stop() error                                                    { return nil }
+func (e *fakeExecutor) SubmitAutomation(automation *Automation) error                  { return nil }
+func (e *fakeExecutor) SetAutomationFeedbackHandler(handler AutomationFeedbackHandler) {}
+func (e *fakeExecutor) Pause()                                                         {}
+func (e *fakeExecutor) Resume()                                                        {}
+func (e *fakeExecutor) SetWorkers(workers int)                                         { e.workers = workers }
+func (e *fakeExecutor) SetDryRun(dryRun bool)                                          { e.dryRun = dryRun }
+
+func TestAgent_HandleConfig(t *testing.T) {
+	interval := 30 * time.Second
+	tooShort := time.Second
+	workers := 3
+	tooMany := maxExecutorWorkers + 1
+	dryRun := true
+	debug := "debug"
+	unknown := "verbose"
+	initial := Config{MetricsInterval: time.Minute, ExecutorWorkers: 5, LogLevel: "info"}
+
+	tests := []struct {
+		name       string
+		update     ConfigUpdate
+		want       AppliedConfig
+		wantErrors int
+	}{
+		{
+			name:   "applied",
+			update: ConfigUpdate{Version: 2, MetricsInterval: &interval, ExecutorWorkers: &workers, DryRun: &dryRun, LogLevel: &debug},
+			want: AppliedConfig{Version: 2, Config: Config{
+				MetricsInterval: interval,
+				DryRun:          true,
+				ExecutorWorkers: workers,
+				LogLevel:        debug,
+			}},
+		},
+		{
+			name:   "unset fields are kept",
+			update: ConfigUpdate{Version: 2, DryRun: &dryRun},
+			want: AppliedConfig{Version: 2, Config: Config{
+				MetricsInterval: time.Minute,
+				DryRun:          true,
+				ExecutorWorkers: 5,
+				LogLevel:        "info",
+			}},
+		},
+		{
+			name:       "invalid config is rejected as a whole",
+			update:     ConfigUpdate{Version: 2, MetricsInterval: &tooShort, ExecutorWorkers: &tooMany, DryRun: &dryRun, LogLevel: &unknown},
+			want:       AppliedConfig{Version: 1, Config: initial},
+			wantErrors: 3,
+		},
+		{
+			name:       "older version is rejected",
+			update:     ConfigUpdate{Version: 0, DryRun: &dryRun},
+			want:       AppliedConfig{Version: 1, Config: initial},
+			wantErrors: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			metricsSource := &fakeMetricsSource{interval: initial.MetricsInterval}
+			executor := &fakeExecutor{workers: initial.ExecutorWorkers}
+			logLevel := initial.LogLevel
+			a := New(metricsSource, nil, nil, executor, nil, nil, func(level *LogLevel) error {
+				logLevel = level.Level
+				return nil
+			}, time.Second)
+			a.SetConfig(initial)
+			a.config.Version = 1
+			dir, err := ioutil.TempDir("", "config")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+			store := NewFileConfigStore(filepath.Join(dir, "config.json"))
+			a.SetConfigStore(store)
+
+			result, err := a.handleConfig(&tt.update)
+			if err != nil {
+				t.Fatalf("handleConfig() error = %v", err)
+			}
+			if len(result.Errors) != tt.wantErrors {
+				t.Errorf("handleConfig() errors = %v, want %d errors", result.Errors, tt.wantErrors)
+			}
+			if !reflect.DeepEqual(result.AppliedConfig, tt.want) {
+				t.Errorf("handleConfig() config = %+v, want %+v", result.AppliedConfig, tt.want)
+			}
+
+			effective := Config{
+				MetricsInterval: metricsSource.interval,
+				DryRun:          executor.dryRun,
+				ExecutorWorkers: executor.workers,
+				LogLevel:        logLevel,
+			}
+			if effective != tt.want.Config {
+				t.Errorf("applied config = %+v, want %+v", effective, tt.want.Config)
+			}
+
+			saved, err := store.Load()
+			if err != nil {
+				t.Fatalf("Load() error = %v", err)
+			}
+			if tt.wantErrors > 0 {
+				if saved != nil {
+					t.Errorf("Load() = %+v, want nothing saved", saved)
+				}
+			} else if saved == nil || *saved != tt.want {
+				t.Errorf("Load() = %+v, want %+v", saved, tt.want)
+			}
+		})
+	}
+}
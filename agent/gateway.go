@@ -6,10 +6,14 @@ type AutomationHandler func(automation *Automation) error
 type RestartHandler func() error
 type ChangeLogLevelHandler func(level *LogLevel) error
 
+// ReadinessHandler called when the gateway becomes ready to send and receive packets or stops being ready
+type ReadinessHandler func(ready bool)
+
 type Gateway interface {
 	Start(ctx context.Context) error
 	WaitAuthorization()
-	// TODO: Add Sync() function to ensure all buffered data is sent before exit
+	// Sync ensures all buffered data is sent before exit, it rejects new data other than logs until it returns
+	Sync(ctx context.Context) error
 
 	SendMetrics(metrics []*Metric) error
 	SendEntitiesDeltas(deltas []*Delta) error
@@ -19,4 +23,6 @@ type Gateway interface {
 	SetAutomationHandler(handler AutomationHandler)
 	SetRestartHandler(handler RestartHandler)
 	SetChangeLogLevelHandler(handler ChangeLogLevelHandler)
+	SetConfigHandler(handler ConfigHandler)
+	SetReadinessHandler(handler ReadinessHandler)
 }
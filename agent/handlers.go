@@ -1,24 +1,38 @@
 package agent
 
 import (
+	"context"
 	"math/rand"
+	"sync"
 	"time"
 
 	"github.com/MagalixTechnologies/core/logger"
 )
 
 func (a *Agent) handleDeltas(deltas []*Delta) error {
+	a.fanOut(func(sink Sink) error { return sink.SendEntitiesDeltas(deltas) })
 	return a.Gateway.SendEntitiesDeltas(deltas)
 }
 
 func (a *Agent) handleResync(resync *EntitiesResync) error {
+	a.fanOut(func(sink Sink) error { return sink.SendEntitiesResync(resync) })
 	return a.Gateway.SendEntitiesResync(resync)
 }
 
 func (a *Agent) handleMetrics(metrics []*Metric) error {
+	a.fanOut(func(sink Sink) error { return sink.SendMetrics(metrics) })
 	return a.Gateway.SendMetrics(metrics)
 }
 
+// fanOut sends data to every sink, errors are logged so a sink never fails the source or the gateway
+func (a *Agent) fanOut(send func(sink Sink) error) {
+	for _, sink := range a.Sinks {
+		if err := send(sink); err != nil {
+			logger.Warnw("unable to send to sink", "sink", sink.Name(), "error", err)
+		}
+	}
+}
+
 func (a *Agent) handleAutomationFeedback(feedback *AutomationFeedback) error {
 	return a.Gateway.SendAutomationFeedback(feedback)
 }
@@ -26,17 +40,7 @@ func (a *Agent) handleAutomationFeedback(feedback *AutomationFeedback) error {
 func (a *Agent) handleRestart() error {
 	go func() {
 		logger.Info("Received restart. Stopping workers.")
-		if err := a.stopSources(); err != nil {
-			logger.Errorf("failed to stop agent sources. %s", err)
-		}
-
-		if err := logger.Sync(); err != nil {
-			logger.Errorf("failed to sync logs. %s", err)
-		}
-
-		if err := a.stopSinks(); err != nil {
-			logger.Errorf("failed to stop agent sinks. %s", err)
-		}
+		a.shutdown()
 
 		// Set a random wait time of up to 600 seconds (10 minutes)
 		waitTime := time.Duration(rand.Intn(600)) * time.Second
@@ -48,6 +52,71 @@ func (a *Agent) handleRestart() error {
 	return nil
 }
 
+// handleReadiness pauses automations while the gateway is not ready, so their feedback isn't lost
+func (a *Agent) handleReadiness(ready bool) {
+	if ready {
+		logger.Info("gateway is ready, resuming automations")
+		a.AutomationExecutor.Resume()
+	} else {
+		logger.Info("gateway is not ready, pausing automations")
+		a.AutomationExecutor.Pause()
+	}
+}
+
+// handleTerminate sends buffered data and exits
+func (a *Agent) handleTerminate() {
+	logger.Info("Received termination signal. Stopping workers.")
+	a.shutdown()
+	a.Exit(0)
+}
+
+// shutdown stops sources, then sends data buffered by the gateway within the drain timeout,
+// data buffered by sinks within the sink sync timeout and stops sinks
+func (a *Agent) shutdown() {
+	if err := a.stopSources(); err != nil {
+		logger.Errorf("failed to stop agent sources. %s", err)
+	}
+
+	if err := logger.Sync(); err != nil {
+		logger.Errorf("failed to sync logs. %s", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), a.drainTimeout)
+	defer cancel()
+	if err := a.Gateway.Sync(ctx); err != nil {
+		logger.Errorf("failed to sync gateway. %s", err)
+	}
+	a.syncSinks()
+
+	if err := a.stopSinks(); err != nil {
+		logger.Errorf("failed to stop agent sinks. %s", err)
+	}
+}
+
+// syncSinks syncs sinks concurrently, each within its own timeout so a slow sink doesn't delay the others
+func (a *Agent) syncSinks() {
+	var wg sync.WaitGroup
+	for _, sink := range a.Sinks {
+		wg.Add(1)
+		go func(sink Sink) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), a.sinkSyncTimeout)
+			defer cancel()
+			if err := sink.Sync(ctx); err != nil {
+				logger.Errorw("failed to sync sink", "sink", sink.Name(), "error", err)
+			}
+		}(sink)
+	}
+	wg.Wait()
+}
+
+// handleLogLevelChange changes the log level, the effective config reports it
 func (a *Agent) handleLogLevelChange(level *LogLevel) error {
-	return a.changeLogLevel(level)
+	a.configM.Lock()
+	defer a.configM.Unlock()
+	if err := a.changeLogLevel(level); err != nil {
+		return err
+	}
+	a.config.LogLevel = level.Level
+	return nil
 }
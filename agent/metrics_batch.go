@@ -0,0 +1,20 @@
+package agent
+
+// MetricsBatchMaxSize max number of metrics sent at once
+const MetricsBatchMaxSize = 1000
+
+// MetricsBatches splits metrics into batches of up to size metrics
+func MetricsBatches(metrics []*Metric, size int) [][]*Metric {
+	if size <= 0 {
+		size = MetricsBatchMaxSize
+	}
+	batches := make([][]*Metric, 0, (len(metrics)+size-1)/size)
+	for start := 0; start < len(metrics); start += size {
+		end := start + size
+		if end > len(metrics) {
+			end = len(metrics)
+		}
+		batches = append(batches, metrics[start:end])
+	}
+	return batches
+}
@@ -0,0 +1,205 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/MagalixTechnologies/core/logger"
+)
+
+// Sink a destination of metrics, deltas and resyncs in addition to the gateway
+type Sink interface {
+	Name() string
+	// Start runs the sink until the context is done
+	Start(ctx context.Context) error
+	// Sync ensures all buffered data is sent before exit
+	Sync(ctx context.Context) error
+
+	SendMetrics(metrics []*Metric) error
+	SendEntitiesDeltas(deltas []*Delta) error
+	SendEntitiesResync(resync *EntitiesResync) error
+}
+
+// defaultSinkSyncTimeout max time each sink has to send buffered data before exit
+const defaultSinkSyncTimeout = 10 * time.Second
+
+// SinkStats counters of a buffered sink
+type SinkStats struct {
+	Queued   int
+	Sent     int
+	Dropped  int
+	Failures int
+}
+
+// sinkItem data queued to be sent to a sink, only one field is set
+type sinkItem struct {
+	metrics []*Metric
+	deltas  []*Delta
+	resync  *EntitiesResync
+}
+
+// BufferedSink queues data sent to a sink and sends it from its own goroutine,
+// so a slow or failing sink never blocks the agent or other sinks
+// the oldest data is dropped when the queue is full, failed sends are logged and dropped
+type BufferedSink struct {
+	sync.Mutex
+	sink  Sink
+	size  int
+	queue []sinkItem
+	// wake is signaled when data is queued
+	wake    chan struct{}
+	sending bool
+	stats   SinkStats
+}
+
+// NewBufferedSink creates a buffered sink queuing up to size sends
+func NewBufferedSink(sink Sink, size int) *BufferedSink {
+	if sink == nil {
+		panic("sink is nil")
+	}
+	if size <= 0 {
+		size = 1
+	}
+	return &BufferedSink{
+		sink: sink,
+		size: size,
+		wake: make(chan struct{}, 1),
+	}
+}
+
+func (s *BufferedSink) Name() string {
+	return s.sink.Name()
+}
+
+// Start starts the wrapped sink and sends queued data until the context is done
+func (s *BufferedSink) Start(ctx context.Context) error {
+	go func() {
+		if err := s.sink.Start(ctx); err != nil {
+			logger.Errorw("sink stopped with an error", "sink", s.Name(), "error", err)
+		}
+	}()
+
+	for {
+		item, ok := s.next()
+		if !ok {
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-s.wake:
+				continue
+			}
+		}
+		s.send(item)
+	}
+}
+
+// Sync waits until queued data is sent, then syncs the wrapped sink
+func (s *BufferedSink) Sync(ctx context.Context) error {
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		s.Lock()
+		idle := len(s.queue) == 0 && !s.sending
+		s.Unlock()
+		if idle {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+	return s.sink.Sync(ctx)
+}
+
+func (s *BufferedSink) SendMetrics(metrics []*Metric) error {
+	s.enqueue(sinkItem{metrics: metrics})
+	return nil
+}
+
+func (s *BufferedSink) SendEntitiesDeltas(deltas []*Delta) error {
+	s.enqueue(sinkItem{deltas: deltas})
+	return nil
+}
+
+func (s *BufferedSink) SendEntitiesResync(resync *EntitiesResync) error {
+	s.enqueue(sinkItem{resync: resync})
+	return nil
+}
+
+// Stats gets counters of the sink
+func (s *BufferedSink) Stats() SinkStats {
+	s.Lock()
+	defer s.Unlock()
+	stats := s.stats
+	stats.Queued = len(s.queue)
+	return stats
+}
+
+func (s *BufferedSink) enqueue(item sinkItem) {
+	s.Lock()
+	if len(s.queue) >= s.size {
+		s.queue = s.queue[1:]
+		s.stats.Dropped++
+		if s.stats.Dropped == 1 || s.stats.Dropped%100 == 0 {
+			logger.Warnw("sink queue is full, dropping oldest data", "sink", s.Name(), "dropped", s.stats.Dropped)
+		}
+	}
+	s.queue = append(s.queue, item)
+	s.Unlock()
+
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// next pops the oldest queued item and marks the sink as sending
+func (s *BufferedSink) next() (sinkItem, bool) {
+	s.Lock()
+	defer s.Unlock()
+	if len(s.queue) == 0 {
+		return sinkItem{}, false
+	}
+	item := s.queue[0]
+	s.queue[0] = sinkItem{}
+	s.queue = s.queue[1:]
+	s.sending = true
+	return item, true
+}
+
+func (s *BufferedSink) send(item sinkItem) {
+	err := s.sendItem(item)
+
+	s.Lock()
+	defer s.Unlock()
+	s.sending = false
+	if err != nil {
+		s.stats.Failures++
+		logger.Warnw("unable to send to sink", "sink", s.Name(), "error", err)
+		return
+	}
+	s.stats.Sent++
+}
+
+// sendItem sends an item to the wrapped sink, a panic is returned as an error
+func (s *BufferedSink) sendItem(item sinkItem) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("sink panic: %v", r)
+		}
+	}()
+
+	switch {
+	case item.metrics != nil:
+		return s.sink.SendMetrics(item.metrics)
+	case item.deltas != nil:
+		return s.sink.SendEntitiesDeltas(item.deltas)
+	case item.resync != nil:
+		return s.sink.SendEntitiesResync(item.resync)
+	}
+	return nil
+}
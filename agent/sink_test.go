@@ -0,0 +1,113 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+type testSink struct {
+	sync.Mutex
+	block   chan struct{}
+	fail    bool
+	panics  bool
+	metrics [][]*Metric
+}
+
+func (s *testSink) Name() string                             { return "test" }
+func (s *testSink) Start(ctx context.Context) error          { return nil }
+func (s *testSink) Sync(ctx context.Context) error           { return nil }
+func (s *testSink) SendEntitiesDeltas(deltas []*Delta) error { return nil }
+func (s *testSink) SendEntitiesResync(resync *EntitiesResync) error {
+	return nil
+}
+
+func (s *testSink) SendMetrics(metrics []*Metric) error {
+	if s.block != nil {
+		<-s.block
+	}
+	if s.panics {
+		panic("boom")
+	}
+	if s.fail {
+		return errors.New("failed")
+	}
+	s.Lock()
+	defer s.Unlock()
+	s.metrics = append(s.metrics, metrics)
+	return nil
+}
+
+func TestBufferedSink(t *testing.T) {
+	tests := []struct {
+		name      string
+		sink      *testSink
+		size      int
+		sends     int
+		wantStats SinkStats
+	}{
+		{
+			name:      "sent",
+			sink:      &testSink{},
+			size:      10,
+			sends:     3,
+			wantStats: SinkStats{Sent: 3},
+		},
+		{
+			name:      "failures",
+			sink:      &testSink{fail: true},
+			size:      10,
+			sends:     2,
+			wantStats: SinkStats{Failures: 2},
+		},
+		{
+			name:      "panics are failures",
+			sink:      &testSink{panics: true},
+			size:      10,
+			sends:     2,
+			wantStats: SinkStats{Failures: 2},
+		},
+		{
+			name:  "oldest are dropped when full",
+			sink:  &testSink{block: make(chan struct{})},
+			size:  2,
+			sends: 5,
+			// the first send is in flight, the next two are dropped
+			wantStats: SinkStats{Sent: 3, Dropped: 2},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sink := NewBufferedSink(tt.sink, tt.size)
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			go sink.Start(ctx)
+
+			for i := 0; i < tt.sends; i++ {
+				if err := sink.SendMetrics([]*Metric{{Value: int64(i)}}); err != nil {
+					t.Fatal(err)
+				}
+				if i == 0 && tt.sink.block != nil {
+					// wait for the first send to be in flight
+					for sink.Stats().Queued != 0 {
+						time.Sleep(time.Millisecond)
+					}
+				}
+			}
+			if tt.sink.block != nil {
+				close(tt.sink.block)
+			}
+
+			syncCtx, cancelSync := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancelSync()
+			if err := sink.Sync(syncCtx); err != nil {
+				t.Fatal(err)
+			}
+			if stats := sink.Stats(); stats != tt.wantStats {
+				t.Fatalf("Stats() = %+v, want %+v", stats, tt.wantStats)
+			}
+		})
+	}
+}
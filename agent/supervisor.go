@@ -0,0 +1,254 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"github.com/MagalixTechnologies/core/logger"
+)
+
+const (
+	// RestartAlways restarts a component whenever it returns
+	RestartAlways RestartPolicy = "always"
+	// RestartOnFailure restarts a component when it returns an error or panics
+	RestartOnFailure RestartPolicy = "on-failure"
+	// RestartNever never restarts a component
+	RestartNever RestartPolicy = "never"
+
+	ComponentRunning ComponentState = "running"
+	ComponentBackoff ComponentState = "backoff"
+	ComponentStopped ComponentState = "stopped"
+	// ComponentFailed the component is not restarted anymore, it crashed more than allowed if critical
+	ComponentFailed ComponentState = "failed"
+
+	defaultComponentBackoff    = time.Second
+	defaultComponentMaxBackoff = 5 * time.Minute
+	defaultComponentMaxCrashes = 5
+	defaultComponentCrashReset = 10 * time.Minute
+)
+
+type RestartPolicy string
+
+type ComponentState string
+
+// ComponentOptions how a supervised component is restarted, zero values use defaults
+type ComponentOptions struct {
+	Restart RestartPolicy
+	// Backoff wait before the first restart, doubled for every consecutive crash up to MaxBackoff
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+	// MaxCrashes consecutive crashes after which a critical component is failed,
+	// other components keep being restarted at MaxBackoff as nothing else would restart them
+	MaxCrashes int
+	// CrashReset running longer than this resets the consecutive crashes
+	CrashReset time.Duration
+	// Critical the supervisor stops everything when the component fails
+	Critical bool
+}
+
+// ComponentHealth state of a supervised component
+type ComponentHealth struct {
+	State    ComponentState `json:"state"`
+	Since    time.Time      `json:"since"`
+	Restarts int            `json:"restarts"`
+	// Crashes consecutive crashes
+	Crashes   int    `json:"crashes"`
+	LastError string `json:"last_error,omitempty"`
+}
+
+// ComponentRun runs a component until the context is done
+type ComponentRun func(ctx context.Context) error
+
+type component struct {
+	name    string
+	run     ComponentRun
+	options ComponentOptions
+	health  ComponentHealth
+}
+
+// Supervisor runs components independently, restarting them with backoff when they return,
+// so a crashing component never stops the others
+type Supervisor struct {
+	sync.Mutex
+	components []*component
+
+	ctx     context.Context
+	cancel  context.CancelFunc
+	wg      sync.WaitGroup
+	failure error
+}
+
+// NewSupervisor creates an empty supervisor
+func NewSupervisor() *Supervisor {
+	return &Supervisor{}
+}
+
+// Add adds a component, it is run right away if the supervisor is started
+func (s *Supervisor) Add(name string, run ComponentRun, options ComponentOptions) {
+	if run == nil {
+		panic("component run is nil")
+	}
+	if options.Restart == "" {
+		options.Restart = RestartOnFailure
+	}
+	if options.Backoff <= 0 {
+		options.Backoff = defaultComponentBackoff
+	}
+	if options.MaxBackoff <= 0 {
+		options.MaxBackoff = defaultComponentMaxBackoff
+	}
+	if options.MaxCrashes <= 0 {
+		options.MaxCrashes = defaultComponentMaxCrashes
+	}
+	if options.CrashReset <= 0 {
+		options.CrashReset = defaultComponentCrashReset
+	}
+
+	c := &component{
+		name:    name,
+		run:     run,
+		options: options,
+		health:  ComponentHealth{State: ComponentStopped, Since: time.Now()},
+	}
+	s.Lock()
+	defer s.Unlock()
+	s.components = append(s.components, c)
+	if s.ctx != nil {
+		s.start(c)
+	}
+}
+
+// Start runs components until the context is done or a critical component fails
+func (s *Supervisor) Start(ctx context.Context) {
+	s.Lock()
+	defer s.Unlock()
+	if s.ctx != nil {
+		panic("supervisor is already started")
+	}
+	s.ctx, s.cancel = context.WithCancel(ctx)
+	for _, c := range s.components {
+		s.start(c)
+	}
+}
+
+// Wait waits until all components stop, returns the error of a failed critical component
+func (s *Supervisor) Wait() error {
+	s.wg.Wait()
+	s.Lock()
+	defer s.Unlock()
+	return s.failure
+}
+
+// start runs a component in a goroutine, must be called with the lock held
+func (s *Supervisor) start(c *component) {
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		err := s.supervise(s.ctx, c)
+		if err == nil || !c.options.Critical {
+			return
+		}
+		s.Lock()
+		if s.failure == nil {
+			s.failure = fmt.Errorf("critical component %s failed, error: %w", c.name, err)
+		}
+		s.Unlock()
+		s.cancel()
+	}()
+}
+
+// Health gets the health of every component by name
+func (s *Supervisor) Health() map[string]ComponentHealth {
+	s.Lock()
+	defer s.Unlock()
+	health := make(map[string]ComponentHealth, len(s.components))
+	for _, c := range s.components {
+		health[c.name] = c.health
+	}
+	return health
+}
+
+// supervise runs a component until the context is done or it fails, returns the last error if it fails
+func (s *Supervisor) supervise(ctx context.Context, c *component) error {
+	for {
+		s.setState(c, ComponentRunning, nil)
+		started := time.Now()
+		err := runComponent(ctx, c.run)
+		if ctx.Err() != nil {
+			s.setState(c, ComponentStopped, nil)
+			return nil
+		}
+
+		if err == nil && c.options.Restart != RestartAlways {
+			logger.Infow("component stopped", "component", c.name)
+			s.setState(c, ComponentStopped, nil)
+			return nil
+		}
+		if err == nil {
+			err = fmt.Errorf("component %s returned", c.name)
+		}
+
+		s.Lock()
+		if time.Since(started) > c.options.CrashReset {
+			c.health.Crashes = 0
+		}
+		c.health.Crashes++
+		crashes := c.health.Crashes
+		s.Unlock()
+
+		if c.options.Restart == RestartNever || (c.options.Critical && crashes > c.options.MaxCrashes) {
+			logger.Errorw("component failed", "component", c.name, "crashes", crashes, "error", err)
+			s.setState(c, ComponentFailed, err)
+			return err
+		}
+
+		backoff := c.options.Backoff << uint(crashes-1)
+		if backoff <= 0 || backoff > c.options.MaxBackoff || crashes > c.options.MaxCrashes {
+			backoff = c.options.MaxBackoff
+		}
+		if crashes > c.options.MaxCrashes {
+			logger.Errorw("component keeps crashing, restarting", "component", c.name, "crashes", crashes, "backoff", backoff, "error", err)
+		} else {
+			logger.Warnw("component crashed, restarting", "component", c.name, "crashes", crashes, "backoff", backoff, "error", err)
+		}
+		s.setState(c, ComponentBackoff, err)
+
+		timer := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			s.setState(c, ComponentStopped, nil)
+			return nil
+		case <-timer.C:
+		}
+
+		s.Lock()
+		c.health.Restarts++
+		s.Unlock()
+	}
+}
+
+func (s *Supervisor) setState(c *component, state ComponentState, err error) {
+	s.Lock()
+	defer s.Unlock()
+	if c.health.State != state {
+		c.health.State = state
+		c.health.Since = time.Now()
+	}
+	if err != nil {
+		c.health.LastError = err.Error()
+	}
+}
+
+// runComponent runs a component, a panic is returned as an error
+func runComponent(ctx context.Context, run ComponentRun) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v\n%s", r, debug.Stack())
+		}
+	}()
+	return run(ctx)
+}
@@ -0,0 +1,104 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSupervisor(t *testing.T) {
+	tests := []struct {
+		name      string
+		run       func(calls int32) error
+		options   ComponentOptions
+		wantErr   bool
+		wantState ComponentState
+		wantCalls int32
+	}{
+		{
+			name:      "crash loop is restarted at max backoff",
+			run:       func(int32) error { return errors.New("failed") },
+			options:   ComponentOptions{Backoff: time.Millisecond, MaxBackoff: time.Hour, MaxCrashes: 2},
+			wantState: ComponentBackoff,
+			wantCalls: 3,
+		},
+		{
+			name:      "critical crash loop is capped",
+			run:       func(int32) error { return errors.New("failed") },
+			options:   ComponentOptions{Backoff: time.Millisecond, MaxCrashes: 3, Critical: true},
+			wantErr:   true,
+			wantState: ComponentFailed,
+			wantCalls: 4,
+		},
+		{
+			name: "restarted after a panic",
+			run: func(calls int32) error {
+				if calls == 1 {
+					panic("boom")
+				}
+				return nil
+			},
+			options:   ComponentOptions{Backoff: time.Millisecond},
+			wantState: ComponentStopped,
+			wantCalls: 2,
+		},
+		{
+			name:      "never restarted",
+			run:       func(int32) error { return errors.New("failed") },
+			options:   ComponentOptions{Restart: RestartNever},
+			wantState: ComponentFailed,
+			wantCalls: 1,
+		},
+		{
+			name:      "critical failure stops the supervisor",
+			run:       func(int32) error { return errors.New("failed") },
+			options:   ComponentOptions{Restart: RestartNever, Critical: true},
+			wantErr:   true,
+			wantState: ComponentFailed,
+			wantCalls: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var calls int32
+			supervisor := NewSupervisor()
+			supervisor.Add("test", func(ctx context.Context) error {
+				return tt.run(atomic.AddInt32(&calls, 1))
+			}, tt.options)
+
+			// a healthy component keeps running until the supervisor stops
+			supervisor.Add("healthy", func(ctx context.Context) error {
+				<-ctx.Done()
+				return nil
+			}, ComponentOptions{})
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			supervisor.Start(ctx)
+
+			deadline := time.Now().Add(5 * time.Second)
+			for {
+				health := supervisor.Health()
+				if health["test"].State == tt.wantState && atomic.LoadInt32(&calls) == tt.wantCalls {
+					break
+				}
+				if time.Now().After(deadline) {
+					t.Fatalf("health = %+v, calls = %d", health["test"], atomic.LoadInt32(&calls))
+				}
+				time.Sleep(time.Millisecond)
+			}
+			if state := supervisor.Health()["healthy"].State; !tt.wantErr && state != ComponentRunning {
+				t.Fatalf("healthy component state = %s, want %s", state, ComponentRunning)
+			}
+
+			if !tt.wantErr {
+				cancel()
+			}
+			if err := supervisor.Wait(); (err != nil) != tt.wantErr {
+				t.Fatalf("Wait() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -1,12 +1,204 @@
 package client
 
-import "crypto/sha512"
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sync"
 
-func (client *Client) getAuthorizationToken(question []byte) ([]byte, error) {
+	"github.com/gorilla/websocket"
+)
+
+// Authenticator authenticates the agent against the agent gateway
+type Authenticator interface {
+	// Prepare customizes the websocket dialer and handshake headers
+	// it is called before every connection attempt
+	Prepare(dialer *websocket.Dialer, header http.Header) error
+	// Answer returns the answer to the authorization question sent by the agent gateway
+	Answer(question []byte) ([]byte, error)
+}
+
+// SecretAuthenticator answers the authorization question with a challenge built from a shared secret
+type SecretAuthenticator struct {
+	secret []byte
+}
+
+// NewSecretAuthenticator creates a new secret authenticator
+func NewSecretAuthenticator(secret []byte) *SecretAuthenticator {
+	return &SecretAuthenticator{secret: secret}
+}
+
+func (a *SecretAuthenticator) Prepare(*websocket.Dialer, http.Header) error {
+	return nil
+}
+
+func (a *SecretAuthenticator) Answer(question []byte) ([]byte, error) {
+	return challenge(question, a.secret)
+}
+
+// TLSAuthenticator authenticates using a client certificate on the websocket connection
+// certificate files are read on every connection attempt so rotated certificates are picked up
+type TLSAuthenticator struct {
+	sync.Mutex
+
+	certFile string
+	keyFile  string
+	caFile   string
+
+	cert *tls.Certificate
+}
+
+// NewTLSAuthenticator creates a new mutual TLS authenticator
+// caFile is optional and used to verify the agent gateway certificate
+func NewTLSAuthenticator(certFile, keyFile, caFile string) *TLSAuthenticator {
+	return &TLSAuthenticator{
+		certFile: certFile,
+		keyFile:  keyFile,
+		caFile:   caFile,
+	}
+}
+
+func (a *TLSAuthenticator) Prepare(dialer *websocket.Dialer, _ http.Header) error {
+	cert, err := tls.LoadX509KeyPair(a.certFile, a.keyFile)
+	if err != nil {
+		return fmt.Errorf("unable to load client certificate, error: %w", err)
+	}
+	a.Lock()
+	a.cert = &cert
+	a.Unlock()
+
+	if dialer.TLSClientConfig == nil {
+		dialer.TLSClientConfig = &tls.Config{}
+	}
+	dialer.TLSClientConfig.Certificates = []tls.Certificate{cert}
+
+	if a.caFile != "" {
+		ca, err := ioutil.ReadFile(a.caFile)
+		if err != nil {
+			return fmt.Errorf("unable to read CA certificate, error: %w", err)
+		}
+		// keep roots added for the proxy
+		pool := dialer.TLSClientConfig.RootCAs
+		if pool == nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(ca) {
+			return fmt.Errorf("no certificates found in %s", a.caFile)
+		}
+		dialer.TLSClientConfig.RootCAs = pool
+	}
+	return nil
+}
+
+// Answer signs the question with the private key of the client certificate
+// the certificate itself is public, so only a signature proves the key is held
+func (a *TLSAuthenticator) Answer(question []byte) ([]byte, error) {
+	a.Lock()
+	defer a.Unlock()
+	if a.cert == nil {
+		return nil, fmt.Errorf("client certificate is not loaded")
+	}
+	signer, ok := a.cert.PrivateKey.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("client certificate key can't sign")
+	}
+	hash, _, err := tlsAnswerHash(signer.Public())
+	if err != nil {
+		return nil, err
+	}
+	digest := question
+	if hash != 0 {
+		sum := sha256.Sum256(question)
+		digest = sum[:]
+	}
+	answer, err := signer.Sign(rand.Reader, digest, hash)
+	if err != nil {
+		return nil, fmt.Errorf("unable to sign authorization question, error: %w", err)
+	}
+	return answer, nil
+}
+
+// VerifyTLSAnswer checks the answer of an agent authenticating with the client certificate, used by agent gateways
+func VerifyTLSAnswer(question []byte, answer []byte, cert *x509.Certificate) error {
+	_, algorithm, err := tlsAnswerHash(cert.PublicKey)
+	if err != nil {
+		return err
+	}
+	return cert.CheckSignature(algorithm, question, answer)
+}
+
+// tlsAnswerHash gets how questions are signed with keys of the same type as the public key
+// ed25519 keys sign the question itself
+func tlsAnswerHash(public crypto.PublicKey) (crypto.Hash, x509.SignatureAlgorithm, error) {
+	switch public.(type) {
+	case *rsa.PublicKey:
+		return crypto.SHA256, x509.SHA256WithRSA, nil
+	case *ecdsa.PublicKey:
+		return crypto.SHA256, x509.ECDSAWithSHA256, nil
+	case ed25519.PublicKey:
+		return 0, x509.PureEd25519, nil
+	default:
+		return 0, x509.UnknownSignatureAlgorithm, fmt.Errorf("unsupported client certificate key type %T", public)
+	}
+}
+
+// TokenFileAuthenticator authenticates using a bearer token mounted as a file
+// the file is read on every use so rotated tokens are picked up
+type TokenFileAuthenticator struct {
+	path string
+}
+
+// NewTokenFileAuthenticator creates a new token file authenticator
+func NewTokenFileAuthenticator(path string) *TokenFileAuthenticator {
+	return &TokenFileAuthenticator{path: path}
+}
+
+func (a *TokenFileAuthenticator) Prepare(_ *websocket.Dialer, header http.Header) error {
+	token, err := a.token()
+	if err != nil {
+		return err
+	}
+	header.Set("Authorization", "Bearer "+string(token))
+	return nil
+}
+
+func (a *TokenFileAuthenticator) Answer([]byte) ([]byte, error) {
+	return a.token()
+}
+
+func (a *TokenFileAuthenticator) token() ([]byte, error) {
+	token, err := ioutil.ReadFile(a.path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read token file, error: %w", err)
+	}
+	token = bytes.TrimSpace(token)
+	if len(token) == 0 {
+		return nil, fmt.Errorf("token file %s is empty", a.path)
+	}
+	return token, nil
+}
+
+// SecretAnswer the answer expected from an agent authenticating with the secret, used by agent gateways
+func SecretAnswer(question []byte, secret []byte) ([]byte, error) {
+	return challenge(question, secret)
+}
+
+// challenge hashes the question surrounding the secret
+func challenge(question []byte, secret []byte) ([]byte, error) {
 	payload := []byte{}
 
 	payload = append(payload, question...)
-	payload = append(payload, []byte(client.secret)...)
+	payload = append(payload, secret...)
 	payload = append(payload, question...)
 
 	sha := sha512.New()
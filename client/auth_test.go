@@ -0,0 +1,146 @@
+package client
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestTokenFileAuthenticator_Rotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "auth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "token")
+	auth := NewTokenFileAuthenticator(path)
+
+	tokens := []struct {
+		content string
+		want    string
+	}{
+		{content: "first\n", want: "first"},
+		{content: "second", want: "second"},
+	}
+	for _, token := range tokens {
+		if err := ioutil.WriteFile(path, []byte(token.content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		header := http.Header{}
+		if err := auth.Prepare(nil, header); err != nil {
+			t.Fatalf("TokenFileAuthenticator.Prepare() error = %v", err)
+		}
+		answer, err := auth.Answer([]byte("question"))
+		if err != nil {
+			t.Fatalf("TokenFileAuthenticator.Answer() error = %v", err)
+		}
+		if string(answer) != token.want || header.Get("Authorization") != "Bearer "+token.want {
+			t.Errorf("TokenFileAuthenticator answer = %s, header = %s, want %s", answer, header.Get("Authorization"), token.want)
+		}
+	}
+}
+
+func TestSecretAuthenticator_Answer(t *testing.T) {
+	auth := NewSecretAuthenticator([]byte("secret"))
+	first, err := auth.Answer([]byte("question"))
+	if err != nil {
+		t.Fatalf("SecretAuthenticator.Answer() error = %v", err)
+	}
+	second, _ := auth.Answer([]byte("question"))
+	other, _ := auth.Answer([]byte("other question"))
+	if len(first) != 64 || string(first) != string(second) || string(first) == string(other) {
+		t.Errorf("SecretAuthenticator.Answer() is not a stable sha512 challenge")
+	}
+}
+
+// writeTestCertificate writes a self signed certificate and its key to dir
+func writeTestCertificate(t *testing.T, dir string, name string) (certFile, keyFile string, cert *x509.Certificate) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err = x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certFile = filepath.Join(dir, name+".crt")
+	keyFile = filepath.Join(dir, name+".key")
+	if err := ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile, cert
+}
+
+func TestTLSAuthenticator_Answer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "auth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	certFile, keyFile, cert := writeTestCertificate(t, dir, "agent")
+	otherCertFile, otherKeyFile, _ := writeTestCertificate(t, dir, "other")
+	question := []byte("question")
+
+	answer := func(certFile, keyFile string) []byte {
+		auth := NewTLSAuthenticator(certFile, keyFile, "")
+		if err := auth.Prepare(&websocket.Dialer{}, http.Header{}); err != nil {
+			t.Fatalf("TLSAuthenticator.Prepare() error = %v", err)
+		}
+		answer, err := auth.Answer(question)
+		if err != nil {
+			t.Fatalf("TLSAuthenticator.Answer() error = %v", err)
+		}
+		return answer
+	}
+
+	// knowing the public certificate is not enough to answer
+	public, _ := challenge(question, cert.Raw)
+	tests := []struct {
+		name    string
+		answer  []byte
+		wantErr bool
+	}{
+		{name: "signed with the certificate key", answer: answer(certFile, keyFile)},
+		{name: "signed with another key", answer: answer(otherCertFile, otherKeyFile), wantErr: true},
+		{name: "built from the certificate", answer: public, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := VerifyTLSAnswer(question, tt.answer, cert); (err != nil) != tt.wantErr {
+				t.Errorf("VerifyTLSAnswer() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
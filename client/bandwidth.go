@@ -0,0 +1,133 @@
+package client
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/MagalixCorp/magalix-agent/v2/proto"
+	"golang.org/x/time/rate"
+)
+
+// throughputWindow period over which outbound throughput is measured
+const throughputWindow = 10 * time.Second
+
+// DefaultBypassKinds critical packet kinds sent without waiting for the bandwidth limiter
+var DefaultBypassKinds = []proto.PacketKind{
+	proto.PacketKindHello,
+	proto.PacketKindAuthorizationRequest,
+	proto.PacketKindAuthorizationAnswer,
+	proto.PacketKindPing,
+	proto.PacketKindAutomationFeedback,
+}
+
+// Throughput outbound traffic to the agent gateway
+type Throughput struct {
+	// BytesPerSecond measured over the last complete window
+	BytesPerSecond float64
+	// Bytes sent by kind since start
+	Bytes map[proto.PacketKind]int64
+	// Throttled total time senders waited for the bandwidth limiter
+	Throttled time.Duration
+}
+
+// Bandwidth limits outbound traffic to the agent gateway with a token bucket
+// and measures throughput
+type Bandwidth struct {
+	sync.Mutex
+
+	// limiter nil means unlimited
+	limiter *rate.Limiter
+	bypass  map[proto.PacketKind]bool
+
+	bytes       map[proto.PacketKind]int64
+	throttled   time.Duration
+	windowStart time.Time
+	windowBytes int64
+	rate        float64
+}
+
+// NewBandwidth creates a bandwidth limiter allowing bytesPerSecond with bursts up to burst bytes
+// 0 bytesPerSecond means unlimited, packets of bypass kinds are never delayed
+func NewBandwidth(bytesPerSecond int, burst int, bypass []proto.PacketKind) *Bandwidth {
+	bandwidth := &Bandwidth{
+		bypass:      map[proto.PacketKind]bool{},
+		bytes:       map[proto.PacketKind]int64{},
+		windowStart: time.Now(),
+	}
+	if bytesPerSecond > 0 {
+		if burst < 1 {
+			burst = bytesPerSecond
+		}
+		bandwidth.limiter = rate.NewLimiter(rate.Limit(bytesPerSecond), burst)
+	}
+	for _, kind := range bypass {
+		bandwidth.bypass[kind] = true
+	}
+	return bandwidth
+}
+
+// Wait blocks until size bytes of the kind can be sent
+// packets larger than the burst wait for it multiple times
+func (b *Bandwidth) Wait(kind proto.PacketKind, size int) {
+	if b.limiter != nil && !b.bypass[kind] {
+		started := time.Now()
+		remaining := size
+		for remaining > 0 {
+			n := remaining
+			if n > b.limiter.Burst() {
+				n = b.limiter.Burst()
+			}
+			// never fails, n is within the burst and the context is not canceled
+			_ = b.limiter.WaitN(context.Background(), n)
+			remaining -= n
+		}
+		if waited := time.Since(started); waited > time.Millisecond {
+			b.Lock()
+			b.throttled += waited
+			b.Unlock()
+		}
+	}
+
+	b.record(kind, size)
+}
+
+func (b *Bandwidth) record(kind proto.PacketKind, size int) {
+	b.Lock()
+	defer b.Unlock()
+	b.bytes[kind] += int64(size)
+	b.roll(time.Now())
+	b.windowBytes += int64(size)
+}
+
+// roll starts a new window when the current one is complete
+func (b *Bandwidth) roll(now time.Time) {
+	elapsed := now.Sub(b.windowStart)
+	if elapsed < throughputWindow {
+		return
+	}
+	if elapsed >= 2*throughputWindow {
+		// nothing was sent for a whole window
+		b.rate = 0
+	} else {
+		b.rate = float64(b.windowBytes) / elapsed.Seconds()
+	}
+	b.windowStart = now
+	b.windowBytes = 0
+}
+
+// Throughput gets the outbound throughput
+func (b *Bandwidth) Throughput() Throughput {
+	b.Lock()
+	defer b.Unlock()
+	b.roll(time.Now())
+	throughput := Throughput{
+		BytesPerSecond: b.rate,
+		Bytes:          map[proto.PacketKind]int64{},
+		Throttled:      b.throttled,
+	}
+	for kind, bytes := range b.bytes {
+		throughput.Bytes[kind] = bytes
+	}
+	return throughput
+}
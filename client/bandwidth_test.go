@@ -0,0 +1,53 @@
+package client
+
+import (
+	"testing"
+	"time"
+
+	"github.com/MagalixCorp/magalix-agent/v2/proto"
+)
+
+func TestBandwidth_Wait(t *testing.T) {
+	tests := []struct {
+		name     string
+		limit    int
+		kind     proto.PacketKind
+		size     int
+		wantWait time.Duration
+	}{
+		{
+			name:  "unlimited",
+			kind:  proto.PacketKindMetricsStoreV2Request,
+			size:  10000,
+			limit: 0,
+		},
+		{
+			name:     "limited beyond burst",
+			kind:     proto.PacketKindMetricsStoreV2Request,
+			size:     300,
+			limit:    1000,
+			wantWait: 200 * time.Millisecond,
+		},
+		{
+			name:  "critical kind bypasses the limit",
+			kind:  proto.PacketKindAutomationFeedback,
+			size:  300,
+			limit: 1000,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bandwidth := NewBandwidth(tt.limit, 100, DefaultBypassKinds)
+			started := time.Now()
+			bandwidth.Wait(tt.kind, tt.size)
+			waited := time.Since(started)
+
+			if waited < tt.wantWait*9/10 || waited > tt.wantWait+100*time.Millisecond {
+				t.Errorf("waited %v, want about %v", waited, tt.wantWait)
+			}
+			if got := bandwidth.Throughput().Bytes[tt.kind]; got != int64(tt.size) {
+				t.Errorf("Throughput().Bytes = %v, want %v", got, tt.size)
+			}
+		})
+	}
+}
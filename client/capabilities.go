@@ -0,0 +1,119 @@
+package client
+
+import (
+	"errors"
+
+	"github.com/MagalixCorp/magalix-agent/v2/proto"
+	"github.com/MagalixTechnologies/core/logger"
+)
+
+// errIncompatibleGateway returned when hello shows that the agent gateway can't serve this agent
+var errIncompatibleGateway = errors.New("incompatible agent gateway")
+
+// legacyKinds packet kinds supported by agent gateways that don't negotiate capabilities
+var legacyKinds = []proto.PacketKind{
+	proto.PacketKindHello,
+	proto.PacketKindAuthorizationRequest,
+	proto.PacketKindAuthorizationAnswer,
+	proto.PacketKindPing,
+	proto.PacketKindBye,
+	proto.PacketKindLogs,
+	proto.PacketKindMetricsStoreV2Request,
+	proto.PacketKindEntitiesDeltasRequest,
+	proto.PacketKindEntitiesResyncRequest,
+	proto.PacketKindAutomation,
+	proto.PacketKindAutomationFeedback,
+	proto.PacketKindRestart,
+	proto.PacketKindLogLevel,
+}
+
+// agentKinds packet kinds added after capabilities negotiation
+// they are used only if the agent gateway advertises them
+var agentKinds = []proto.PacketKind{
+	proto.PacketKindChunk,
+	proto.PacketKindConfig,
+}
+
+// handshakeKinds packet kinds sent before capabilities are negotiated
+var handshakeKinds = []proto.PacketKind{
+	proto.PacketKindHello,
+	proto.PacketKindAuthorizationRequest,
+	proto.PacketKindAuthorizationAnswer,
+	proto.PacketKindPing,
+}
+
+// legacyCapabilities capabilities assumed for agent gateways that don't advertise any
+func legacyCapabilities() proto.Capabilities {
+	capabilities := proto.Capabilities{
+		proto.CapabilityPacketsV2,
+		proto.CodecCapability(proto.CodecSnappy),
+	}
+	for _, kind := range legacyKinds {
+		capabilities = append(capabilities, proto.KindCapability(kind))
+	}
+	return capabilities
+}
+
+// agentCapabilities capabilities advertised by the agent in hello
+func (client *Client) agentCapabilities() proto.Capabilities {
+	capabilities := append(legacyCapabilities(), proto.CapabilityEnvelope)
+	for _, kind := range agentKinds {
+		capabilities = append(capabilities, proto.KindCapability(kind))
+	}
+	for _, name := range client.codecs {
+		capability := proto.CodecCapability(name)
+		if _, ok := proto.GetCodec(name); ok && !capabilities.Has(capability) {
+			capabilities = append(capabilities, capability)
+		}
+	}
+	for _, name := range client.formats {
+		capability := proto.FormatCapability(name)
+		if _, ok := proto.GetFormat(name); ok && !capabilities.Has(capability) {
+			capabilities = append(capabilities, capability)
+		}
+	}
+	return capabilities
+}
+
+// negotiate enables capabilities advertised by both the agent and the agent gateway
+func (client *Client) negotiate(server proto.Capabilities) {
+	if len(server) == 0 {
+		server = legacyCapabilities()
+	}
+	capabilities := client.agentCapabilities().Intersect(server)
+	codec := client.chooseCodec(capabilities)
+	format := client.chooseFormat(capabilities)
+
+	client.capabilitiesM.Lock()
+	client.capabilities = capabilities
+	client.codec = codec
+	client.format = format
+	client.capabilitiesM.Unlock()
+
+	logger.Infow(
+		"capabilities have been negotiated",
+		"capabilities", capabilities,
+		"codec", codec.Name(),
+		"format", format.Name(),
+	)
+}
+
+// Supports checks if a capability is enabled with the current agent gateway
+func (client *Client) Supports(capability proto.Capability) bool {
+	client.capabilitiesM.Lock()
+	defer client.capabilitiesM.Unlock()
+	if client.capabilities == nil {
+		return legacyCapabilities().Has(capability)
+	}
+	return client.capabilities.Has(capability)
+}
+
+// supportsKind checks if a packet kind can be sent to the current agent gateway
+func (client *Client) supportsKind(kind proto.PacketKind) bool {
+	for _, item := range handshakeKinds {
+		if item == kind {
+			return true
+		}
+	}
+	return client.Supports(proto.KindCapability(kind))
+}
@@ -0,0 +1,252 @@
+package client
+
+import (
+	"encoding/gob"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/MagalixCorp/magalix-agent/v2/proto"
+	"github.com/MagalixTechnologies/core/logger"
+)
+
+const (
+	CaptureOutbound = "outbound"
+	CaptureInbound  = "inbound"
+
+	// captureFormatGOB format of hello frames, they are sent before a format is negotiated
+	captureFormatGOB = "gob"
+)
+
+// CaptureRecord a frame exchanged with the agent gateway written to a capture file
+type CaptureRecord struct {
+	Time      time.Time
+	Direction string
+	Kind      proto.PacketKind
+	// Response the frame answers a request of Kind sent in the other direction
+	Response bool
+	// Enveloped the packet is wrapped in an envelope with an idempotency id
+	Enveloped bool
+	Codec     string
+	Format    string
+	Payload   []byte
+	// Error a request failed instead of being answered
+	Error string
+	// Redacted sensitive fields are removed from the payload
+	Redacted bool
+}
+
+// Capture writes frames exchanged with the agent gateway to a file, used for debugging
+// sensitive fields are redacted before frames are written
+type Capture struct {
+	sync.Mutex
+
+	file    *os.File
+	encoder *gob.Encoder
+}
+
+// NewCapture creates a capture writing to the file, an existing file is truncated
+func NewCapture(path string) (*Capture, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create capture file, error: %w", err)
+	}
+	return &Capture{
+		file:    file,
+		encoder: gob.NewEncoder(file),
+	}, nil
+}
+
+// Write redacts and appends a frame to the capture file
+func (c *Capture) Write(record CaptureRecord) error {
+	redact(&record)
+
+	c.Lock()
+	defer c.Unlock()
+	if c.file == nil {
+		return nil
+	}
+	if err := c.encoder.Encode(record); err != nil {
+		return fmt.Errorf("unable to write to capture file, error: %w", err)
+	}
+	return nil
+}
+
+// Close closes the capture file
+func (c *Capture) Close() error {
+	c.Lock()
+	defer c.Unlock()
+	if c.file == nil {
+		return nil
+	}
+	err := c.file.Close()
+	c.file = nil
+	return err
+}
+
+// ReadCaptureFile calls fn for every record in a capture file in the order they were written
+// a truncated last record, left by a crash while writing, is skipped
+func ReadCaptureFile(path string, fn func(record *CaptureRecord) error) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("unable to open capture file, error: %w", err)
+	}
+	defer file.Close()
+
+	decoder := gob.NewDecoder(file)
+	for {
+		var record CaptureRecord
+		err := decoder.Decode(&record)
+		if err == io.EOF {
+			return nil
+		}
+		if err == io.ErrUnexpectedEOF {
+			logger.Warnw("capture file ends with a truncated record", "file", path)
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("unable to decode capture file, error: %w", err)
+		}
+		if err := fn(&record); err != nil {
+			return err
+		}
+	}
+}
+
+// DecodeCaptureRecord decodes the packet of a captured frame
+// json packets are decoded as generic values, so fields unknown to this agent are kept
+func DecodeCaptureRecord(record *CaptureRecord) (interface{}, error) {
+	if len(record.Payload) == 0 {
+		return nil, nil
+	}
+	if record.Format == captureFormatGOB {
+		var hello proto.PacketHello
+		if err := proto.DecodeGOB(record.Payload, &hello); err != nil {
+			return nil, err
+		}
+		return hello, nil
+	}
+
+	codec, ok := proto.GetCodec(record.Codec)
+	if !ok {
+		return nil, fmt.Errorf("unsupported codec %s", record.Codec)
+	}
+	format, ok := proto.GetFormat(record.Format)
+	if !ok {
+		return nil, fmt.Errorf("unsupported format %s", record.Format)
+	}
+	if format.Name() == proto.FormatJSON {
+		var packet interface{}
+		if err := proto.DecodePacket(format, codec, record.Payload, &packet); err != nil {
+			return nil, err
+		}
+		return packet, nil
+	}
+	return decodeCapturedPacket(record, format, codec)
+}
+
+// decodeCapturedPacket decodes a frame to the packet type of its kind
+func decodeCapturedPacket(record *CaptureRecord, format proto.Format, codec proto.Codec) (interface{}, error) {
+	var (
+		packet interface{}
+		ok     bool
+	)
+	switch {
+	case record.Enveloped && record.Response:
+		packet, ok = &proto.PacketEnvelopeAck{}, true
+	case record.Enveloped:
+		var envelope proto.PacketEnvelope
+		if err := proto.DecodePacket(format, codec, record.Payload, &envelope); err != nil {
+			return nil, err
+		}
+		data, _ := envelope.Data.([]byte)
+		packet, ok = proto.NewPacket(record.Kind)
+		if !ok {
+			return nil, fmt.Errorf("unknown packet kind %s", record.Kind)
+		}
+		if err := format.Unmarshal(data, packet); err != nil {
+			return nil, err
+		}
+		envelope.Data = packet
+		return envelope, nil
+	case record.Response:
+		packet, ok = proto.NewResponse(record.Kind)
+	default:
+		packet, ok = proto.NewPacket(record.Kind)
+	}
+	if !ok {
+		return nil, fmt.Errorf("unknown packet kind %s", record.Kind)
+	}
+	if err := proto.DecodePacket(format, codec, record.Payload, packet); err != nil {
+		return nil, err
+	}
+	return packet, nil
+}
+
+// redact removes authorization tokens from a frame
+// the payload is dropped if it can't be decoded
+func redact(record *CaptureRecord) {
+	sensitive := (record.Kind == proto.PacketKindAuthorizationRequest && record.Response) ||
+		(record.Kind == proto.PacketKindAuthorizationAnswer && !record.Response)
+	if !sensitive || len(record.Payload) == 0 {
+		return
+	}
+	record.Redacted = true
+
+	codec, codecOk := proto.GetCodec(record.Codec)
+	format, formatOk := proto.GetFormat(record.Format)
+	if !codecOk || !formatOk {
+		record.Payload = nil
+		return
+	}
+	packet, err := decodeCapturedPacket(record, format, codec)
+	if err != nil {
+		record.Payload = nil
+		return
+	}
+	switch packet := packet.(type) {
+	case *proto.PacketAuthorizationQuestion:
+		packet.Token = nil
+	case *proto.PacketAuthorizationAnswer:
+		packet.Token = nil
+	}
+	record.Payload, err = proto.EncodePacket(format, codec, record.Kind, packet)
+	if err != nil {
+		record.Payload = nil
+	}
+}
+
+// capture writes a frame to the capture file if capturing is enabled
+func (client *Client) capture(
+	direction string,
+	kind proto.PacketKind,
+	response bool,
+	enveloped bool,
+	payload []byte,
+	err error,
+) {
+	if client.captureFile == nil {
+		return
+	}
+	record := CaptureRecord{
+		Time:      time.Now().UTC(),
+		Direction: direction,
+		Kind:      kind,
+		Response:  response,
+		Enveloped: enveloped,
+		Codec:     client.getCodec().Name(),
+		Format:    client.getFormat().Name(),
+		Payload:   payload,
+	}
+	if kind == proto.PacketKindHello {
+		record.Codec, record.Format = "", captureFormatGOB
+	}
+	if err != nil {
+		record.Error = err.Error()
+	}
+	if err := client.captureFile.Write(record); err != nil {
+		logger.Warnw("unable to capture frame", "kind", kind, "error", err)
+	}
+}
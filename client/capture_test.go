@@ -0,0 +1,94 @@
+package client
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/MagalixCorp/magalix-agent/v2/proto"
+)
+
+func TestCapture_Redact(t *testing.T) {
+	tests := []struct {
+		name     string
+		format   string
+		response bool
+		kind     proto.PacketKind
+		in       interface{}
+		want     interface{}
+	}{
+		{
+			name:   "answer token is redacted",
+			format: proto.FormatJSON,
+			kind:   proto.PacketKindAuthorizationAnswer,
+			in:     proto.PacketAuthorizationAnswer{Token: []byte("secret")},
+			want:   map[string]interface{}{"token": nil},
+		},
+		{
+			name:     "question token is redacted",
+			format:   proto.FormatProtobuf,
+			response: true,
+			kind:     proto.PacketKindAuthorizationRequest,
+			in:       proto.PacketAuthorizationQuestion{Token: []byte("secret")},
+			want:     &proto.PacketAuthorizationQuestion{},
+		},
+		{
+			name:   "other packets are kept",
+			format: proto.FormatProtobuf,
+			kind:   proto.PacketKindLogLevel,
+			in:     proto.PacketLogLevel{Level: "debug"},
+			want:   &proto.PacketLogLevel{Level: "debug"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "capture")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+			path := filepath.Join(dir, "frames")
+
+			capture, err := NewCapture(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			format, _ := proto.GetFormat(tt.format)
+			codec, _ := proto.GetCodec(proto.CodecSnappy)
+			payload, err := proto.EncodePacket(format, codec, tt.kind, tt.in)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = capture.Write(CaptureRecord{
+				Direction: CaptureOutbound,
+				Kind:      tt.kind,
+				Response:  tt.response,
+				Codec:     codec.Name(),
+				Format:    format.Name(),
+				Payload:   payload,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			capture.Close()
+
+			var records []*CaptureRecord
+			err = ReadCaptureFile(path, func(record *CaptureRecord) error {
+				records = append(records, record)
+				return nil
+			})
+			if err != nil || len(records) != 1 {
+				t.Fatalf("ReadCaptureFile() records = %v, error = %v", len(records), err)
+			}
+			got, err := DecodeCaptureRecord(records[0])
+			if err != nil {
+				t.Fatalf("DecodeCaptureRecord() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("DecodeCaptureRecord() = %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,250 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/MagalixCorp/magalix-agent/v2/proto"
+	"github.com/MagalixTechnologies/core/logger"
+	"github.com/MagalixTechnologies/uuid-go"
+)
+
+// chunkTransferTimeout incomplete transfers not updated for this long are dropped
+const chunkTransferTimeout = 10 * time.Minute
+
+// split splits a package into chunk packages when its encoding with the negotiated format is larger than the chunk size
+// every chunk is piped and retried on its own
+// the encoded size is kept on the packages, so the pipe budget doesn't encode them again
+// it must not log, as it is reachable from Client.Write piping logs, the pipe workers log chunked transfers
+// chunks inherit priority, expiry time and retries of the package but not the expiry count,
+// as a count of packages of the same kind doesn't apply to parts of a single package
+func (client *Client) split(pack Package) []Package {
+	format := client.getFormat()
+	data, err := format.Marshal(pack.Kind, pack.Data)
+	if err != nil {
+		// the error is reported when the package is sent
+		return []Package{pack}
+	}
+	if format.Name() == proto.FormatJSON {
+		// keep the encoded form, so it is not encoded again when sent
+		pack.Data = json.RawMessage(data)
+	}
+	pack.size = len(data)
+
+	if client.chunkSize <= 0 || len(data) <= client.chunkSize || !client.supportsKind(proto.PacketKindChunk) {
+		return []Package{pack}
+	}
+
+	transferID := uuid.NewV4().String()
+	total := (len(data) + client.chunkSize - 1) / client.chunkSize
+	packs := make([]Package, 0, total)
+	for i := 0; i < total; i++ {
+		start := i * client.chunkSize
+		end := start + client.chunkSize
+		if end > len(data) {
+			end = len(data)
+		}
+		packs = append(packs, Package{
+			ID:         fmt.Sprintf("%s/%d", pack.ID, i),
+			Kind:       proto.PacketKindChunk,
+			ExpiryTime: pack.ExpiryTime,
+			Priority:   pack.Priority,
+			Retries:    pack.Retries,
+			size:       end - start,
+			Data: proto.PacketChunk{
+				TransferID: transferID,
+				Kind:       pack.Kind,
+				Index:      i,
+				Total:      total,
+				Data:       data[start:end],
+				Format:     format.Name(),
+			},
+		})
+	}
+	return packs
+}
+
+type chunkTransfer struct {
+	kind     proto.PacketKind
+	parts    [][]byte
+	received int
+	updated  time.Time
+}
+
+// Reassembler collects chunks until all parts of a transfer are received
+type Reassembler struct {
+	sync.Mutex
+
+	transfers map[string]*chunkTransfer
+	timeout   time.Duration
+}
+
+// NewReassembler creates a new reassembler dropping transfers not updated within timeout
+func NewReassembler(timeout time.Duration) *Reassembler {
+	return &Reassembler{
+		transfers: map[string]*chunkTransfer{},
+		timeout:   timeout,
+	}
+}
+
+// Add adds a chunk, returns the encoded packet once all chunks of the transfer are received
+// duplicate chunks are ignored so chunks can be retried safely
+func (r *Reassembler) Add(chunk *proto.PacketChunk) ([]byte, bool, error) {
+	parts, complete, err := r.add(chunk)
+	if !complete || err != nil {
+		return nil, complete, err
+	}
+	return join(parts), true, nil
+}
+
+// add adds a chunk, returns the parts once all chunks of the transfer are received
+func (r *Reassembler) add(chunk *proto.PacketChunk) ([][]byte, bool, error) {
+	if chunk.Total <= 0 || chunk.Index < 0 || chunk.Index >= chunk.Total {
+		return nil, false, fmt.Errorf(
+			"invalid chunk %d of %d for transfer %s", chunk.Index, chunk.Total, chunk.TransferID,
+		)
+	}
+
+	r.Lock()
+	defer r.Unlock()
+
+	now := time.Now()
+	for id, transfer := range r.transfers {
+		if now.Sub(transfer.updated) > r.timeout {
+			logger.Warnw("dropping incomplete chunked transfer", "transfer", id, "kind", transfer.kind)
+			delete(r.transfers, id)
+		}
+	}
+
+	transfer, ok := r.transfers[chunk.TransferID]
+	if !ok {
+		transfer = &chunkTransfer{
+			kind:  chunk.Kind,
+			parts: make([][]byte, chunk.Total),
+		}
+		r.transfers[chunk.TransferID] = transfer
+	}
+	if len(transfer.parts) != chunk.Total || transfer.kind != chunk.Kind {
+		return nil, false, fmt.Errorf("chunk doesn't match transfer %s", chunk.TransferID)
+	}
+	transfer.updated = now
+	if transfer.parts[chunk.Index] == nil {
+		transfer.parts[chunk.Index] = chunk.Data
+		transfer.received++
+	}
+	if transfer.received < len(transfer.parts) {
+		return nil, false, nil
+	}
+
+	delete(r.transfers, chunk.TransferID)
+	return transfer.parts, true, nil
+}
+
+// reopen restores a completed transfer without the chunk, so the transfer completes again when the chunk is retried
+func (r *Reassembler) reopen(chunk *proto.PacketChunk, parts [][]byte) {
+	r.Lock()
+	defer r.Unlock()
+
+	parts[chunk.Index] = nil
+	r.transfers[chunk.TransferID] = &chunkTransfer{
+		kind:     chunk.Kind,
+		parts:    parts,
+		received: len(parts) - 1,
+		updated:  time.Now(),
+	}
+}
+
+func join(parts [][]byte) []byte {
+	data := []byte{}
+	for _, part := range parts {
+		data = append(data, part...)
+	}
+	return data
+}
+
+// sendUnchunked collects chunks piped for an agent gateway that doesn't support them,
+// e.g. after failing over to an older one, and sends the packet once all its chunks are collected
+// the packet keeps the id of the chunked package, chunk ids are derived from it
+func (client *Client) sendUnchunked(id string, in interface{}) error {
+	chunk, ok := in.(proto.PacketChunk)
+	if !ok {
+		return fmt.Errorf("invalid chunk packet of type %T", in)
+	}
+
+	parts, complete, err := client.unchunker.add(&chunk)
+	if err != nil {
+		return err
+	}
+	if !complete {
+		return nil
+	}
+
+	from, ok := proto.GetFormat(chunk.Format)
+	if !ok {
+		return fmt.Errorf("unsupported format %s of chunked packet", chunk.Format)
+	}
+	packet, ok := proto.NewPacket(chunk.Kind)
+	if !ok {
+		return fmt.Errorf("unknown chunked packet kind %s", chunk.Kind)
+	}
+	if err := from.Unmarshal(join(parts), packet); err != nil {
+		return fmt.Errorf("unable to decode chunked %s packet, error: %w", chunk.Kind, err)
+	}
+
+	logger.Infow(
+		"agent gateway doesn't support chunks, sending reassembled packet",
+		"kind", chunk.Kind,
+		"transfer", chunk.TransferID,
+	)
+	id = strings.TrimSuffix(id, fmt.Sprintf("/%d", chunk.Index))
+	err = client.SendIdempotent(id, chunk.Kind, reflect.ValueOf(packet).Elem().Interface())
+	if err != nil {
+		client.unchunker.reopen(&chunk, parts)
+		return err
+	}
+	return nil
+}
+
+// handleChunk handles chunks sent by the agent gateway
+// a completed transfer is passed to the listener of its packet kind
+func (client *Client) handleChunk(in []byte) ([]byte, error) {
+	var chunk proto.PacketChunk
+	if err := client.Decode(in, &chunk); err != nil {
+		return nil, err
+	}
+
+	data, complete, err := client.reassembler.Add(&chunk)
+	if err != nil {
+		return nil, err
+	}
+	if !complete {
+		return client.Encode(proto.PacketChunkResponse{})
+	}
+
+	client.listenersM.Lock()
+	listener, ok := client.listeners[chunk.Kind]
+	client.listenersM.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("no listener for chunked packet kind %s", chunk.Kind)
+	}
+
+	// the listener decodes with the current format, the transfer may have started with another one
+	from, ok := proto.GetFormat(chunk.Format)
+	if !ok {
+		return nil, fmt.Errorf("unsupported format %s of chunked packet", chunk.Format)
+	}
+	data, err = proto.Transcode(chunk.Kind, from, client.getFormat(), data)
+	if err != nil {
+		return nil, err
+	}
+
+	payload, err := client.getCodec().Compress(data)
+	if err != nil {
+		return nil, err
+	}
+	return listener(payload)
+}
@@ -0,0 +1,180 @@
+package client
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/MagalixCorp/magalix-agent/v2/proto"
+)
+
+func TestClient_SplitAndReassemble(t *testing.T) {
+	tests := []struct {
+		name       string
+		chunkSize  int
+		data       string
+		wantChunks int
+	}{
+		{
+			name:       "chunking disabled",
+			chunkSize:  0,
+			data:       strings.Repeat("a", 100),
+			wantChunks: 0,
+		},
+		{
+			name:       "small packet is not split",
+			chunkSize:  1000,
+			data:       strings.Repeat("a", 100),
+			wantChunks: 0,
+		},
+		{
+			name:       "large packet is split",
+			chunkSize:  10,
+			data:       strings.Repeat("a", 95),
+			wantChunks: 10,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &Client{
+				chunkSize:    tt.chunkSize,
+				capabilities: proto.Capabilities{proto.KindCapability(proto.PacketKindChunk)},
+			}
+			packs := client.split(Package{
+				ID:          "pack",
+				Kind:        proto.PacketKindEntitiesResyncRequest,
+				ExpiryCount: 2,
+				Priority:    1,
+				Data:        tt.data,
+			})
+
+			if tt.wantChunks == 0 {
+				if len(packs) != 1 || packs[0].Kind != proto.PacketKindEntitiesResyncRequest {
+					t.Fatalf("Client.split() = %v packages, want the package itself", len(packs))
+				}
+				// the json encoded string is quoted
+				if packs[0].size != len(tt.data)+2 {
+					t.Errorf("Client.split() size = %v, want %v", packs[0].size, len(tt.data)+2)
+				}
+				return
+			}
+			if len(packs) != tt.wantChunks {
+				t.Fatalf("Client.split() = %v chunks, want %v", len(packs), tt.wantChunks)
+			}
+
+			if packs[1].ID != "pack/1" {
+				t.Errorf("chunk id = %v, want %v", packs[1].ID, "pack/1")
+			}
+
+			reassembler := NewReassembler(time.Minute)
+			// deliver in reverse order with a duplicate to check retries are harmless
+			packs = append(packs, packs[0])
+			var data []byte
+			for i := len(packs) - 1; i >= 0; i-- {
+				if packs[i].Kind != proto.PacketKindChunk || packs[i].ExpiryCount != 0 {
+					t.Fatalf("chunk package = %v, want chunk kind without expiry count", packs[i])
+				}
+				chunk := packs[i].Data.(proto.PacketChunk)
+				got, complete, err := reassembler.Add(&chunk)
+				if err != nil {
+					t.Fatalf("Reassembler.Add() error = %v", err)
+				}
+				if complete {
+					data = got
+				}
+			}
+
+			var got string
+			if err := json.Unmarshal(data, &got); err != nil {
+				t.Fatalf("unable to decode reassembled packet: %v", err)
+			}
+			if got != tt.data {
+				t.Errorf("reassembled packet = %v, want %v", got, tt.data)
+			}
+		})
+	}
+}
+
+func TestClient_SendUnchunked(t *testing.T) {
+	tests := []struct {
+		name     string
+		failLast bool
+	}{
+		{name: "chunks are reassembled"},
+		{name: "last chunk is retried after failing", failLast: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "spool")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			// every record is written to a new file, so removing the directory fails the next write
+			spool, err := NewSpool(dir, 1, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			client := newClient(Options{GatewayURLs: []string{"wss://gateway"}, Spool: spool, ChunkSize: 10})
+
+			logs := proto.PacketLogs{{Data: strings.Repeat("a", 50)}}
+			client.capabilities = proto.Capabilities{proto.KindCapability(proto.PacketKindChunk)}
+			packs := client.split(Package{ID: "pack", Kind: proto.PacketKindLogs, Data: logs})
+			if len(packs) < 2 {
+				t.Fatalf("Client.split() = %v packages, want chunks", len(packs))
+			}
+			// failed over to an agent gateway that doesn't support chunks
+			client.capabilities = legacyCapabilities()
+
+			last := packs[len(packs)-1]
+			for _, pack := range packs[:len(packs)-1] {
+				if err := client.SendIdempotent(pack.ID, pack.Kind, pack.Data); err != nil {
+					t.Fatalf("Client.SendIdempotent() error = %v", err)
+				}
+			}
+			if tt.failLast {
+				if err := os.RemoveAll(dir); err != nil {
+					t.Fatal(err)
+				}
+				if err := client.SendIdempotent(last.ID, last.Kind, last.Data); err == nil {
+					t.Fatalf("Client.SendIdempotent() error = nil, want an error")
+				}
+				if err := os.MkdirAll(dir, 0755); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := client.SendIdempotent(last.ID, last.Kind, last.Data); err != nil {
+				t.Fatalf("Client.SendIdempotent() error = %v", err)
+			}
+
+			files, err := ListSpoolFiles(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var records []*SpoolRecord
+			for _, file := range files {
+				err := ReadSpoolFile(file, func(record *SpoolRecord) error {
+					records = append(records, record)
+					return nil
+				})
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			if len(records) != 1 || records[0].Kind != proto.PacketKindLogs {
+				t.Fatalf("sent records = %v, want a single logs packet", records)
+			}
+			var got proto.PacketLogs
+			if err := proto.DecodeSnappy(records[0].Payload, &got); err != nil {
+				t.Fatalf("unable to decode sent packet: %v", err)
+			}
+			if len(got) != 1 || got[0].Data != logs[0].Data {
+				t.Errorf("sent packet = %v, want %v", got, logs)
+			}
+		})
+	}
+}
@@ -1,6 +1,8 @@
 package client
 
 import (
+	"context"
+	"errors"
 	"net/url"
 	"sync"
 	"time"
@@ -9,6 +11,7 @@ import (
 	"github.com/MagalixTechnologies/channel"
 	"github.com/MagalixTechnologies/core/logger"
 	"github.com/MagalixTechnologies/uuid-go"
+	"github.com/gorilla/websocket"
 )
 
 const (
@@ -27,24 +30,51 @@ type timeouts struct {
 // Client agent gateway client
 // Client agent gateway client
 type Client struct {
-	address          string
+	endpoints        *endpoints
 	version          string
 	startID          string
 	AccountID        uuid.UUID
 	ClusterID        uuid.UUID
-	secret           []byte
 	ServerVersion    string
 	AgentPermissions string
 
-	channel    *channel.Client
-	connected  bool
-	authorized bool
+	authenticator Authenticator
+	proxy         *ProxyConfig
+
+	channel *channel.Client
+	server  uuid.UUID
+	conn    *websocket.Conn
+
+	state        *stateMachine
+	giveUpPolicy GiveUpPolicy
+	// dormantUntil end of the dormant period, zero if dormant indefinitely
+	dormantUntil time.Time
+
+	// capabilities enabled with the current agent gateway, nil before hello
+	// guarded by its own mutex as packages are piped while blockedM is held
+	capabilities  proto.Capabilities
+	capabilitiesM sync.Mutex
+	// codecs names of codecs supported by the agent in order of preference
+	codecs []string
+	// codec negotiated with the current agent gateway
+	codec proto.Codec
+	// formats names of packet formats supported by the agent in order of preference
+	formats []string
+	// format negotiated with the current agent gateway
+	format proto.Format
+
+	// chunkSize packets larger than this are split into chunks, 0 disables chunking
+	chunkSize   int
+	reassembler *Reassembler
+	// unchunker reassembles piped chunks for agent gateways that don't support chunks
+	unchunker *Reassembler
+
+	listeners  map[proto.PacketKind]func(in []byte) ([]byte, error)
+	listenersM sync.Mutex
 
 	shouldSendLogs  bool
 	logBuffer       proto.PacketLogs
 
-	// for thread blocked on connection
-	blocked  sync.Map
 	blockedM sync.Mutex
 
 	timeouts timeouts
@@ -54,88 +84,157 @@ type Client struct {
 	pipe       *Pipe
 	pipeStatus *Pipe
 
+	// spool when set packets are written to spool files instead of the gateway
+	spool *Spool
+	// captureFile when set frames exchanged with the gateway are written to it
+	captureFile *Capture
+
+	bandwidth *Bandwidth
+
+	// acked ids of piped packets acknowledged by the agent gateway
+	acked *ackWindow
+
 	watchdogTicker *time.Ticker
+
+	latencies *sendLatencies
+	// startOnce starts workers shared by restarts of Connect
+	startOnce sync.Once
+}
+
+// Options options of a client
+type Options struct {
+	// GatewayURLs agent gateway urls, the client fails over to the next one
+	GatewayURLs []string
+	// AllowPlaintext ws urls are dialed without tls instead of being upgraded to wss, meant for the mock gateway
+	AllowPlaintext bool
+	Version     string
+	StartID     string
+	AccountID   uuid.UUID
+	ClusterID   uuid.UUID
+
+	Authenticator    Authenticator
+	ServerVersion    string
+	AgentPermissions string
+
+	ProtoHandshake time.Duration
+	ProtoWrite     time.Duration
+	ProtoRead      time.Duration
+	ProtoReconnect time.Duration
+	ProtoBackoff   time.Duration
+
+	SendLogs  bool
+	PipeStore PipeStore
+	// Spool packets are written to spool files instead of being sent if set
+	Spool   *Spool
+	Capture *Capture
+	Codecs  []string
+	Formats []string
+	// ChunkSize packets encoded larger are sent in chunks, 0 disables chunking
+	ChunkSize     int
+	FailoverAfter int
+	FailbackAfter time.Duration
+	Proxy         *ProxyConfig
+	GiveUpPolicy  GiveUpPolicy
+	Bandwidth     *Bandwidth
 }
 
 // newClient creates a new client
-func newClient(
-	address string,
-	version string,
-	startID string,
-	accountID uuid.UUID,
-	clusterID uuid.UUID,
-	secret []byte,
-	serverVersion string,
-	agentPermissions string,
-	timeouts timeouts,
-	shouldSendLogs bool,
-) *Client {
-	gwUrl, err := url.Parse(address)
+func newClient(options Options) *Client {
+	endpoints, err := newEndpoints(options.GatewayURLs, options.FailoverAfter, options.FailbackAfter, options.AllowPlaintext)
 	if err != nil {
 		panic(err)
 	}
 
-	if gwUrl.Scheme == "ws" {
-		gwUrl.Scheme = "wss"
+	protoTimeouts := timeouts{
+		protoHandshake: options.ProtoHandshake,
+		protoWrite:     options.ProtoWrite,
+		protoRead:      options.ProtoRead,
+		protoReconnect: options.ProtoReconnect,
+		protoBackoff:   options.ProtoBackoff,
 	}
 
-	address = gwUrl.String()
+	// the channel client is used for its channel only, connections are dialed by Client.listen
+	gwUrl, err := url.Parse(endpoints.Current())
+	if err != nil {
+		panic(err)
+	}
 
 	client := &Client{
-		address:          address,
-		version:          version,
-		startID:          startID,
-		AccountID:        accountID,
-		ClusterID:        clusterID,
-		secret:           secret,
-		ServerVersion:    serverVersion,
-		shouldSendLogs:   shouldSendLogs,
-		AgentPermissions: agentPermissions,
+		endpoints:        endpoints,
+		version:          options.Version,
+		startID:          options.StartID,
+		AccountID:        options.AccountID,
+		ClusterID:        options.ClusterID,
+		authenticator:    options.Authenticator,
+		proxy:            options.Proxy,
+		ServerVersion:    options.ServerVersion,
+		shouldSendLogs:   options.SendLogs,
+		AgentPermissions: options.AgentPermissions,
 		channel: channel.NewClient(*gwUrl, channel.ChannelOptions{
-			ProtoHandshake: timeouts.protoHandshake,
-			ProtoWrite:     timeouts.protoWrite,
-			ProtoRead:      timeouts.protoRead,
-			ProtoReconnect: timeouts.protoReconnect,
+			ProtoHandshake: protoTimeouts.protoHandshake,
+			ProtoWrite:     protoTimeouts.protoWrite,
+			ProtoRead:      protoTimeouts.protoRead,
+			ProtoReconnect: protoTimeouts.protoReconnect,
 		}),
 		logBuffer: make(proto.PacketLogs, 0, 10),
-		blocked:   sync.Map{},
 		blockedM:  sync.Mutex{},
 
-		timeouts: timeouts,
+		state:        newStateMachine(StateDisconnected),
+		giveUpPolicy: options.GiveUpPolicy,
+
+		timeouts: protoTimeouts,
+
+		spool:       options.Spool,
+		captureFile: options.Capture,
+
+		bandwidth: options.Bandwidth,
+		acked:     newAckWindow(ackWindowSize),
+		latencies: newSendLatencies(),
+
+		codecs:  options.Codecs,
+		formats: options.Formats,
+
+		chunkSize:   options.ChunkSize,
+		reassembler: NewReassembler(chunkTransferTimeout),
+		unchunker:   NewReassembler(chunkTransferTimeout),
+		listeners:   map[proto.PacketKind]func(in []byte) ([]byte, error){},
+	}
+
+	// there is no connection to wait for in spool mode
+	if options.Spool != nil {
+		client.state.set(StateReady)
 	}
 
-	client.pipe = NewPipe(client)
-	client.pipeStatus = NewPipe(client)
+	client.pipe = NewPipe(client, options.PipeStore)
+	client.pipeStatus = NewPipe(client, NewDefaultPipeStore())
+
+	client.AddListener(proto.PacketKindChunk, client.handleChunk)
 
 	return client
 }
 
+// errNotConnected returned when no connection is established with the agent gateway in time
+var errNotConnected = errors.New("timeout waiting for connection with agent gateway")
+
 // WaitForConnection waits for an established connection with the agent gateway
 // it blocks until the agent gateway is connected and the agent is authenticated
-// it takes a timeout parameter to return if not connected
+// it takes a timeout parameter to return if not connected, 0 waits indefinitely
 // returns true if connected false if timeout occurred
 // Example:
 //   WaitForConnection(time.Second * 10)
 func (client *Client) WaitForConnection(timeout time.Duration) bool {
-	if client.authorized {
-		return true
-	}
-	c := make(chan struct{})
-	defer func() {
-		client.blocked.Delete(c)
-		close(c)
-	}()
-	func() {
-		client.blockedM.Lock()
-		defer client.blockedM.Unlock()
-		client.blocked.Store(c, struct{}{})
-	}()
-	select {
-	case <-c:
-		return true
-	case <-time.After(timeout):
-		return false
-	}
+	return client.state.wait(StateReady, timeout)
+}
+
+// State returns the connection state and the time it was entered
+func (client *Client) State() (State, time.Time) {
+	return client.state.get()
+}
+
+// Subscribe returns a channel receiving connection state transitions and a function to unsubscribe
+// the current state is received first, the oldest transitions are dropped if the subscriber doesn't keep up
+func (client *Client) Subscribe() (<-chan StateTransition, func()) {
+	return client.state.subscribe()
 }
 
 func (client *Client) WithBackoff(fn func() error) {
@@ -164,33 +263,44 @@ func (client *Client) WithBackoffLimit(fn func() error, limit int) error {
 }
 
 // send sends a packet to the agent-gateway
-// it uses the default proto encoding to encode and decode in/out parameters
+// it uses the format and codec negotiated with the agent gateway to encode and decode in/out parameters
 func (client *Client) send(kind proto.PacketKind, in interface{}, out interface{}) error {
 	var (
 		req []byte
 		err error
 	)
+	format, codec := client.getFormat(), client.getCodec()
 	if kind == proto.PacketKindHello {
 		req, err = proto.EncodeGOB(in)
 		if err != nil {
 			return err
 		}
 	} else {
-		req, err = proto.EncodeSnappy(in)
+		req, err = proto.EncodePacket(format, codec, kind, in)
 		if err != nil {
 			return err
 		}
 	}
 
-	res, err := client.channel.Send(kind.String(), req)
+	if client.spool != nil {
+		err = client.spool.Write(kind, codec.Name(), req)
+		if err != nil {
+			return err
+		}
+		client.blockedM.Lock()
+		client.lastSent = time.Now()
+		client.blockedM.Unlock()
+		return nil
+	}
+
+	_, enveloped := in.(proto.PacketEnvelope)
+	client.capture(CaptureOutbound, kind, false, enveloped, req, nil)
+	res, err := client.sendRaw(kind, req)
+	client.capture(CaptureInbound, kind, true, enveloped, res, err)
 	if err != nil {
 		return err
 	}
 
-	client.blockedM.Lock()
-	client.lastSent = time.Now()
-	client.blockedM.Unlock()
-
 	if out == nil {
 		return nil
 	}
@@ -198,7 +308,42 @@ func (client *Client) send(kind proto.PacketKind, in interface{}, out interface{
 	if kind == proto.PacketKindHello {
 		return proto.DecodeGOB(res, out)
 	}
-	return proto.DecodeSnappy(res, out)
+	return proto.DecodePacket(format, codec, res, out)
+}
+
+// sendRaw sends an already encoded packet to the agent-gateway
+// it blocks until the bandwidth limiter allows sending it
+func (client *Client) sendRaw(kind proto.PacketKind, req []byte) ([]byte, error) {
+	client.bandwidth.Wait(kind, len(req))
+	started := time.Now()
+	res, err := client.channel.Channel.Send(client.serverID(), kind.String(), req)
+	if err != nil {
+		return nil, err
+	}
+	client.latencies.record(kind, time.Since(started))
+
+	client.blockedM.Lock()
+	client.lastSent = time.Now()
+	client.blockedM.Unlock()
+
+	return res, nil
+}
+
+// SendRaw sends a json packet already compressed with the named codec to the agent-gateway if there is an established connection
+// the packet is re-encoded if a different format or codec is negotiated with the agent gateway
+// it is used to replay spooled packets
+func (client *Client) SendRaw(kind proto.PacketKind, codecName string, req []byte) ([]byte, error) {
+	if !client.WaitForConnection(time.Minute) {
+		return nil, errNotConnected
+	}
+	req, err := client.transcode(kind, codecName, req)
+	if err != nil {
+		return nil, err
+	}
+	client.capture(CaptureOutbound, kind, false, false, req, nil)
+	res, err := client.sendRaw(kind, req)
+	client.capture(CaptureInbound, kind, true, false, res, err)
+	return res, err
 }
 
 // Send sends a packet to the agent-gateway if there is an established connection it internally uses client.send
@@ -206,7 +351,13 @@ func (client *Client) Send(kind proto.PacketKind, in interface{}, out interface{
 	logger.Debugw("sending package", "kind", kind)
 
 	defer logger.Debugw("package sent", "kind", kind)
-	client.WaitForConnection(time.Minute)
+	if !client.WaitForConnection(time.Minute) {
+		return errNotConnected
+	}
+	if !client.supportsKind(kind) {
+		logger.Warnw("packet kind is not supported by the agent gateway, dropping packet", "kind", kind)
+		return nil
+	}
 	return client.send(kind, in, out)
 }
 
@@ -227,53 +378,67 @@ func (client *Client) Pipe(pack Package) {
 	if client.pipe == nil {
 		panic("client pipe not defined")
 	}
-	client.pipe.Send(pack)
+	// chunk ids are derived from the package id, so retried chunks keep theirs
+	if pack.ID == "" {
+		pack.ID = uuid.NewV4().String()
+	}
+	for _, part := range client.split(pack) {
+		client.pipe.Send(part)
+	}
 	// i := client.pipe.Send(pack)  Uncomment after piping logs logic is implemented/revisited
 	// if i > 0 {
 	// 	logger.Errorw("discarded packets to agent-gateway", "#packets", i)
 	// }
 }
 
+// Throughput gets the outbound throughput to the agent gateway
+func (client *Client) Throughput() Throughput {
+	return client.bandwidth.Throughput()
+}
+
+// PipeStats gets usage of the pipe store and packages evicted to stay within its budget
+func (client *Client) PipeStats() PipeStats {
+	stats := client.pipe.storage.Stats()
+	stats.Dropped = client.pipe.Dropped()
+	return stats
+}
+
+// SendLatencies gets round trip times of packets sent to the agent gateway by kind
+func (client *Client) SendLatencies() map[proto.PacketKind]SendLatency {
+	return client.latencies.get()
+}
+
+// Drain rejects new packages other than logs and sends pending packages in priority order until the context is done
+// buffered logs are flushed first
+func (client *Client) Drain(ctx context.Context) DrainReport {
+	client.blockedM.Lock()
+	if len(client.logBuffer) > 0 {
+		client.flushLogs()
+	}
+	client.blockedM.Unlock()
+
+	report := client.pipe.Drain(ctx)
+	report.merge(client.pipeStatus.Drain(ctx))
+	return report
+}
+
 // AddListener adds a listener for a specific packet kind
 func (client *Client) AddListener(kind proto.PacketKind, listener func(in []byte) ([]byte, error)) {
-	if err := client.channel.AddListener(kind.String(), listener); err != nil {
+	captured := func(in []byte) ([]byte, error) {
+		client.capture(CaptureInbound, kind, false, false, in, nil)
+		out, err := listener(in)
+		client.capture(CaptureOutbound, kind, true, false, out, err)
+		return out, err
+	}
+	if err := client.channel.AddListener(kind.String(), captured); err != nil {
 		panic(err)
 	}
+	client.listenersM.Lock()
+	client.listeners[kind] = listener
+	client.listenersM.Unlock()
 }
 
 // InitClient inits client
-func InitClient(
-	version string,
-	startID string,
-	accountID, clusterID uuid.UUID,
-	secret []byte,
-	serverVersion string,
-	agentPermissions string,
-	gatewayUrl string,
-	protoHandshake time.Duration,
-	protoWrite time.Duration,
-	protoRead time.Duration,
-	protoReconnect time.Duration,
-	protoBackoff time.Duration,
-	sendLogs bool,
-) *Client {
-	client := newClient(
-		gatewayUrl,
-		version,
-		startID,
-		accountID,
-		clusterID,
-		secret,
-		serverVersion,
-		agentPermissions,
-		timeouts{
-			protoHandshake: protoHandshake,
-			protoWrite:     protoWrite,
-			protoRead:      protoRead,
-			protoReconnect: protoReconnect,
-			protoBackoff:   protoBackoff,
-		},
-		sendLogs,
-	)
-	return client
+func InitClient(options Options) *Client {
+	return newClient(options)
 }
@@ -0,0 +1,94 @@
+package client
+
+import (
+	"fmt"
+
+	"github.com/MagalixCorp/magalix-agent/v2/proto"
+)
+
+// chooseCodec picks the most preferred codec enabled in capabilities
+// falls back to snappy which every agent gateway supports
+func (client *Client) chooseCodec(capabilities proto.Capabilities) proto.Codec {
+	for _, name := range client.codecs {
+		if !capabilities.Has(proto.CodecCapability(name)) {
+			continue
+		}
+		if codec, ok := proto.GetCodec(name); ok {
+			return codec
+		}
+	}
+	codec, _ := proto.GetCodec(proto.CodecSnappy)
+	return codec
+}
+
+// getCodec gets the codec negotiated with the current agent gateway
+func (client *Client) getCodec() proto.Codec {
+	client.capabilitiesM.Lock()
+	codec := client.codec
+	client.capabilitiesM.Unlock()
+	if codec == nil {
+		codec, _ = proto.GetCodec(proto.CodecSnappy)
+	}
+	return codec
+}
+
+// chooseFormat picks the most preferred format enabled in capabilities
+// falls back to json which every agent gateway supports
+func (client *Client) chooseFormat(capabilities proto.Capabilities) proto.Format {
+	for _, name := range client.formats {
+		if !capabilities.Has(proto.FormatCapability(name)) {
+			continue
+		}
+		if format, ok := proto.GetFormat(name); ok {
+			return format
+		}
+	}
+	format, _ := proto.GetFormat(proto.FormatJSON)
+	return format
+}
+
+// getFormat gets the format negotiated with the current agent gateway
+func (client *Client) getFormat() proto.Format {
+	client.capabilitiesM.Lock()
+	format := client.format
+	client.capabilitiesM.Unlock()
+	if format == nil {
+		format, _ = proto.GetFormat(proto.FormatJSON)
+	}
+	return format
+}
+
+// Encode encodes a packet with the format and codec negotiated with the current agent gateway
+func (client *Client) Encode(in interface{}) ([]byte, error) {
+	return proto.EncodePacket(client.getFormat(), client.getCodec(), "", in)
+}
+
+// Decode decodes a packet with the format and codec negotiated with the current agent gateway
+func (client *Client) Decode(in []byte, out interface{}) error {
+	return proto.DecodePacket(client.getFormat(), client.getCodec(), in, out)
+}
+
+// transcode re-encodes a json payload compressed with the named codec using the current format and codec
+func (client *Client) transcode(kind proto.PacketKind, codecName string, payload []byte) ([]byte, error) {
+	if codecName == "" {
+		codecName = proto.CodecSnappy
+	}
+	format, codec := client.getFormat(), client.getCodec()
+	if codec.Name() == codecName && format.Name() == proto.FormatJSON {
+		return payload, nil
+	}
+	from, ok := proto.GetCodec(codecName)
+	if !ok {
+		return nil, fmt.Errorf("unsupported codec %s", codecName)
+	}
+	raw, err := from.Decompress(payload)
+	if err != nil {
+		return nil, fmt.Errorf("unable to decode from %s, error: %w", codecName, err)
+	}
+	jsonFormat, _ := proto.GetFormat(proto.FormatJSON)
+	raw, err = proto.Transcode(kind, jsonFormat, format, raw)
+	if err != nil {
+		return nil, err
+	}
+	return codec.Compress(raw)
+}
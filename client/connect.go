@@ -2,42 +2,54 @@ package client
 
 import (
 	"context"
-	"fmt"
+	"errors"
 	"github.com/reconquest/sign-go"
 	"golang.org/x/sync/errgroup"
 	"os"
-	"strings"
-	"sync"
 	"syscall"
 	"time"
 
+	"github.com/MagalixCorp/magalix-agent/v2/proto"
 	"github.com/MagalixTechnologies/channel"
 	"github.com/MagalixTechnologies/core/logger"
 )
 
-const watchdogInterval = time.Minute
+const (
+	watchdogInterval  = time.Minute
+	watchdogTimeout   = 10 * time.Minute
+	pipeStatsInterval = time.Minute
+)
 
-func (client *Client) onConnect(connected chan bool) error {
-	client.blockedM.Lock()
-	client.connected = true
-	client.blockedM.Unlock()
+func (client *Client) onConnect() error {
+	if !client.state.transition(StateConnecting, StateHello) {
+		return nil
+	}
 
 	expire := time.Now().Add(time.Minute * 10)
+	failedOver := false
+	dormant := false
 	_ = client.WithBackoffLimit(func() error {
 
-		if !client.connected {
-			return nil
+		if !client.handshaking() {
+			return nil // disconnected, breaking condition for backoff
 		}
 
+		client.state.transition(StateAuthorizing, StateHello)
 		err := client.hello()
 		if err != nil {
 			logger.Errorw("unable to verify protocol version with remote server", "error", err)
-			if time.Now().After(expire) || strings.Contains(err.Error(), "unsupported version") {
+			if time.Now().After(expire) || errors.Is(err, errIncompatibleGateway) {
 				return nil // breaking condition for backoff
 			}
+			if client.endpoints.Failure() {
+				failedOver = true
+				client.reconnect()
+				return nil // breaking condition for backoff, continues on the next endpoint
+			}
 			return err // continue condition for backoff
 		}
 
+		client.state.transition(StateHello, StateAuthorizing)
 		err = client.authorize()
 
 		if err != nil {
@@ -45,11 +57,11 @@ func (client *Client) onConnect(connected chan bool) error {
 
 			if ok {
 				if connectionError.Code == 404 {
-					// TODO: Remove this loop once we get permission to delete the agent
-					for {
-						time.Sleep(time.Hour * 8760)
-					}
-
+					// TODO: Remove this once we get permission to delete the agent
+					logger.Errorw("agent is not found by agent gateway, going dormant", "error", err)
+					dormant = true
+					client.goDormant(0)
+					return nil
 				}
 			}
 
@@ -57,50 +69,53 @@ func (client *Client) onConnect(connected chan bool) error {
 				"unable to authorize client",
 				"error", err,
 			)
+			if client.endpoints.Failure() {
+				failedOver = true
+				client.reconnect()
+				return nil // breaking condition for backoff, continues on the next endpoint
+			}
 			return err // continue condition for backoff
 		}
 
-		client.authorized = true
-		connected <- true
-
-		client.blockedM.Lock()
-		defer client.blockedM.Unlock()
-		client.blocked.Range(func(k, v interface{}) bool {
-			k.(chan struct{}) <- struct{}{}
-			return true
-		})
-
-		client.blocked = sync.Map{}
+		client.endpoints.Success()
+		client.state.transition(StateAuthorizing, StateReady)
 
 		return nil
 	}, 100)
 
-	if client.authorized {
+	if !client.handshaking() || failedOver || dormant {
 		return nil
 	}
 
 	// if it fails to connect for time
-	os.Exit(122)
+	client.giveUp()
 	return nil
 }
 
+// handshaking checks if the client is in the hello or authorization phase of a connection
+func (client *Client) handshaking() bool {
+	state, _ := client.state.get()
+	return state == StateHello || state == StateAuthorizing
+}
+
 func (client *Client) onDisconnect() {
-	client.blockedM.Lock()
-	defer client.blockedM.Unlock()
-	client.connected = false
-	client.authorized = false
+	client.state.setUnless(StateDisconnected, StateDormant)
 }
 
 // Connect starts the client
-func (client *Client) Connect(ctx context.Context, connect chan bool) error {
-	oc := func() error { return client.onConnect(connect) }
-	odc := client.onDisconnect
-	client.channel.SetHooks(&oc, &odc)
-	eg, egCtx := errgroup.WithContext(ctx)
+func (client *Client) Connect(ctx context.Context) error {
+	if client.spool != nil {
+		return client.connectSpool(ctx)
+	}
 
-	// TODO: find a better way to handle this
-	eg.Go(func() error {
-		sign.Notify(func(os.Signal) bool {
+	// disconnection is handled by the listen loop, the channel hook runs asynchronously
+	// and could override the state of the next connection
+	oc := client.onConnect
+	client.channel.SetHooks(&oc, nil)
+	// the signal handler, channel listener and pipe workers outlive a connect, so it can be restarted
+	client.startOnce.Do(func() {
+		// TODO: find a better way to handle this
+		go sign.Notify(func(os.Signal) bool {
 			if !client.IsReady() {
 				return true
 			}
@@ -118,43 +133,125 @@ func (client *Client) Connect(ctx context.Context, connect chan bool) error {
 
 			return true
 		}, syscall.SIGHUP)
-		return nil
+		// TODO: Refactor channel package to use a context for managing go routines
+		go client.listen()
+		client.pipe.Start(10)
+		client.pipeStatus.Start(1)
 	})
 
+	eg, egCtx := errgroup.WithContext(ctx)
 	eg.Go(func() error { return client.StartWatchdog(egCtx) })
-	// TODO: Refactor channel package to use a context for managing go routines
-	go client.channel.Listen()
+	eg.Go(func() error { return client.watchFailBack(egCtx) })
+	eg.Go(func() error { return client.reportPipeStats(egCtx) })
+	return eg.Wait()
+}
+
+// connectSpool starts pipe workers writing to the spool without connecting to the agent gateway
+func (client *Client) connectSpool(ctx context.Context) error {
+	logger.Infow("spool mode is enabled, packets will not be sent to the agent gateway", "dir", client.spool.dir)
 	client.pipe.Start(10)
 	client.pipeStatus.Start(1)
-	return eg.Wait()
+	_ = client.reportPipeStats(ctx)
+	return client.spool.Close()
 }
 
 // IsReady returns true if the agent is connected and authenticated
 func (client *Client) IsReady() bool {
-	return client.authorized
+	state, _ := client.state.get()
+	return state == StateReady
 }
 
+// StartWatchdog forces a reconnect when nothing is sent for more than 10 minutes,
+// as the connection may be stuck without being closed
 func (client *Client) StartWatchdog(ctx context.Context) error {
-	startTime := time.Now()
+	// since sending is watched from, the start or the last forced reconnect
+	since := time.Now()
 	client.watchdogTicker = time.NewTicker(watchdogInterval)
-	msg := "nothing sent for more than 10 minutes"
+	defer client.watchdogTicker.Stop()
 	for {
 		select {
 		case <-ctx.Done():
 			return nil
 		case <-client.watchdogTicker.C:
 			client.blockedM.Lock()
-			{
-				// it didn't send anything before
-				if (client.lastSent == time.Time{}) {
-					if startTime.Add(10 * time.Minute).Before(time.Now()) {
-						return fmt.Errorf(msg)
-					}
-				} else if client.lastSent.Add(10 * time.Minute).Before(time.Now()) {
-					return fmt.Errorf(msg)
+			lastSent := client.lastSent
+			client.blockedM.Unlock()
+
+			if lastSent.After(since) {
+				since = lastSent
+			}
+			if since.Add(watchdogTimeout).Before(time.Now()) {
+				logger.Warnw("nothing sent for more than 10 minutes, reconnecting", "last-sent", lastSent)
+				client.reconnect()
+				since = time.Now()
+			}
+		}
+	}
+}
+
+// reportPipeStats logs packages evicted from the pipe to stay within its budget, starved packages,
+// errors of the pipe store and throttling by the bandwidth limit
+func (client *Client) reportPipeStats(ctx context.Context) error {
+	ticker := time.NewTicker(pipeStatsInterval)
+	defer ticker.Stop()
+	reported := map[proto.PacketKind]PipeUsage{}
+	starved := map[proto.PacketKind]int{}
+	var throttled time.Duration
+	storeErrors := 0
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			stats := client.PipeStats()
+			for kind, usage := range stats.Evicted {
+				last := reported[kind]
+				if usage.Packages == last.Packages {
+					continue
 				}
+				logger.Warnw(
+					"packets have been evicted from the pipe to stay within its budget",
+					"kind", kind,
+					"packets", usage.Packages-last.Packages,
+					"bytes", usage.Bytes-last.Bytes,
+					"pending/packets", stats.Pending.Packages,
+					"pending/bytes", stats.Pending.Bytes,
+				)
+				reported[kind] = usage
+			}
+			for kind, schedule := range stats.Kinds {
+				last := starved[kind]
+				if schedule.Starved == last {
+					continue
+				}
+				logger.Warnw(
+					"packets have been starved in the pipe",
+					"kind", kind,
+					"packets", schedule.Starved-last,
+					"max-wait", schedule.MaxWait,
+					"oldest-wait", schedule.OldestWait,
+				)
+				starved[kind] = schedule.Starved
+			}
+
+			if stats.StoreErrors > storeErrors {
+				logger.Errorw(
+					"pipe store failed",
+					"errors", stats.StoreErrors-storeErrors,
+					"last-error", stats.LastStoreError,
+				)
+				storeErrors = stats.StoreErrors
+			}
+
+			throughput := client.Throughput()
+			if throughput.Throttled > throttled {
+				logger.Infow(
+					"outbound traffic has been throttled by the bandwidth limit",
+					"throttled", throughput.Throttled-throttled,
+					"bytes-per-second", int64(throughput.BytesPerSecond),
+				)
+				throttled = throughput.Throttled
 			}
-			client.blockedM.Unlock()
 		}
 	}
 }
@@ -0,0 +1,104 @@
+package client
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/MagalixTechnologies/core/logger"
+	"github.com/MagalixTechnologies/uuid-go"
+	"github.com/gorilla/websocket"
+)
+
+const failBackCheckInterval = time.Minute
+
+// listen connects to the agent gateway and reconnects whenever the connection drops
+// it replaces channel.Client.Listen which doesn't allow customizing the websocket dialer
+func (client *Client) listen() {
+	go client.channel.Channel.Init()
+	for {
+		client.waitDormant()
+		client.listenOnce()
+	}
+}
+
+func (client *Client) listenOnce() {
+	if state, _ := client.state.get(); state == StateDormant {
+		return
+	}
+	client.state.set(StateConnecting)
+	dialer := websocket.Dialer{
+		HandshakeTimeout: client.timeouts.protoHandshake,
+	}
+	client.proxy.configure(&dialer)
+	header := http.Header{}
+	err := client.authenticator.Prepare(&dialer, header)
+	if err != nil {
+		logger.Errorw("unable to prepare connection to agent gateway", "error", err)
+		client.onDisconnect()
+		time.Sleep(client.timeouts.protoReconnect)
+		return
+	}
+
+	address := client.endpoints.Current()
+	con, _, err := dialer.Dial(address, header)
+	if err != nil {
+		logger.Errorw("failed to connect to agent gateway", "address", address, "error", err)
+		client.endpoints.Failure()
+		client.onDisconnect()
+		time.Sleep(client.timeouts.protoReconnect)
+		return
+	}
+	defer con.Close()
+
+	peer := client.channel.Channel.NewPeer(con, "")
+	client.blockedM.Lock()
+	client.server = peer.ID
+	client.conn = con
+	client.blockedM.Unlock()
+
+	client.channel.Channel.HandlePeer(peer)
+
+	client.blockedM.Lock()
+	client.conn = nil
+	client.blockedM.Unlock()
+	client.onDisconnect()
+	time.Sleep(client.timeouts.protoReconnect)
+}
+
+// reconnect drops the current connection, the listen loop then dials the active endpoint
+func (client *Client) reconnect() {
+	client.blockedM.Lock()
+	defer client.blockedM.Unlock()
+	if client.conn != nil {
+		client.conn.Close()
+	}
+}
+
+// watchFailBack fails back to the primary endpoint once the failover cooldown passes
+func (client *Client) watchFailBack(ctx context.Context) error {
+	ticker := time.NewTicker(failBackCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			if client.endpoints.FailBack() {
+				client.reconnect()
+			}
+		}
+	}
+}
+
+// EndpointsHealth returns health of the configured agent gateway endpoints
+func (client *Client) EndpointsHealth() []EndpointHealth {
+	return client.endpoints.Health()
+}
+
+// serverID returns the id of the current agent gateway peer
+func (client *Client) serverID() uuid.UUID {
+	client.blockedM.Lock()
+	defer client.blockedM.Unlock()
+	return client.server
+}
@@ -0,0 +1,142 @@
+package client
+
+import (
+	"fmt"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/MagalixTechnologies/core/logger"
+)
+
+// EndpointHealth health of an agent gateway endpoint
+type EndpointHealth struct {
+	Address string
+	Active  bool
+	// Failures consecutive connection, hello or authorization failures
+	Failures    int
+	LastFailure time.Time
+	LastSuccess time.Time
+}
+
+// endpoints an ordered list of agent gateway endpoints, the first one is the primary
+// the client fails over to the next endpoint after repeated failures
+// and fails back to the primary after a cooldown
+type endpoints struct {
+	sync.Mutex
+
+	items   []*EndpointHealth
+	current int
+	// time of the last failover away from the primary
+	failedOver time.Time
+
+	maxFailures int
+	cooldown    time.Duration
+}
+
+// newEndpoints creates endpoints from ws or wss addresses, ws addresses are upgraded to wss unless allowPlaintext is set
+func newEndpoints(addresses []string, maxFailures int, cooldown time.Duration, allowPlaintext bool) (*endpoints, error) {
+	if len(addresses) == 0 {
+		return nil, fmt.Errorf("no agent gateway address specified")
+	}
+	items := make([]*EndpointHealth, 0, len(addresses))
+	for _, address := range addresses {
+		gwUrl, err := url.Parse(address)
+		if err != nil {
+			return nil, fmt.Errorf("invalid agent gateway address %s, error: %w", address, err)
+		}
+		switch gwUrl.Scheme {
+		case "wss":
+		case "ws":
+			if allowPlaintext {
+				logger.Warnw("agent gateway address is not using tls", "address", address)
+			} else {
+				gwUrl.Scheme = "wss"
+			}
+		default:
+			return nil, fmt.Errorf("unsupported agent gateway scheme %s, expected ws or wss", gwUrl.Scheme)
+		}
+		items = append(items, &EndpointHealth{Address: gwUrl.String()})
+	}
+	items[0].Active = true
+	if maxFailures < 1 {
+		maxFailures = 1
+	}
+	return &endpoints{
+		items:       items,
+		maxFailures: maxFailures,
+		cooldown:    cooldown,
+	}, nil
+}
+
+// Current returns the address of the active endpoint
+func (e *endpoints) Current() string {
+	e.Lock()
+	defer e.Unlock()
+	return e.items[e.current].Address
+}
+
+// Success records a successful connection and authorization with the active endpoint
+func (e *endpoints) Success() {
+	e.Lock()
+	defer e.Unlock()
+	item := e.items[e.current]
+	item.Failures = 0
+	item.LastSuccess = time.Now()
+}
+
+// Failure records a failure of the active endpoint
+// returns true if it failed over to another endpoint
+func (e *endpoints) Failure() bool {
+	e.Lock()
+	defer e.Unlock()
+	item := e.items[e.current]
+	item.Failures++
+	item.LastFailure = time.Now()
+	if item.Failures < e.maxFailures || len(e.items) == 1 {
+		return false
+	}
+
+	item.Failures = 0
+	e.activate((e.current + 1) % len(e.items))
+	if e.current != 0 {
+		e.failedOver = time.Now()
+	}
+	logger.Warnw(
+		"agent gateway endpoint failed repeatedly, failing over",
+		"from", item.Address,
+		"to", e.items[e.current].Address,
+	)
+	return true
+}
+
+// FailBack switches back to the primary endpoint when the cooldown has passed since failing over
+// returns true if it switched
+func (e *endpoints) FailBack() bool {
+	e.Lock()
+	defer e.Unlock()
+	if e.current == 0 || time.Since(e.failedOver) < e.cooldown {
+		return false
+	}
+	from := e.items[e.current].Address
+	e.activate(0)
+	logger.Infow("failing back to primary agent gateway endpoint", "from", from, "to", e.items[0].Address)
+	return true
+}
+
+// Health returns health of all endpoints
+func (e *endpoints) Health() []EndpointHealth {
+	e.Lock()
+	defer e.Unlock()
+	res := make([]EndpointHealth, len(e.items))
+	for i, item := range e.items {
+		res[i] = *item
+	}
+	return res
+}
+
+func (e *endpoints) activate(index int) {
+	e.items[e.current].Active = false
+	e.current = index
+	e.items[e.current].Active = true
+}
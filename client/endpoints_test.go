@@ -0,0 +1,68 @@
+package client
+
+import (
+	"testing"
+	"time"
+)
+
+func TestEndpoints_FailoverAndFailBack(t *testing.T) {
+	e, err := newEndpoints([]string{"wss://primary", "wss://secondary"}, 2, 0, false)
+	if err != nil {
+		t.Fatalf("newEndpoints() error = %v", err)
+	}
+
+	steps := []struct {
+		name       string
+		action     func() bool
+		want       bool
+		wantActive string
+	}{
+		{name: "first failure", action: e.Failure, want: false, wantActive: "wss://primary"},
+		{name: "second failure fails over", action: e.Failure, want: true, wantActive: "wss://secondary"},
+		{name: "fails back after cooldown", action: e.FailBack, want: true, wantActive: "wss://primary"},
+		{name: "nothing to fail back", action: e.FailBack, want: false, wantActive: "wss://primary"},
+	}
+	for _, step := range steps {
+		if got := step.action(); got != step.want {
+			t.Errorf("%s: got %v, want %v", step.name, got, step.want)
+		}
+		if got := e.Current(); got != step.wantActive {
+			t.Errorf("%s: endpoints.Current() = %v, want %v", step.name, got, step.wantActive)
+		}
+	}
+
+	e.cooldown = time.Hour
+	e.Failure()
+	e.Failure()
+	if e.FailBack() {
+		t.Errorf("endpoints.FailBack() failed back before cooldown")
+	}
+}
+
+func TestNewEndpoints_InvalidScheme(t *testing.T) {
+	if _, err := newEndpoints([]string{"https://gateway"}, 1, time.Minute, false); err == nil {
+		t.Errorf("newEndpoints() expected an error for unsupported scheme")
+	}
+}
+
+func TestNewEndpoints_Plaintext(t *testing.T) {
+	tests := []struct {
+		name           string
+		allowPlaintext bool
+		want           string
+	}{
+		{name: "upgraded to tls", want: "wss://gateway"},
+		{name: "plaintext allowed", allowPlaintext: true, want: "ws://gateway"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e, err := newEndpoints([]string{"ws://gateway"}, 1, time.Minute, tt.allowPlaintext)
+			if err != nil {
+				t.Fatalf("newEndpoints() error = %v", err)
+			}
+			if got := e.Current(); got != tt.want {
+				t.Errorf("endpoints.Current() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,85 @@
+package client
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/MagalixTechnologies/core/logger"
+)
+
+const (
+	// GiveUpExit exits the agent when it gives up connecting, so it is restarted
+	GiveUpExit = "exit"
+	// GiveUpDormant stays dormant for a period when it gives up connecting, then tries again
+	GiveUpDormant = "dormant"
+)
+
+// exitCodeGiveUp exit code used when the agent gives up connecting to the agent gateway
+const exitCodeGiveUp = 122
+
+// GiveUpPolicy what the client does when it can't connect and authorize
+type GiveUpPolicy struct {
+	Action string
+	// DormantPeriod time to stay dormant with GiveUpDormant
+	DormantPeriod time.Duration
+}
+
+// NewGiveUpPolicy creates a give up policy
+func NewGiveUpPolicy(action string, dormantPeriod time.Duration) (GiveUpPolicy, error) {
+	switch action {
+	case GiveUpExit:
+	case GiveUpDormant:
+		if dormantPeriod <= 0 {
+			return GiveUpPolicy{}, fmt.Errorf("dormant period must be positive, got %s", dormantPeriod)
+		}
+	default:
+		return GiveUpPolicy{}, fmt.Errorf("unsupported give up policy %s, expected %s or %s", action, GiveUpExit, GiveUpDormant)
+	}
+	return GiveUpPolicy{Action: action, DormantPeriod: dormantPeriod}, nil
+}
+
+// giveUp applies the give up policy
+func (client *Client) giveUp() {
+	if client.giveUpPolicy.Action != GiveUpDormant {
+		logger.Errorw("unable to connect to agent gateway, giving up and exiting", "code", exitCodeGiveUp)
+		os.Exit(exitCodeGiveUp)
+	}
+	logger.Errorw(
+		"unable to connect to agent gateway, giving up and going dormant",
+		"period", client.giveUpPolicy.DormantPeriod,
+	)
+	client.goDormant(client.giveUpPolicy.DormantPeriod)
+}
+
+// goDormant drops the connection and stops reconnecting for a period, 0 stays dormant indefinitely
+func (client *Client) goDormant(period time.Duration) {
+	client.blockedM.Lock()
+	if period > 0 {
+		client.dormantUntil = time.Now().Add(period)
+	} else {
+		client.dormantUntil = time.Time{}
+	}
+	client.blockedM.Unlock()
+
+	client.state.set(StateDormant)
+	client.reconnect()
+}
+
+// waitDormant blocks while the client is dormant
+func (client *Client) waitDormant() {
+	state, _ := client.state.get()
+	if state != StateDormant {
+		return
+	}
+
+	client.blockedM.Lock()
+	until := client.dormantUntil
+	client.blockedM.Unlock()
+
+	if until.IsZero() {
+		select {}
+	}
+	time.Sleep(time.Until(until))
+	client.state.set(StateDisconnected)
+}
@@ -0,0 +1,89 @@
+package client
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/MagalixCorp/magalix-agent/v2/proto"
+	"github.com/MagalixTechnologies/core/logger"
+)
+
+// ackWindowSize number of recently acknowledged ids kept to avoid sending them again
+const ackWindowSize = 10000
+
+// ackWindow a bounded set of acknowledged ids, the oldest ids are forgotten first
+type ackWindow struct {
+	sync.Mutex
+
+	ids  map[string]struct{}
+	ring []string
+	next int
+}
+
+func newAckWindow(size int) *ackWindow {
+	return &ackWindow{
+		ids:  make(map[string]struct{}, size),
+		ring: make([]string, size),
+	}
+}
+
+// Add adds an acknowledged id
+func (w *ackWindow) Add(id string) {
+	w.Lock()
+	defer w.Unlock()
+	if _, ok := w.ids[id]; ok {
+		return
+	}
+	if old := w.ring[w.next]; old != "" {
+		delete(w.ids, old)
+	}
+	w.ring[w.next] = id
+	w.ids[id] = struct{}{}
+	w.next = (w.next + 1) % len(w.ring)
+}
+
+// Has checks if an id has been acknowledged
+func (w *ackWindow) Has(id string) bool {
+	w.Lock()
+	defer w.Unlock()
+	_, ok := w.ids[id]
+	return ok
+}
+
+// SendIdempotent sends a packet identified by id if there is an established connection
+// it fails if no connection is established within a minute, so the pipe retries the packet
+// the packet is wrapped in an envelope and the agent gateway must acknowledge its id,
+// ids acknowledged before are not sent again, including across reconnects
+// agent gateways that don't support envelopes get the bare packet
+func (client *Client) SendIdempotent(id string, kind proto.PacketKind, in interface{}) error {
+	if client.acked.Has(id) {
+		logger.Debugw("packet has been acknowledged already, skipping", "kind", kind, "id", id)
+		return nil
+	}
+
+	if !client.WaitForConnection(time.Minute) {
+		return errNotConnected
+	}
+	if kind == proto.PacketKindChunk && !client.supportsKind(kind) {
+		return client.sendUnchunked(id, in)
+	}
+	if !client.supportsKind(kind) {
+		logger.Warnw("packet kind is not supported by the agent gateway, dropping packet", "kind", kind)
+		return nil
+	}
+	if !client.Supports(proto.CapabilityEnvelope) {
+		return client.send(kind, in, nil)
+	}
+
+	var ack proto.PacketEnvelopeAck
+	err := client.send(kind, proto.PacketEnvelope{ID: id, Data: in}, &ack)
+	if err != nil {
+		return err
+	}
+	if ack.ID != id {
+		return fmt.Errorf("packet %s has not been acknowledged by agent gateway, got ack for %q", id, ack.ID)
+	}
+	client.acked.Add(id)
+	return nil
+}
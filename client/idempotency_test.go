@@ -0,0 +1,56 @@
+package client
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestAckWindow(t *testing.T) {
+	tests := []struct {
+		name  string
+		size  int
+		added int
+		id    string
+		want  bool
+	}{
+		{
+			name:  "acked id",
+			size:  3,
+			added: 3,
+			id:    "0",
+			want:  true,
+		},
+		{
+			name:  "unknown id",
+			size:  3,
+			added: 3,
+			id:    "3",
+			want:  false,
+		},
+		{
+			name:  "oldest id is forgotten",
+			size:  3,
+			added: 4,
+			id:    "0",
+			want:  false,
+		},
+		{
+			name:  "newer ids are kept",
+			size:  3,
+			added: 4,
+			id:    "1",
+			want:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := newAckWindow(tt.size)
+			for i := 0; i < tt.added; i++ {
+				w.Add(fmt.Sprint(i))
+			}
+			if got := w.Has(tt.id); got != tt.want {
+				t.Errorf("Has(%s) = %v, want %v", tt.id, got, tt.want)
+			}
+		})
+	}
+}
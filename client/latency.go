@@ -0,0 +1,48 @@
+package client
+
+import (
+	"sync"
+	"time"
+
+	"github.com/MagalixCorp/magalix-agent/v2/proto"
+)
+
+// SendLatency round trip times of packets sent to the agent gateway since start
+// bandwidth limiter waits are not included
+type SendLatency struct {
+	Count int64
+	Total time.Duration
+	Max   time.Duration
+}
+
+// sendLatencies send latencies by kind
+type sendLatencies struct {
+	sync.Mutex
+	kinds map[proto.PacketKind]SendLatency
+}
+
+func newSendLatencies() *sendLatencies {
+	return &sendLatencies{kinds: map[proto.PacketKind]SendLatency{}}
+}
+
+func (l *sendLatencies) record(kind proto.PacketKind, latency time.Duration) {
+	l.Lock()
+	defer l.Unlock()
+	stats := l.kinds[kind]
+	stats.Count++
+	stats.Total += latency
+	if latency > stats.Max {
+		stats.Max = latency
+	}
+	l.kinds[kind] = stats
+}
+
+func (l *sendLatencies) get() map[proto.PacketKind]SendLatency {
+	l.Lock()
+	defer l.Unlock()
+	kinds := make(map[proto.PacketKind]SendLatency, len(l.kinds))
+	for kind, stats := range l.kinds {
+		kinds[kind] = stats
+	}
+	return kinds
+}
@@ -49,7 +49,9 @@ func (client *Client) flushLogs() {
 }
 
 func (client *Client) Sync() error {
-	// TODO: Should actually wait till logs are sent
+	// it doesn't wait till logs are sent, Drain does
+	client.blockedM.Lock()
+	defer client.blockedM.Unlock()
 	client.flushLogs()
 	return nil
 }
@@ -1,16 +1,61 @@
 package client
 
 import (
+	"context"
 	"sync"
 	"time"
 
 	"github.com/MagalixCorp/magalix-agent/v2/proto"
 	"github.com/MagalixTechnologies/core/logger"
+	"github.com/MagalixTechnologies/uuid-go"
 )
 
 // PipeSender interface for sender
 type PipeSender interface {
-	Send(kind proto.PacketKind, in interface{}, out interface{}) error
+	// SendIdempotent sends a packet identified by an id that is kept across retries
+	SendIdempotent(id string, kind proto.PacketKind, in interface{}) error
+}
+
+// drainCheckInterval interval to check if a draining pipe is empty
+const drainCheckInterval = 100 * time.Millisecond
+
+// DrainReport result of draining pipes
+type DrainReport struct {
+	// Sent packages sent while draining
+	Sent int
+	// Rejected packages piped while draining by kind, logs are never rejected
+	Rejected map[proto.PacketKind]int
+	// Remaining packages not sent before the deadline by kind
+	Remaining map[proto.PacketKind]int
+	// Persisted remaining packages are kept in a persistent store and sent after restart
+	Persisted bool
+}
+
+// Dropped gets the number of packages that are lost, logs are not counted
+// as they keep being piped while draining, including the logs of draining itself
+func (r DrainReport) Dropped() int {
+	dropped := 0
+	for _, count := range r.Rejected {
+		dropped += count
+	}
+	if !r.Persisted {
+		for kind, count := range r.Remaining {
+			if kind != proto.PacketKindLogs {
+				dropped += count
+			}
+		}
+	}
+	return dropped
+}
+
+func (r *DrainReport) merge(other DrainReport) {
+	r.Sent += other.Sent
+	for kind, count := range other.Rejected {
+		r.Rejected[kind] += count
+	}
+	for kind, count := range other.Remaining {
+		r.Remaining[kind] += count
+	}
 }
 
 // Pipe pipe
@@ -19,26 +64,58 @@ type Pipe struct {
 
 	sender  PipeSender
 	storage PipeStore
+
+	// guarded by cond.L
+	// sending packages popped by workers and not sent yet
+	sending  int
+	sent     int
+	draining bool
+	rejected map[proto.PacketKind]int
+	// dropped packages the store reported dropped when adding, since start
+	dropped int
 }
 
-// NewPipe creates a new pipe
-func NewPipe(sender PipeSender) *Pipe {
+// NewPipe creates a new pipe backed by the given store
+func NewPipe(sender PipeSender, storage PipeStore) *Pipe {
 	return &Pipe{
 		cond: sync.NewCond(&sync.Mutex{}),
 
-		sender:  sender,
-		storage: NewDefaultPipeStore(),
+		sender:   sender,
+		storage:  storage,
+		rejected: map[proto.PacketKind]int{},
 	}
 }
 
 // Send pushes a packet to the pipe to be sent
+// packages other than logs are rejected while the pipe is draining
 func (p *Pipe) Send(pack Package) int {
+	p.cond.L.Lock()
+	if p.draining && pack.Kind != proto.PacketKindLogs {
+		p.rejected[pack.Kind]++
+		p.cond.L.Unlock()
+		return 1
+	}
+	p.cond.L.Unlock()
+
+	if pack.ID == "" {
+		pack.ID = uuid.NewV4().String()
+	}
 	pack.time = time.Now()
 	ret := p.storage.Add(&pack)
+	p.cond.L.Lock()
+	p.dropped += ret
+	p.cond.L.Unlock()
 	p.cond.Broadcast()
 	return ret
 }
 
+// Dropped gets the number of packages the store dropped when adding since start
+func (p *Pipe) Dropped() int {
+	p.cond.L.Lock()
+	defer p.cond.L.Unlock()
+	return p.dropped
+}
+
 // Start start multiple workers for sending packages
 func (p *Pipe) Start(workers int) {
 	for i := 0; i < workers; i++ {
@@ -57,22 +134,41 @@ func (p *Pipe) start() {
 				p.cond.L.Unlock()
 				continue
 			}
+			p.sending++
 			p.cond.L.Unlock()
 
 			logFields := logger.With(
 				"kind", pack.Kind,
+				"id", pack.ID,
 				"diff", time.Since(pack.time),
 				"remaining", p.storage.Len(),
 			)
 			logFields.Debugf("sending packet %s ....", pack.Kind.String())
+			if chunk, ok := pack.Data.(proto.PacketChunk); ok && chunk.Index == 0 {
+				logFields.Infow(
+					"packet is too large, sending it in chunks",
+					"chunked-kind", chunk.Kind,
+					"chunks", chunk.Total,
+					"transfer", chunk.TransferID,
+				)
+			}
 
-			err := p.sender.Send(pack.Kind, pack.Data, nil)
+			err := p.sender.SendIdempotent(pack.ID, pack.Kind, pack.Data)
 			if err != nil {
 				p.storage.Add(pack)
 				logFields.Errorw("error sending packet", "error", err, "remaining", p.storage.Len())
 			} else {
+				// acked only once sent, so persistent stores keep the package if the agent stops meanwhile
+				p.storage.Ack(pack)
 				logFields.Debugw("completed sending packet", "remaining", p.storage.Len())
 			}
+
+			p.cond.L.Lock()
+			p.sending--
+			if err == nil {
+				p.sent++
+			}
+			p.cond.L.Unlock()
 		}
 	}()
 }
@@ -81,3 +177,44 @@ func (p *Pipe) start() {
 func (p *Pipe) Len() int {
 	return p.storage.Len()
 }
+
+// Drain rejects new packages and waits until pending packages are sent or the context is done
+// workers send pending packages in priority order as usual
+// the pipe accepts packages again once drained, as the agent may keep running
+func (p *Pipe) Drain(ctx context.Context) DrainReport {
+	p.cond.L.Lock()
+	p.draining = true
+	p.rejected = map[proto.PacketKind]int{}
+	sent := p.sent
+	p.cond.L.Unlock()
+
+	ticker := time.NewTicker(drainCheckInterval)
+	defer ticker.Stop()
+	for !p.drained() {
+		select {
+		case <-ctx.Done():
+			return p.drainReport(sent)
+		case <-ticker.C:
+		}
+	}
+	return p.drainReport(sent)
+}
+
+func (p *Pipe) drained() bool {
+	p.cond.L.Lock()
+	defer p.cond.L.Unlock()
+	return p.sending == 0 && p.storage.Len() == 0
+}
+
+// drainReport ends draining and reports packages since sent
+func (p *Pipe) drainReport(sent int) DrainReport {
+	p.cond.L.Lock()
+	defer p.cond.L.Unlock()
+	p.draining = false
+	return DrainReport{
+		Sent:      p.sent - sent,
+		Rejected:  p.rejected,
+		Remaining: p.storage.Count(),
+		Persisted: p.storage.Persistent(),
+	}
+}
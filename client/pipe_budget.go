@@ -0,0 +1,199 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/MagalixCorp/magalix-agent/v2/proto"
+)
+
+const (
+	// EvictDropOldest evicts the oldest packages first
+	EvictDropOldest = "drop-oldest"
+	// EvictDropLowestPriority evicts the least urgent packages first, the oldest of them first
+	EvictDropLowestPriority = "drop-lowest-priority"
+	// EvictDownsampleMetrics thins queued metrics evenly across time instead of losing the oldest,
+	// other kinds are evicted oldest first
+	EvictDownsampleMetrics = "downsample-metrics"
+)
+
+// PipeBudget limits the encoded size of pending packages
+type PipeBudget struct {
+	// Bytes budget of all packages, 0 means unlimited
+	Bytes int
+	// Kinds budgets of packages of a kind
+	Kinds map[proto.PacketKind]int
+	// Eviction policy used to choose packages to evict when a budget is exceeded
+	Eviction string
+}
+
+// NewPipeBudget creates a pipe budget, quotas are specified as kind:bytes
+func NewPipeBudget(bytes int, quotas []string, eviction string) (PipeBudget, error) {
+	switch eviction {
+	case EvictDropOldest, EvictDropLowestPriority, EvictDownsampleMetrics:
+	default:
+		return PipeBudget{}, fmt.Errorf(
+			"unsupported eviction policy %s, expected %s, %s or %s",
+			eviction, EvictDropOldest, EvictDropLowestPriority, EvictDownsampleMetrics,
+		)
+	}
+
+	kinds := map[proto.PacketKind]int{}
+	for _, quota := range quotas {
+		parts := strings.SplitN(quota, ":", 2)
+		if len(parts) != 2 {
+			return PipeBudget{}, fmt.Errorf("invalid pipe quota %s, expected kind:bytes", quota)
+		}
+		limit, err := strconv.Atoi(parts[1])
+		if err != nil || limit <= 0 {
+			return PipeBudget{}, fmt.Errorf("invalid pipe quota %s, bytes must be a positive number", quota)
+		}
+		kinds[proto.PacketKind(parts[0])] = limit
+	}
+
+	return PipeBudget{
+		Bytes:    bytes,
+		Kinds:    kinds,
+		Eviction: eviction,
+	}, nil
+}
+
+// PipeUsage number and encoded size of packages
+type PipeUsage struct {
+	Packages int
+	Bytes    int
+}
+
+// PipeStats usage of a pipe store
+type PipeStats struct {
+	// Pending packages waiting to be sent
+	Pending PipeUsage
+	// PendingKinds packages waiting to be sent by kind
+	PendingKinds map[proto.PacketKind]PipeUsage
+	// Dropped packages the store dropped when adding since start, filled by the client
+	Dropped int
+	// Evicted packages evicted to stay within the budget by kind since start
+	Evicted map[proto.PacketKind]PipeUsage
+	// Kinds scheduling stats by kind
+	Kinds map[proto.PacketKind]KindSchedule
+	// StoreErrors errors of the store since start, e.g. writes of a persistent store failing on a full disk
+	StoreErrors int
+	// LastStoreError the last error of the store
+	LastStoreError string
+}
+
+// packageSize gets the json encoded size of a package not measured when piped
+func packageSize(pack *Package) int {
+	if data, ok := pack.Data.(json.RawMessage); ok {
+		return len(data)
+	}
+	data, err := json.Marshal(pack.Data)
+	if err != nil {
+		return 0
+	}
+	return len(data)
+}
+
+// enforceBudget evicts packages until the kind quota and the global budget are met
+// must be called with the lock held
+func (s *DefaultPipeStore) enforceBudget(kind proto.PacketKind) {
+	if quota, ok := s.budget.Kinds[kind]; ok {
+		for s.kindBytes[kind] > quota {
+			candidate := s.evictionCandidate(s.kinds[kind])
+			if candidate == nil {
+				s.mismatch(fmt.Sprintf("%s packets", kind), s.kindBytes[kind])
+				s.kindBytes[kind] = 0
+				break
+			}
+			s.evict(candidate)
+		}
+	}
+	if s.budget.Bytes > 0 {
+		for s.bytes > s.budget.Bytes {
+			candidate := s.evictionCandidate(*s.pq)
+			if candidate == nil {
+				s.mismatch("packets", s.bytes)
+				s.bytes = 0
+				break
+			}
+			s.evict(candidate)
+		}
+	}
+}
+
+// mismatch records bytes accounted for with no packages left to evict, the accounting is reset
+// as it can't be met by evicting, it is reported as a store error since the store must not log
+func (s *DefaultPipeStore) mismatch(what string, bytes int) {
+	s.errors++
+	s.lastError = fmt.Sprintf("pipe budget accounts for %d bytes of %s with no packages left to evict", bytes, what)
+}
+
+func (s *DefaultPipeStore) evict(pack *Package) {
+	usage := s.evicted[pack.Kind]
+	usage.Packages++
+	usage.Bytes += pack.size
+	s.evicted[pack.Kind] = usage
+
+	s.removed++
+	s.remove(pack)
+	s.dropped(pack)
+}
+
+// evictionCandidate chooses a package to evict according to the eviction policy
+func (s *DefaultPipeStore) evictionCandidate(packs []*Package) *Package {
+	switch s.budget.Eviction {
+	case EvictDropLowestPriority:
+		var candidate *Package
+		for _, pack := range packs {
+			if candidate == nil || pack.Priority > candidate.Priority ||
+				(pack.Priority == candidate.Priority && pack.time.Before(candidate.time)) {
+				candidate = pack
+			}
+		}
+		return candidate
+	case EvictDownsampleMetrics:
+		if candidate := s.downsampleCandidate(packs); candidate != nil {
+			return candidate
+		}
+	}
+	return oldestPackage(packs)
+}
+
+// downsampleCandidate chooses the metrics package whose removal leaves the smallest gap in time
+// between its neighbours, the oldest and newest packages are kept
+// returns nil if there are not enough metrics packages to thin
+func (s *DefaultPipeStore) downsampleCandidate(packs []*Package) *Package {
+	metrics := []*Package{}
+	for _, pack := range packs {
+		if pack.Kind == proto.PacketKindMetricsStoreV2Request {
+			metrics = append(metrics, pack)
+		}
+	}
+	if len(metrics) < 3 {
+		return nil
+	}
+	sort.SliceStable(metrics, func(i, j int) bool {
+		return metrics[i].time.Before(metrics[j].time)
+	})
+
+	best := 1
+	for i := 2; i < len(metrics)-1; i++ {
+		if metrics[i+1].time.Sub(metrics[i-1].time) < metrics[best+1].time.Sub(metrics[best-1].time) {
+			best = i
+		}
+	}
+	return metrics[best]
+}
+
+func oldestPackage(packs []*Package) *Package {
+	var oldest *Package
+	for _, pack := range packs {
+		if oldest == nil || pack.time.Before(oldest.time) {
+			oldest = pack
+		}
+	}
+	return oldest
+}
@@ -0,0 +1,157 @@
+package client
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/MagalixCorp/magalix-agent/v2/proto"
+)
+
+func TestDefaultPipeStore_Budget(t *testing.T) {
+	start := time.Now()
+	pack := func(kind proto.PacketKind, priority int, minute int) *Package {
+		return &Package{
+			Kind:     kind,
+			Priority: priority,
+			time:     start.Add(time.Duration(minute) * time.Minute),
+			Data:     json.RawMessage(`"0123456789"`),
+		}
+	}
+
+	tests := []struct {
+		name   string
+		budget PipeBudget
+		packs  []*Package
+		// wantKept minutes of the packages kept
+		wantKept    []int
+		wantEvicted map[proto.PacketKind]int
+	}{
+		{
+			name:   "drop oldest",
+			budget: PipeBudget{Bytes: 24, Eviction: EvictDropOldest},
+			packs: []*Package{
+				pack(proto.PacketKindLogs, 9, 0),
+				pack(proto.PacketKindMetricsStoreV2Request, 4, 1),
+				pack(proto.PacketKindLogs, 9, 2),
+				pack(proto.PacketKindMetricsStoreV2Request, 4, 3),
+			},
+			wantKept:    []int{2, 3},
+			wantEvicted: map[proto.PacketKind]int{proto.PacketKindLogs: 1, proto.PacketKindMetricsStoreV2Request: 1},
+		},
+		{
+			name:   "drop lowest priority",
+			budget: PipeBudget{Bytes: 24, Eviction: EvictDropLowestPriority},
+			packs: []*Package{
+				pack(proto.PacketKindLogs, 9, 0),
+				pack(proto.PacketKindMetricsStoreV2Request, 4, 1),
+				pack(proto.PacketKindLogs, 9, 2),
+				pack(proto.PacketKindMetricsStoreV2Request, 4, 3),
+			},
+			wantKept:    []int{1, 3},
+			wantEvicted: map[proto.PacketKind]int{proto.PacketKindLogs: 2},
+		},
+		{
+			name: "kind quota",
+			budget: PipeBudget{
+				Kinds:    map[proto.PacketKind]int{proto.PacketKindLogs: 12},
+				Eviction: EvictDropOldest,
+			},
+			packs: []*Package{
+				pack(proto.PacketKindLogs, 9, 0),
+				pack(proto.PacketKindMetricsStoreV2Request, 4, 1),
+				pack(proto.PacketKindLogs, 9, 2),
+			},
+			wantKept:    []int{1, 2},
+			wantEvicted: map[proto.PacketKind]int{proto.PacketKindLogs: 1},
+		},
+		{
+			name:   "downsample metrics",
+			budget: PipeBudget{Bytes: 48, Eviction: EvictDownsampleMetrics},
+			packs: []*Package{
+				pack(proto.PacketKindMetricsStoreV2Request, 4, 0),
+				pack(proto.PacketKindMetricsStoreV2Request, 4, 1),
+				pack(proto.PacketKindMetricsStoreV2Request, 4, 3),
+				pack(proto.PacketKindMetricsStoreV2Request, 4, 4),
+				pack(proto.PacketKindMetricsStoreV2Request, 4, 5),
+			},
+			wantKept:    []int{0, 1, 3, 5},
+			wantEvicted: map[proto.PacketKind]int{proto.PacketKindMetricsStoreV2Request: 1},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewMemoryPipeStore(tt.budget, PipeSchedule{Mode: SchedulePriority})
+			for _, p := range tt.packs {
+				s.Add(p)
+			}
+
+			var kept []int
+			for p := s.Pop(); p != nil; p = s.Pop() {
+				kept = append(kept, int(p.time.Sub(start)/time.Minute))
+			}
+			if len(kept) != len(tt.wantKept) {
+				t.Fatalf("kept = %v, want %v", kept, tt.wantKept)
+			}
+			wanted := map[int]bool{}
+			for _, minute := range tt.wantKept {
+				wanted[minute] = true
+			}
+			for _, minute := range kept {
+				if !wanted[minute] {
+					t.Errorf("kept = %v, want %v", kept, tt.wantKept)
+					break
+				}
+			}
+
+			stats := s.Stats()
+			for kind, want := range tt.wantEvicted {
+				if got := stats.Evicted[kind].Packages; got != want {
+					t.Errorf("evicted %s = %v, want %v", kind, got, want)
+				}
+			}
+			if stats.Pending.Bytes != 0 {
+				t.Errorf("pending bytes after pop = %v, want 0", stats.Pending.Bytes)
+			}
+		})
+	}
+}
+
+func TestDefaultPipeStore_BudgetMismatch(t *testing.T) {
+	tests := []struct {
+		name   string
+		budget PipeBudget
+		skew   func(s *DefaultPipeStore)
+	}{
+		{
+			name:   "kind quota",
+			budget: PipeBudget{Kinds: map[proto.PacketKind]int{proto.PacketKindLogs: 12}, Eviction: EvictDropOldest},
+			skew:   func(s *DefaultPipeStore) { s.kindBytes[proto.PacketKindLogs] = 100 },
+		},
+		{
+			name:   "global budget",
+			budget: PipeBudget{Bytes: 24, Eviction: EvictDownsampleMetrics},
+			skew:   func(s *DefaultPipeStore) { s.bytes = 100 },
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewMemoryPipeStore(tt.budget, PipeSchedule{Mode: SchedulePriority})
+			tt.skew(s)
+
+			s.Add(&Package{Kind: proto.PacketKindLogs, Data: json.RawMessage(`"0123456789"`)})
+
+			if s.Len() != 0 {
+				t.Errorf("DefaultPipeStore.Len() = %v, want 0", s.Len())
+			}
+			if stats := s.Stats(); stats.StoreErrors != 1 || stats.LastStoreError == "" {
+				t.Errorf("DefaultPipeStore.Stats() store errors = %v %q, want the mismatch", stats.StoreErrors, stats.LastStoreError)
+			}
+			// the accounting is reset, so the next package is kept
+			s.Add(&Package{Kind: proto.PacketKindLogs, Data: json.RawMessage(`"0123456789"`)})
+			if s.Len() != 1 {
+				t.Errorf("DefaultPipeStore.Len() = %v, want 1", s.Len())
+			}
+		})
+	}
+}
@@ -0,0 +1,178 @@
+package client
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/MagalixCorp/magalix-agent/v2/proto"
+)
+
+const (
+	// SchedulePriority sends packages strictly by priority then time
+	SchedulePriority = "priority"
+	// ScheduleFair gives each kind a share of send bandwidth by its weight
+	// and sends packages of a kind by their aged priority
+	ScheduleFair = "fair"
+)
+
+// fairQuantum bytes a kind of weight 1 may send in a round of fair scheduling
+const fairQuantum = 16 * 1024
+
+// PipeSchedule how pending packages are scheduled for sending
+type PipeSchedule struct {
+	Mode string
+	// Weights shares of send bandwidth in fair mode, kinds not listed have weight 1
+	Weights map[proto.PacketKind]int
+	// Aging raises the priority of a waiting package by one every period in fair mode, 0 disables aging
+	Aging time.Duration
+	// Starvation packages sent after waiting longer are counted as starved
+	Starvation time.Duration
+}
+
+// NewPipeSchedule creates a pipe schedule, weights are specified as kind:weight
+func NewPipeSchedule(mode string, weights []string, aging time.Duration, starvation time.Duration) (PipeSchedule, error) {
+	switch mode {
+	case SchedulePriority, ScheduleFair:
+	default:
+		return PipeSchedule{}, fmt.Errorf(
+			"unsupported pipe schedule %s, expected %s or %s", mode, SchedulePriority, ScheduleFair,
+		)
+	}
+
+	kinds := map[proto.PacketKind]int{}
+	for _, weight := range weights {
+		parts := strings.SplitN(weight, ":", 2)
+		if len(parts) != 2 {
+			return PipeSchedule{}, fmt.Errorf("invalid pipe weight %s, expected kind:weight", weight)
+		}
+		value, err := strconv.Atoi(parts[1])
+		if err != nil || value <= 0 {
+			return PipeSchedule{}, fmt.Errorf("invalid pipe weight %s, weight must be a positive number", weight)
+		}
+		kinds[proto.PacketKind(parts[0])] = value
+	}
+
+	return PipeSchedule{
+		Mode:       mode,
+		Weights:    kinds,
+		Aging:      aging,
+		Starvation: starvation,
+	}, nil
+}
+
+// KindSchedule scheduling stats of a packet kind
+type KindSchedule struct {
+	// Scheduled packages taken for sending, retries included
+	Scheduled int
+	// MaxWait longest time a package waited before it was taken for sending
+	MaxWait time.Duration
+	// Starved packages taken after waiting longer than the starvation threshold
+	Starved int
+	// OldestWait time the oldest pending package has been waiting
+	OldestWait time.Duration
+}
+
+// peekFair chooses the next package with deficit round robin across kinds
+// the chosen package is kept until acked, so peeking again returns it
+func (s *DefaultPipeStore) peekFair() *Package {
+	if s.peeked != nil {
+		return s.peeked
+	}
+
+	kinds := make([]proto.PacketKind, 0, len(s.kinds))
+	for kind, packs := range s.kinds {
+		if len(packs) > 0 {
+			kinds = append(kinds, kind)
+		} else {
+			// idle kinds don't accumulate credit
+			delete(s.deficits, kind)
+		}
+	}
+	if len(kinds) == 0 {
+		return nil
+	}
+	sort.Slice(kinds, func(i, j int) bool { return kinds[i] < kinds[j] })
+
+	// resume the round at the current kind or the one after it
+	start := sort.Search(len(kinds), func(i int) bool { return kinds[i] >= s.current })
+	now := time.Now()
+
+	// rounds each kind needs to afford its first package are computed up front, so large packages
+	// don't take a round each per quantum, the kind needing the fewest rounds is chosen,
+	// ties go to the first kind in round order
+	heads := make([]*Package, len(kinds))
+	chosen, chosenRounds := -1, 0
+	for offset := range kinds {
+		i := (start + offset) % len(kinds)
+		kind := kinds[i]
+		heads[i] = s.agedFirst(s.kinds[kind], now)
+		rounds := 0
+		if missing := heads[i].size - s.deficits[kind]; missing > 0 {
+			credit := s.weight(kind) * fairQuantum
+			rounds = (missing + credit - 1) / credit
+		}
+		if chosen == -1 || rounds < chosenRounds {
+			chosen, chosenRounds = i, rounds
+		}
+	}
+
+	// credit every kind for the rounds passed, kinds before the chosen one in its round are credited once more
+	chosenOffset := (chosen - start + len(kinds)) % len(kinds)
+	for offset := range kinds {
+		i := (start + offset) % len(kinds)
+		rounds := chosenRounds
+		if offset < chosenOffset {
+			rounds++
+		}
+		s.deficits[kinds[i]] += rounds * s.weight(kinds[i]) * fairQuantum
+	}
+
+	kind := kinds[chosen]
+	pack := heads[chosen]
+	s.deficits[kind] -= pack.size
+	s.current = kind
+	s.peeked = pack
+	return pack
+}
+
+// agedFirst gets the most urgent package counting the time it has waited
+func (s *DefaultPipeStore) agedFirst(packs []*Package, now time.Time) *Package {
+	var first *Package
+	var firstPriority int
+	for _, pack := range packs {
+		priority := pack.Priority
+		if s.schedule.Aging > 0 {
+			priority -= int(now.Sub(pack.time) / s.schedule.Aging)
+		}
+		if first == nil || priority < firstPriority ||
+			(priority == firstPriority && pack.time.Before(first.time)) {
+			first = pack
+			firstPriority = priority
+		}
+	}
+	return first
+}
+
+func (s *DefaultPipeStore) weight(kind proto.PacketKind) int {
+	if weight, ok := s.schedule.Weights[kind]; ok {
+		return weight
+	}
+	return 1
+}
+
+// scheduled records how long a package waited before it was taken for sending
+func (s *DefaultPipeStore) scheduled(pack *Package) {
+	wait := time.Since(pack.time)
+	stats := s.schedules[pack.Kind]
+	stats.Scheduled++
+	if wait > stats.MaxWait {
+		stats.MaxWait = wait
+	}
+	if s.schedule.Starvation > 0 && wait > s.schedule.Starvation {
+		stats.Starved++
+	}
+	s.schedules[pack.Kind] = stats
+}
@@ -0,0 +1,125 @@
+package client
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/MagalixCorp/magalix-agent/v2/proto"
+)
+
+func TestDefaultPipeStore_Schedule(t *testing.T) {
+	data := json.RawMessage(`"` + strings.Repeat("0", 10*1024) + `"`)
+	tests := []struct {
+		name     string
+		schedule PipeSchedule
+		// wantMetrics number of metrics packages in the first pops
+		wantMetrics int
+	}{
+		{
+			name:        "priority starves metrics",
+			schedule:    PipeSchedule{Mode: SchedulePriority},
+			wantMetrics: 0,
+		},
+		{
+			name:        "fair shares bandwidth",
+			schedule:    PipeSchedule{Mode: ScheduleFair},
+			wantMetrics: 2,
+		},
+		{
+			name: "fair by weight",
+			schedule: PipeSchedule{
+				Mode:    ScheduleFair,
+				Weights: map[proto.PacketKind]int{proto.PacketKindEntitiesDeltasRequest: 3},
+			},
+			wantMetrics: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewMemoryPipeStore(PipeBudget{Eviction: EvictDropOldest}, tt.schedule)
+			old := time.Now().Add(-time.Hour)
+			for i := 0; i < 4; i++ {
+				s.Add(&Package{Kind: proto.PacketKindMetricsStoreV2Request, Priority: 4, time: old, Data: data})
+			}
+			for i := 0; i < 10; i++ {
+				s.Add(&Package{Kind: proto.PacketKindEntitiesDeltasRequest, Priority: 1, Data: data})
+			}
+
+			metrics := 0
+			for i := 0; i < 5; i++ {
+				if s.Pop().Kind == proto.PacketKindMetricsStoreV2Request {
+					metrics++
+				}
+			}
+			if metrics != tt.wantMetrics {
+				t.Errorf("metrics in first pops = %v, want %v", metrics, tt.wantMetrics)
+			}
+
+			stats := s.Stats()
+			if got := stats.Kinds[proto.PacketKindEntitiesDeltasRequest].Scheduled; got != 5-metrics {
+				t.Errorf("scheduled deltas = %v, want %v", got, 5-metrics)
+			}
+		})
+	}
+}
+
+func TestDefaultPipeStore_ScheduleAging(t *testing.T) {
+	tests := []struct {
+		name         string
+		aging        time.Duration
+		wantPriority int
+	}{
+		{
+			name:         "without aging",
+			wantPriority: 1,
+		},
+		{
+			name:         "waiting package ages upward",
+			aging:        time.Minute,
+			wantPriority: 5,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewMemoryPipeStore(
+				PipeBudget{Eviction: EvictDropOldest},
+				PipeSchedule{Mode: ScheduleFair, Aging: tt.aging},
+			)
+			s.Add(&Package{Kind: proto.PacketKindLogs, Priority: 5, time: time.Now().Add(-time.Hour), Data: "old"})
+			s.Add(&Package{Kind: proto.PacketKindLogs, Priority: 1, Data: "new"})
+
+			if got := s.Pop().Priority; got != tt.wantPriority {
+				t.Errorf("Pop().Priority = %v, want %v", got, tt.wantPriority)
+			}
+		})
+	}
+}
+
+func TestDefaultPipeStore_ScheduleLargePackages(t *testing.T) {
+	// quoted to a hundred quanta and half a quantum
+	large := json.RawMessage(`"` + strings.Repeat("0", 100*fairQuantum-2) + `"`)
+	small := json.RawMessage(`"` + strings.Repeat("0", fairQuantum/2-2) + `"`)
+	s := NewMemoryPipeStore(PipeBudget{Eviction: EvictDropOldest}, PipeSchedule{Mode: ScheduleFair})
+	s.Add(&Package{Kind: proto.PacketKindEntitiesResyncRequest, Data: large})
+	for i := 0; i < 300; i++ {
+		s.Add(&Package{Kind: proto.PacketKindLogs, Data: small})
+	}
+
+	// the small kind sends two packages a round until the large package is afforded after about 100 rounds
+	popped := -1
+	for i := 0; i < 300 && popped == -1; i++ {
+		if s.Pop().Kind == proto.PacketKindEntitiesResyncRequest {
+			popped = i
+		}
+	}
+	if popped < 195 || popped > 205 {
+		t.Errorf("large package popped after %d packages, want about 200", popped)
+	}
+	for kind, deficit := range s.deficits {
+		if deficit < 0 || deficit > fairQuantum {
+			t.Errorf("deficit of %s = %v, want at most a quantum", kind, deficit)
+		}
+	}
+}
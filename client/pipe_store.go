@@ -10,6 +10,8 @@ import (
 
 // Package structure used to send packages over the channel
 type Package struct {
+	// ID idempotency id, assigned when piped if empty and kept across retries
+	ID string
 	// Kind packet kind
 	Kind proto.PacketKind
 	// ExpiryTime time afterwards will not try to send packets
@@ -30,6 +32,8 @@ type Package struct {
 	index int
 	// time used internally to manage priority queue
 	time time.Time
+	// size encoded size of data, set when piped or measured as json when added, used to enforce the pipe budget
+	size int
 	// Data data to be sent
 	Data interface{}
 }
@@ -42,13 +46,20 @@ type PipeStore interface {
 	// returns the same if called multiple times without ack unless a package expires
 	// returns nil if nothing in the queue
 	Peek() *Package
-	// Acks that a peeked package has been sent, does nothing if the package has expired
+	// Acks that a peeked or popped package has been sent, does nothing if the package has expired
 	Ack(*Package)
-	// Pop is an atomic peek and ack
+	// Pop takes the first available package for sending, it must be acked once sent
+	// and added again if sending fails, persistent stores keep it until acked
 	// returns nil in case there are no packages
 	Pop() *Package
 	// Len gets the number of pending packets
 	Len() int
+	// Count gets the number of pending packets by kind
+	Count() map[proto.PacketKind]int
+	// Stats gets usage of the store and the packets evicted to stay within its budget
+	Stats() PipeStats
+	// Persistent whether pending packets are kept across restarts
+	Persistent() bool
 }
 
 type DefaultPipeStore struct {
@@ -61,6 +72,27 @@ type DefaultPipeStore struct {
 	pq *PriorityQueue
 	// to keep track of counts
 	kinds map[proto.PacketKind][]*Package
+
+	budget    PipeBudget
+	bytes     int
+	kindBytes map[proto.PacketKind]int
+	evicted   map[proto.PacketKind]PipeUsage
+	// onDrop called for packages removed without being sent
+	onDrop func(*Package)
+
+	schedule PipeSchedule
+	// deficits bytes each kind may send in the current round of fair scheduling
+	deficits map[proto.PacketKind]int
+	// current kind served by fair scheduling
+	current proto.PacketKind
+	// peeked package chosen by fair scheduling and not acked yet
+	peeked    *Package
+	schedules map[proto.PacketKind]KindSchedule
+
+	// errors are counted rather than logged, as the store is reachable from Client.Write piping logs
+	// they are reported with the pipe stats
+	errors    int
+	lastError string
 }
 
 func (s *DefaultPipeStore) Add(pack *Package) int {
@@ -72,8 +104,13 @@ func (s *DefaultPipeStore) Add(pack *Package) int {
 	if (pack.time == time.Time{}) {
 		pack.time = time.Now()
 	}
+	if pack.size == 0 {
+		pack.size = packageSize(pack)
+	}
 	heap.Push(s.pq, pack)
 	heap.Fix(s.pq, pack.index)
+	s.bytes += pack.size
+	s.kindBytes[pack.Kind] += pack.size
 
 	// expire count
 	kind, ok := s.kinds[pack.Kind]
@@ -90,13 +127,17 @@ func (s *DefaultPipeStore) Add(pack *Package) int {
 		if (kind[i].ExpiryCount > 0 && kind[i].ExpiryCount < len(kind)) ||
 			(kind[i].ExpiryTime != nil && now.After(*kind[i].ExpiryTime)) {
 			s.removed++
-			s.removeKind(kind[i], i)
+			expired := kind[i]
+			s.removeKind(expired, i)
+			s.dropped(expired)
 			kind = s.kinds[pack.Kind]
 		} else {
 			i++
 		}
 	}
 
+	s.enforceBudget(pack.Kind)
+
 	removed := s.removed
 	s.removed = 0
 	return removed
@@ -108,6 +149,7 @@ func (s *DefaultPipeStore) Pop() *Package {
 	pack := s.peek()
 	if pack != nil {
 		s.ack(pack)
+		s.scheduled(pack)
 	}
 	return pack
 }
@@ -119,6 +161,10 @@ func (s *DefaultPipeStore) Peek() *Package {
 }
 
 func (s *DefaultPipeStore) peek() *Package {
+	if s.schedule.Mode == ScheduleFair {
+		return s.peekFairRetry()
+	}
+
 	var pack *Package
 
 	for s.pq.Len() > 0 {
@@ -129,6 +175,7 @@ func (s *DefaultPipeStore) peek() *Package {
 		if pack.ExpiryTime != nil && time.Now().After(*pack.ExpiryTime) {
 			s.removed++
 			s.remove(pack)
+			s.dropped(pack)
 		}
 		break
 	}
@@ -136,13 +183,35 @@ func (s *DefaultPipeStore) peek() *Package {
 		return nil
 	}
 
-	// decrease priority if number of retries increased
+	s.retried(pack)
+	return pack
+}
+
+// peekFairRetry chooses the next package with fair scheduling skipping expired packages
+func (s *DefaultPipeStore) peekFairRetry() *Package {
+	for {
+		pack := s.peekFair()
+		if pack == nil {
+			return nil
+		}
+		if pack.ExpiryTime != nil && time.Now().After(*pack.ExpiryTime) {
+			s.removed++
+			s.remove(pack)
+			s.dropped(pack)
+			continue
+		}
+		s.retried(pack)
+		return pack
+	}
+}
+
+// retried decreases priority if number of retries increased
+func (s *DefaultPipeStore) retried(pack *Package) {
 	pack.retries++
 	if pack.Retries > 0 && pack.retries%pack.Retries == 0 {
 		pack.Priority++
 		heap.Fix(s.pq, pack.index)
 	}
-	return pack
 }
 
 func (s *DefaultPipeStore) Ack(pack *Package) {
@@ -158,7 +227,12 @@ func (s *DefaultPipeStore) ack(pack *Package) {
 }
 
 func (s *DefaultPipeStore) remove(pack *Package) {
+	if pack == s.peeked {
+		s.peeked = nil
+	}
 	heap.Remove(s.pq, pack.index)
+	s.bytes -= pack.size
+	s.kindBytes[pack.Kind] -= pack.size
 	kind, ok := s.kinds[pack.Kind]
 	if ok {
 		// the loop will be executed only once most of the time
@@ -174,7 +248,12 @@ func (s *DefaultPipeStore) remove(pack *Package) {
 }
 
 func (s *DefaultPipeStore) removeKind(pack *Package, index int) {
+	if pack == s.peeked {
+		s.peeked = nil
+	}
 	heap.Remove(s.pq, pack.index)
+	s.bytes -= pack.size
+	s.kindBytes[pack.Kind] -= pack.size
 	kind, ok := s.kinds[pack.Kind]
 	if ok {
 		kind = append(kind[:index], kind[index+1:]...)
@@ -188,12 +267,78 @@ func (s *DefaultPipeStore) Len() int {
 	return s.pq.Len()
 }
 
+func (s *DefaultPipeStore) Count() map[proto.PacketKind]int {
+	s.Lock()
+	defer s.Unlock()
+	count := map[proto.PacketKind]int{}
+	for kind, packs := range s.kinds {
+		if len(packs) > 0 {
+			count[kind] = len(packs)
+		}
+	}
+	return count
+}
+
+func (s *DefaultPipeStore) Persistent() bool {
+	return false
+}
+
+func (s *DefaultPipeStore) Stats() PipeStats {
+	s.Lock()
+	defer s.Unlock()
+	stats := PipeStats{
+		Pending: PipeUsage{Packages: s.pq.Len(), Bytes: s.bytes},
+		Evicted: map[proto.PacketKind]PipeUsage{},
+	}
+	for kind, usage := range s.evicted {
+		stats.Evicted[kind] = usage
+	}
+	now := time.Now()
+	stats.Kinds = map[proto.PacketKind]KindSchedule{}
+	for kind, schedule := range s.schedules {
+		stats.Kinds[kind] = schedule
+	}
+	stats.PendingKinds = map[proto.PacketKind]PipeUsage{}
+	for kind, packs := range s.kinds {
+		if len(packs) > 0 {
+			stats.PendingKinds[kind] = PipeUsage{Packages: len(packs), Bytes: s.kindBytes[kind]}
+		}
+		if oldest := oldestPackage(packs); oldest != nil {
+			schedule := stats.Kinds[kind]
+			schedule.OldestWait = now.Sub(oldest.time)
+			stats.Kinds[kind] = schedule
+		}
+	}
+	stats.StoreErrors = s.errors
+	stats.LastStoreError = s.lastError
+	return stats
+}
+
+func (s *DefaultPipeStore) dropped(pack *Package) {
+	if s.onDrop != nil {
+		s.onDrop(pack)
+	}
+}
+
+// NewDefaultPipeStore creates an in-memory pipe store without a budget, scheduling packages by priority
 func NewDefaultPipeStore() *DefaultPipeStore {
+	return NewMemoryPipeStore(PipeBudget{Eviction: EvictDropOldest}, PipeSchedule{Mode: SchedulePriority})
+}
+
+// NewMemoryPipeStore creates an in-memory pipe store evicting packages to stay within the budget
+// and scheduling packages according to the schedule
+func NewMemoryPipeStore(budget PipeBudget, schedule PipeSchedule) *DefaultPipeStore {
 	pq := PriorityQueue{}
 	heap.Init(&pq)
 	return &DefaultPipeStore{
-		pq:    &pq,
-		kinds: map[proto.PacketKind][]*Package{},
+		pq:        &pq,
+		kinds:     map[proto.PacketKind][]*Package{},
+		budget:    budget,
+		kindBytes: map[proto.PacketKind]int{},
+		evicted:   map[proto.PacketKind]PipeUsage{},
+		schedule:  schedule,
+		deficits:  map[proto.PacketKind]int{},
+		schedules: map[proto.PacketKind]KindSchedule{},
 	}
 }
 
@@ -0,0 +1,401 @@
+package client
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/MagalixCorp/magalix-agent/v2/proto"
+	"github.com/MagalixTechnologies/core/logger"
+)
+
+const (
+	diskPipeStoreFile = "pipe.log"
+
+	// DefaultDiskCompactThreshold number of log records written before
+	// the log is considered for compaction
+	DefaultDiskCompactThreshold = 1000
+)
+
+type diskRecordOp string
+
+const (
+	diskRecordAdd diskRecordOp = "add"
+	diskRecordAck diskRecordOp = "ack"
+)
+
+// diskRecord a single line of the append-only log
+type diskRecord struct {
+	Op          diskRecordOp     `json:"op"`
+	ID          uint64           `json:"id"`
+	PackageID   string           `json:"package_id,omitempty"`
+	Kind        proto.PacketKind `json:"kind,omitempty"`
+	ExpiryTime  *time.Time       `json:"expiry_time,omitempty"`
+	ExpiryCount int              `json:"expiry_count,omitempty"`
+	Priority    int              `json:"priority,omitempty"`
+	Retries     int              `json:"retries,omitempty"`
+	Tries       int              `json:"tries,omitempty"`
+	Time        *time.Time       `json:"time,omitempty"`
+	Data        json.RawMessage  `json:"data,omitempty"`
+}
+
+// DiskPipeStore a PipeStore that journals every package to an append-only log
+// so pending packages survive agent restarts.
+// Ordering and expiry are delegated to an in-memory DefaultPipeStore which is
+// rebuilt by replaying the log on start.
+type DiskPipeStore struct {
+	sync.Mutex
+
+	path string
+	file *os.File
+
+	mem *DefaultPipeStore
+
+	// log ids of packages that have not been acked yet, pending or popped for sending
+	ids    map[*Package]uint64
+	nextID uint64
+
+	// records written since the last compaction
+	records          int
+	compactThreshold int
+
+	// errors are counted rather than logged, as the store is reachable from Client.Write piping logs
+	// they are reported with the pipe stats
+	errors    int
+	lastError string
+}
+
+// NewDiskPipeStore opens or creates a disk pipe store in the given directory
+// and loads all pending packages from a previous run
+func NewDiskPipeStore(dir string, compactThreshold int, budget PipeBudget, schedule PipeSchedule) (*DiskPipeStore, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create pipe store directory, error: %w", err)
+	}
+
+	s := &DiskPipeStore{
+		path:             filepath.Join(dir, diskPipeStoreFile),
+		mem:              NewMemoryPipeStore(budget, schedule),
+		ids:              map[*Package]uint64{},
+		compactThreshold: compactThreshold,
+	}
+	// packages expired or evicted by the in-memory store are acked, so they are not loaded again
+	s.mem.onDrop = s.drop
+
+	err = s.replay()
+	if err != nil {
+		return nil, err
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	err = s.compact()
+	if err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// replay rebuilds the in-memory store from the log
+func (s *DiskPipeStore) replay() error {
+	file, err := os.Open(s.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("unable to open pipe store log, error: %w", err)
+	}
+	defer file.Close()
+
+	byID := map[uint64]*Package{}
+	corrupted := 0
+
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if len(line) > 0 {
+			var record diskRecord
+			if jsonErr := json.Unmarshal(line, &record); jsonErr != nil {
+				// most likely a partial write of the last record before a crash
+				corrupted++
+			} else {
+				s.apply(&record, byID)
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("unable to read pipe store log, error: %w", err)
+		}
+	}
+
+	if corrupted > 0 {
+		logger.Warnw("skipped corrupted records in pipe store log", "path", s.path, "records", corrupted)
+	}
+	logger.Infow("loaded pending packages from disk", "path", s.path, "packages", s.mem.Len())
+
+	return nil
+}
+
+func (s *DiskPipeStore) apply(record *diskRecord, byID map[uint64]*Package) {
+	if record.ID > s.nextID {
+		s.nextID = record.ID
+	}
+
+	switch record.Op {
+	case diskRecordAdd:
+		pack := &Package{
+			ID:          record.PackageID,
+			Kind:        record.Kind,
+			ExpiryTime:  record.ExpiryTime,
+			ExpiryCount: record.ExpiryCount,
+			Priority:    record.Priority,
+			Retries:     record.Retries,
+			retries:     record.Tries,
+			Data:        record.Data,
+		}
+		if record.Time != nil {
+			pack.time = *record.Time
+		}
+		byID[record.ID] = pack
+		s.ids[pack] = record.ID
+		s.mem.Add(pack)
+	case diskRecordAck:
+		pack, ok := byID[record.ID]
+		if !ok {
+			return
+		}
+		delete(byID, record.ID)
+		delete(s.ids, pack)
+		s.mem.Ack(pack)
+	}
+}
+
+func (s *DiskPipeStore) Add(pack *Package) int {
+	if pack == nil {
+		panic("programming error, make sure you don't pass nil package")
+	}
+	s.Lock()
+	defer s.Unlock()
+	if (pack.time == time.Time{}) {
+		pack.time = time.Now()
+	}
+
+	if _, ok := s.ids[pack]; ok {
+		// a popped package put back after a failed send is still in the log
+		removed := s.mem.Add(pack)
+		s.maybeCompact()
+		return removed
+	}
+
+	data, err := json.Marshal(pack.Data)
+	if err != nil {
+		s.fail(fmt.Errorf("unable to persist %s package, keeping it in memory only, error: %w", pack.Kind, err))
+	} else {
+		// keep the encoded form, it is what gets sent anyway
+		pack.Data = json.RawMessage(data)
+
+		s.nextID++
+		s.ids[pack] = s.nextID
+		s.write(s.addRecord(s.nextID, pack))
+	}
+
+	removed := s.mem.Add(pack)
+	s.maybeCompact()
+	return removed
+}
+
+// Pop takes a package for sending, it stays in the log until acked
+// so it is restored if the agent stops while sending it
+func (s *DiskPipeStore) Pop() *Package {
+	s.Lock()
+	defer s.Unlock()
+	return s.mem.Pop()
+}
+
+func (s *DiskPipeStore) Peek() *Package {
+	s.Lock()
+	defer s.Unlock()
+	return s.mem.Peek()
+}
+
+func (s *DiskPipeStore) Ack(pack *Package) {
+	s.Lock()
+	defer s.Unlock()
+	s.mem.Ack(pack)
+	s.ack(pack)
+}
+
+func (s *DiskPipeStore) ack(pack *Package) {
+	s.drop(pack)
+	s.maybeCompact()
+}
+
+// drop writes an ack record without compacting
+// it is called by the in-memory store with its lock held
+func (s *DiskPipeStore) drop(pack *Package) {
+	id, ok := s.ids[pack]
+	if !ok {
+		return
+	}
+	delete(s.ids, pack)
+	s.write(&diskRecord{Op: diskRecordAck, ID: id})
+}
+
+func (s *DiskPipeStore) Len() int {
+	return s.mem.Len()
+}
+
+func (s *DiskPipeStore) Count() map[proto.PacketKind]int {
+	return s.mem.Count()
+}
+
+func (s *DiskPipeStore) Persistent() bool {
+	return true
+}
+
+func (s *DiskPipeStore) Stats() PipeStats {
+	stats := s.mem.Stats()
+	s.Lock()
+	stats.StoreErrors += s.errors
+	if s.lastError != "" {
+		stats.LastStoreError = s.lastError
+	}
+	s.Unlock()
+	return stats
+}
+
+// Close closes the underlying log file
+func (s *DiskPipeStore) Close() error {
+	s.Lock()
+	defer s.Unlock()
+	if s.file == nil {
+		return nil
+	}
+	err := s.file.Close()
+	s.file = nil
+	return err
+}
+
+func (s *DiskPipeStore) addRecord(id uint64, pack *Package) *diskRecord {
+	t := pack.time
+	data, _ := pack.Data.(json.RawMessage)
+	return &diskRecord{
+		Op:          diskRecordAdd,
+		ID:          id,
+		PackageID:   pack.ID,
+		Kind:        pack.Kind,
+		ExpiryTime:  pack.ExpiryTime,
+		ExpiryCount: pack.ExpiryCount,
+		Priority:    pack.Priority,
+		Retries:     pack.Retries,
+		Tries:       pack.retries,
+		Time:        &t,
+		Data:        data,
+	}
+}
+
+func (s *DiskPipeStore) write(record *diskRecord) {
+	if s.file == nil {
+		return
+	}
+	line, err := json.Marshal(record)
+	if err != nil {
+		s.fail(fmt.Errorf("unable to encode pipe store record, error: %w", err))
+		return
+	}
+	// a single write per record, so a crash leaves at most one partial line
+	_, err = s.file.Write(append(line, '\n'))
+	if err != nil {
+		s.fail(fmt.Errorf("unable to write pipe store record to %s, error: %w", s.path, err))
+		return
+	}
+	s.records++
+}
+
+func (s *DiskPipeStore) maybeCompact() {
+	if s.records < s.compactThreshold || s.records < 2*s.mem.Len() {
+		return
+	}
+	err := s.compact()
+	if err != nil {
+		s.fail(fmt.Errorf("unable to compact pipe store log %s, error: %w", s.path, err))
+	}
+}
+
+// fail records an error of the store, the lock must be held
+func (s *DiskPipeStore) fail(err error) {
+	s.errors++
+	s.lastError = err.Error()
+}
+
+// compact rewrites the log with pending packages only
+// pending packages are written in their original order so that
+// expiry counts are evaluated the same way on replay
+func (s *DiskPipeStore) compact() error {
+	// packages popped for sending are kept until acked
+	pending := make([]*Package, 0, len(s.ids))
+	for pack := range s.ids {
+		pending = append(pending, pack)
+	}
+
+	sort.SliceStable(pending, func(i, j int) bool {
+		return pending[i].time.Before(pending[j].time)
+	})
+
+	tmpPath := s.path + ".tmp"
+	tmp, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+
+	ids := make(map[*Package]uint64, len(pending))
+	writer := bufio.NewWriter(tmp)
+	for _, pack := range pending {
+		id := s.ids[pack]
+		ids[pack] = id
+		line, err := json.Marshal(s.addRecord(id, pack))
+		if err != nil {
+			tmp.Close()
+			return err
+		}
+		_, _ = writer.Write(append(line, '\n'))
+	}
+
+	if err := writer.Flush(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	if s.file != nil {
+		s.file.Close()
+		s.file = nil
+	}
+	if err := os.Rename(tmpPath, s.path); err != nil {
+		return err
+	}
+
+	s.file, err = os.OpenFile(s.path, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+
+	s.ids = ids
+	s.records = len(ids)
+	return nil
+}
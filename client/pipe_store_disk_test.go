@@ -0,0 +1,160 @@
+package client
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/MagalixCorp/magalix-agent/v2/proto"
+)
+
+func newTestDiskPipeStore(t *testing.T, dir string, compactThreshold int) *DiskPipeStore {
+	s, err := NewDiskPipeStore(dir, compactThreshold, PipeBudget{Eviction: EvictDropOldest}, PipeSchedule{Mode: SchedulePriority})
+	if err != nil {
+		t.Fatalf("NewDiskPipeStore() error = %v", err)
+	}
+	return s
+}
+
+func TestDiskPipeStore_Reopen(t *testing.T) {
+	tests := []struct {
+		name string
+		// packages added before reopening
+		packs []*Package
+		// number of packages to pop before reopening
+		pop int
+		// ack popped packages as sent
+		ack bool
+		// data of packages expected in order after reopening
+		want []string
+	}{
+		{
+			name: "pending packages survive",
+			packs: []*Package{
+				{Kind: proto.PacketKindLogs, Priority: 2, Data: "a"},
+				{Kind: proto.PacketKindLogs, Priority: 1, Data: "b"},
+			},
+			want: []string{`"b"`, `"a"`},
+		},
+		{
+			name: "acked packages are not restored",
+			packs: []*Package{
+				{Kind: proto.PacketKindLogs, Priority: 1, Data: "a"},
+				{Kind: proto.PacketKindLogs, Priority: 2, Data: "b"},
+			},
+			pop:  1,
+			ack:  true,
+			want: []string{`"b"`},
+		},
+		{
+			name: "popped packages not acked are restored",
+			packs: []*Package{
+				{Kind: proto.PacketKindLogs, Priority: 1, Data: "a"},
+				{Kind: proto.PacketKindLogs, Priority: 2, Data: "b"},
+			},
+			pop:  1,
+			want: []string{`"a"`, `"b"`},
+		},
+		{
+			name: "time expired packages are dropped",
+			packs: []*Package{
+				{Kind: proto.PacketKindLogs, ExpiryTime: after(50 * time.Millisecond), Data: "a"},
+				{Kind: proto.PacketKindMetricsStoreV2Request, Data: "b"},
+			},
+			want: []string{`"b"`},
+		},
+		{
+			name: "expiry count is honored",
+			packs: []*Package{
+				{Kind: proto.PacketKindLogs, ExpiryCount: 1, Data: "a"},
+				{Kind: proto.PacketKindLogs, ExpiryCount: 1, Data: "b"},
+			},
+			want: []string{`"b"`},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "pipe-store")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			s := newTestDiskPipeStore(t, dir, DefaultDiskCompactThreshold)
+			for _, pack := range tt.packs {
+				s.Add(pack)
+			}
+			for i := 0; i < tt.pop; i++ {
+				pack := s.Pop()
+				if tt.ack {
+					s.Ack(pack)
+				}
+			}
+			s.Close()
+
+			time.Sleep(100 * time.Millisecond)
+
+			s = newTestDiskPipeStore(t, dir, DefaultDiskCompactThreshold)
+			defer s.Close()
+			if got := s.Len(); got != len(tt.want) {
+				t.Fatalf("DiskPipeStore.Len() = %v, want %v", got, len(tt.want))
+			}
+			for i, want := range tt.want {
+				pack := s.Pop()
+				if got := string(pack.Data.(json.RawMessage)); got != want {
+					t.Errorf("case %d DiskPipeStore.Pop() = %v, want %v", i, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestDiskPipeStore_Compact(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pipe-store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s := newTestDiskPipeStore(t, dir, 10)
+	for i := 0; i < 100; i++ {
+		s.Add(&Package{Kind: proto.PacketKindLogs, Priority: 1, Data: i})
+		if i%2 == 0 {
+			s.Ack(s.Pop())
+		}
+	}
+	if s.records > 2*s.Len()+1 {
+		t.Errorf("log was not compacted, records = %v", s.records)
+	}
+	s.Close()
+
+	s = newTestDiskPipeStore(t, dir, 10)
+	defer s.Close()
+	if got := s.Len(); got != 50 {
+		t.Errorf("DiskPipeStore.Len() = %v, want %v", got, 50)
+	}
+}
+
+func TestDiskPipeStore_Errors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pipe-store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s := newTestDiskPipeStore(t, dir, 1000)
+	defer s.Close()
+	// writes fail as if the disk was full
+	s.file.Close()
+
+	s.Add(&Package{Kind: proto.PacketKindLogs, Data: "a"})
+	stats := s.Stats()
+	if stats.StoreErrors != 1 || stats.LastStoreError == "" {
+		t.Errorf("DiskPipeStore.Stats() errors = %v, last error = %q, want 1 error", stats.StoreErrors, stats.LastStoreError)
+	}
+	if got := s.Len(); got != 1 {
+		t.Errorf("DiskPipeStore.Len() = %v, want %v", got, 1)
+	}
+}
@@ -0,0 +1,83 @@
+package client
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/MagalixCorp/magalix-agent/v2/proto"
+)
+
+// fakeSender blocks sending until released
+type fakeSender struct {
+	release chan struct{}
+}
+
+func (s *fakeSender) SendIdempotent(id string, kind proto.PacketKind, in interface{}) error {
+	<-s.release
+	return nil
+}
+
+func TestPipe_Drain(t *testing.T) {
+	tests := []struct {
+		name          string
+		workers       int
+		packages      int
+		wantSent      int
+		wantRemaining int
+		wantDropped   int
+	}{
+		{
+			name:        "sends pending packages",
+			workers:     2,
+			packages:    5,
+			wantSent:    6,
+			wantDropped: 1,
+		},
+		{
+			name:          "stops at the deadline",
+			packages:      5,
+			wantRemaining: 5,
+			wantDropped:   6,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sender := &fakeSender{release: make(chan struct{})}
+			pipe := NewPipe(sender, NewDefaultPipeStore())
+			for i := 0; i < tt.packages; i++ {
+				pipe.Send(Package{Kind: proto.PacketKindMetricsStoreV2Request, Priority: i})
+			}
+			pipe.Start(tt.workers)
+			// metrics are rejected while draining, logs are not
+			time.AfterFunc(10*time.Millisecond, func() {
+				pipe.Send(Package{Kind: proto.PacketKindMetricsStoreV2Request})
+				pipe.Send(Package{Kind: proto.PacketKindLogs})
+			})
+			time.AfterFunc(50*time.Millisecond, func() { close(sender.release) })
+
+			ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+			defer cancel()
+			report := pipe.Drain(ctx)
+
+			if report.Sent != tt.wantSent {
+				t.Errorf("Sent = %v, want %v", report.Sent, tt.wantSent)
+			}
+			if got := report.Remaining[proto.PacketKindMetricsStoreV2Request]; got != tt.wantRemaining {
+				t.Errorf("Remaining = %v, want %v", got, tt.wantRemaining)
+			}
+			if got := report.Rejected[proto.PacketKindMetricsStoreV2Request]; got != 1 {
+				t.Errorf("Rejected = %v, want %v", got, 1)
+			}
+			if got := report.Dropped(); got != tt.wantDropped {
+				t.Errorf("Dropped() = %v, want %v", got, tt.wantDropped)
+			}
+
+			// packages are accepted again once drained
+			pipe.Send(Package{Kind: proto.PacketKindMetricsStoreV2Request})
+			if got := pipe.storage.Count()[proto.PacketKindMetricsStoreV2Request]; tt.workers == 0 && got != tt.wantRemaining+1 {
+				t.Errorf("Count() after drain = %v, want %v", got, tt.wantRemaining+1)
+			}
+		})
+	}
+}
@@ -0,0 +1,75 @@
+package client
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+
+	"github.com/gorilla/websocket"
+)
+
+// ProxyConfig egress proxy used to connect to the agent gateway
+type ProxyConfig struct {
+	// url http (CONNECT) or socks5 proxy, nil uses HTTPS_PROXY and NO_PROXY environment variables
+	url *url.URL
+	// ca CA bundle of a TLS intercepting proxy trusted in addition to system roots
+	ca []byte
+}
+
+// NewProxyConfig creates a proxy config
+// all parameters are optional, user and password override credentials set in the proxy url
+func NewProxyConfig(rawURL, user, password, caFile string) (*ProxyConfig, error) {
+	config := &ProxyConfig{}
+
+	if rawURL != "" {
+		proxyURL, err := url.Parse(rawURL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy url, error: %w", err)
+		}
+		if proxyURL.Scheme != "http" && proxyURL.Scheme != "socks5" {
+			return nil, fmt.Errorf("unsupported proxy scheme %s, expected http or socks5", proxyURL.Scheme)
+		}
+		if user != "" {
+			proxyURL.User = url.UserPassword(user, password)
+		}
+		config.url = proxyURL
+	}
+
+	if caFile != "" {
+		ca, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read proxy CA bundle, error: %w", err)
+		}
+		if !x509.NewCertPool().AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("no certificates found in %s", caFile)
+		}
+		config.ca = ca
+	}
+
+	return config, nil
+}
+
+// configure sets the proxy and trusted roots on a websocket dialer
+func (p *ProxyConfig) configure(dialer *websocket.Dialer) {
+	if p == nil || p.url == nil {
+		dialer.Proxy = http.ProxyFromEnvironment
+	} else {
+		dialer.Proxy = http.ProxyURL(p.url)
+	}
+
+	if p != nil && p.ca != nil {
+		// a new pool for every dial, as authenticators may add to it
+		pool, err := x509.SystemCertPool()
+		if err != nil || pool == nil {
+			pool = x509.NewCertPool()
+		}
+		pool.AppendCertsFromPEM(p.ca)
+		if dialer.TLSClientConfig == nil {
+			dialer.TLSClientConfig = &tls.Config{}
+		}
+		dialer.TLSClientConfig.RootCAs = pool
+	}
+}
@@ -1,6 +1,7 @@
 package client
 
 import (
+	"fmt"
 	"time"
 
 	"github.com/MagalixCorp/magalix-agent/v2/proto"
@@ -22,11 +23,21 @@ func (client *Client) hello() error {
 		PacketV2Enabled:  true,
 		ServerVersion:    client.ServerVersion,
 		AgentPermissions: client.AgentPermissions,
+		Capabilities:     client.agentCapabilities(),
 	}, &hello)
 	if err != nil {
+		if e, ok := err.(*channel.ProtocolError); ok && e.Code == channel.BadRequestCode {
+			return fmt.Errorf("%w: %s", errIncompatibleGateway, e)
+		}
 		return err
 	}
 
+	if hello.Major != 0 && hello.Major != ProtocolMajorVersion {
+		return fmt.Errorf("%w: unsupported protocol major version %d", errIncompatibleGateway, hello.Major)
+	}
+
+	client.negotiate(hello.Capabilities)
+
 	logger.Infow("hello phase has been finished",
 		"client/protocol/major", ProtocolMajorVersion,
 		"client/protocol/minor", ProtocolMinorVersion,
@@ -57,7 +68,7 @@ func (client *Client) authorize() error {
 		)
 	}
 
-	token, err := client.getAuthorizationToken(question.Token)
+	token, err := client.authenticator.Answer(question.Token)
 	if err != nil {
 		return err
 	}
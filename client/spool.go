@@ -0,0 +1,231 @@
+package client
+
+import (
+	"encoding/gob"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/MagalixCorp/magalix-agent/v2/proto"
+	"github.com/MagalixTechnologies/core/logger"
+)
+
+const (
+	spoolFileExt     = ".spool"
+	spoolReplayedExt = ".replayed"
+	// spoolOffsetExt the number of records of a spool file replayed so far is kept next to it
+	spoolOffsetExt = ".offset"
+)
+
+// SpoolRecord a single encoded packet written to a spool file
+type SpoolRecord struct {
+	Kind proto.PacketKind
+	Time time.Time
+	// Codec name of the codec the payload is encoded with, empty means snappy
+	Codec   string
+	Payload []byte
+}
+
+// Spool writes encoded packets to rotating files instead of sending them
+// to the agent gateway, used when the gateway is not reachable at all
+type Spool struct {
+	sync.Mutex
+
+	dir         string
+	maxFileSize int64
+	maxFiles    int
+
+	file    *os.File
+	encoder *gob.Encoder
+	size    int64
+	seq     int
+}
+
+// NewSpool creates a spool in the given directory
+// maxFileSize is the size after which a new file is started
+// maxFiles is the number of files to keep, oldest files are removed first, 0 means unlimited
+func NewSpool(dir string, maxFileSize int64, maxFiles int) (*Spool, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create spool directory, error: %w", err)
+	}
+	return &Spool{
+		dir:         dir,
+		maxFileSize: maxFileSize,
+		maxFiles:    maxFiles,
+	}, nil
+}
+
+// Write appends an encoded packet to the current spool file
+func (s *Spool) Write(kind proto.PacketKind, codec string, payload []byte) error {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.file == nil || s.size >= s.maxFileSize {
+		err := s.rotate()
+		if err != nil {
+			return err
+		}
+	}
+
+	err := s.encoder.Encode(SpoolRecord{
+		Kind:    kind,
+		Time:    time.Now().UTC(),
+		Codec:   codec,
+		Payload: payload,
+	})
+	if err != nil {
+		return fmt.Errorf("unable to write to spool file, error: %w", err)
+	}
+	return nil
+}
+
+// Close closes the current spool file
+func (s *Spool) Close() error {
+	s.Lock()
+	defer s.Unlock()
+	if s.file == nil {
+		return nil
+	}
+	err := s.file.Close()
+	s.file = nil
+	return err
+}
+
+func (s *Spool) rotate() error {
+	if s.file != nil {
+		s.file.Close()
+		s.file = nil
+	}
+
+	// names sort in creation order
+	s.seq++
+	name := filepath.Join(s.dir, fmt.Sprintf("%020d-%06d%s", time.Now().UnixNano(), s.seq%1000000, spoolFileExt))
+	file, err := os.OpenFile(name, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("unable to create spool file, error: %w", err)
+	}
+	s.file = file
+	s.size = 0
+	s.encoder = gob.NewEncoder(&spoolCounter{spool: s})
+	logger.Infow("started new spool file", "file", name)
+
+	if s.maxFiles > 0 {
+		files, err := ListSpoolFiles(s.dir)
+		if err != nil {
+			return err
+		}
+		for len(files) > s.maxFiles {
+			logger.Warnw("spool files limit reached, removing oldest file", "file", files[0])
+			if err := os.Remove(files[0]); err != nil {
+				return fmt.Errorf("unable to remove spool file, error: %w", err)
+			}
+			files = files[1:]
+		}
+	}
+	return nil
+}
+
+// spoolCounter tracks the size of the current spool file
+type spoolCounter struct {
+	spool *Spool
+}
+
+func (c *spoolCounter) Write(p []byte) (int, error) {
+	n, err := c.spool.file.Write(p)
+	c.spool.size += int64(n)
+	return n, err
+}
+
+// ListSpoolFiles lists spool files in the directory that are not replayed yet, oldest first
+func ListSpoolFiles(dir string) ([]string, error) {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("unable to list spool directory, error: %w", err)
+	}
+	files := []string{}
+	for _, info := range infos {
+		if info.IsDir() || !strings.HasSuffix(info.Name(), spoolFileExt) {
+			continue
+		}
+		files = append(files, filepath.Join(dir, info.Name()))
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// ReadSpoolFile calls fn for every record in a spool file in the order they were written
+// a truncated last record, left by a crash while writing, is skipped
+func ReadSpoolFile(path string, fn func(record *SpoolRecord) error) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("unable to open spool file, error: %w", err)
+	}
+	defer file.Close()
+
+	decoder := gob.NewDecoder(file)
+	for {
+		var record SpoolRecord
+		err := decoder.Decode(&record)
+		if err == io.EOF {
+			return nil
+		}
+		if err == io.ErrUnexpectedEOF {
+			logger.Warnw("spool file ends with a truncated record", "file", path)
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("unable to decode spool file, error: %w", err)
+		}
+		if err := fn(&record); err != nil {
+			return err
+		}
+	}
+}
+
+// MarkSpoolFileReplayed renames a spool file so it is skipped by ListSpoolFiles
+func MarkSpoolFileReplayed(path string) error {
+	if err := os.Rename(path, path+spoolReplayedExt); err != nil {
+		return err
+	}
+	if err := os.Remove(path + spoolOffsetExt); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// SpoolFileOffset gets the number of records of a spool file replayed so far
+func SpoolFileOffset(path string) (int, error) {
+	data, err := ioutil.ReadFile(path + spoolOffsetExt)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("unable to read spool offset file, error: %w", err)
+	}
+	offset, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return 0, fmt.Errorf("invalid spool offset file, error: %w", err)
+	}
+	return offset, nil
+}
+
+// SetSpoolFileOffset records the number of records of a spool file replayed so far,
+// so a replay interrupted midway resumes after them
+func SetSpoolFileOffset(path string, offset int) error {
+	tmp := path + spoolOffsetExt + ".tmp"
+	if err := ioutil.WriteFile(tmp, []byte(strconv.Itoa(offset)), 0644); err != nil {
+		return fmt.Errorf("unable to write spool offset file, error: %w", err)
+	}
+	if err := os.Rename(tmp, path+spoolOffsetExt); err != nil {
+		return fmt.Errorf("unable to replace spool offset file, error: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,102 @@
+package client
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/MagalixCorp/magalix-agent/v2/proto"
+)
+
+func TestSpool_WriteAndRead(t *testing.T) {
+	tests := []struct {
+		name        string
+		maxFileSize int64
+		maxFiles    int
+		packets     int
+		wantFiles   int
+		wantFirst   string
+	}{
+		{
+			name:        "single file",
+			maxFileSize: 1 << 20,
+			packets:     10,
+			wantFiles:   1,
+			wantFirst:   "0",
+		},
+		{
+			name:        "rotates files",
+			maxFileSize: 1,
+			packets:     3,
+			wantFiles:   3,
+			wantFirst:   "0",
+		},
+		{
+			name:        "removes oldest files",
+			maxFileSize: 1,
+			maxFiles:    2,
+			packets:     3,
+			wantFiles:   2,
+			wantFirst:   "1",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "spool")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			spool, err := NewSpool(dir, tt.maxFileSize, tt.maxFiles)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i < tt.packets; i++ {
+				if err := spool.Write(proto.PacketKindLogs, proto.CodecSnappy, []byte{byte('0' + i)}); err != nil {
+					t.Fatalf("Spool.Write() error = %v", err)
+				}
+			}
+			spool.Close()
+
+			files, err := ListSpoolFiles(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(files) != tt.wantFiles {
+				t.Fatalf("ListSpoolFiles() = %v files, want %v", len(files), tt.wantFiles)
+			}
+
+			var got []*SpoolRecord
+			for _, file := range files {
+				err := ReadSpoolFile(file, func(record *SpoolRecord) error {
+					got = append(got, record)
+					return nil
+				})
+				if err != nil {
+					t.Fatalf("ReadSpoolFile() error = %v", err)
+				}
+			}
+			if got[0].Kind != proto.PacketKindLogs || string(got[0].Payload) != tt.wantFirst {
+				t.Errorf("first record = %v %s, want %v %s", got[0].Kind, got[0].Payload, proto.PacketKindLogs, tt.wantFirst)
+			}
+
+			if err := SetSpoolFileOffset(files[0], 1); err != nil {
+				t.Fatal(err)
+			}
+			if offset, err := SpoolFileOffset(files[0]); err != nil || offset != 1 {
+				t.Errorf("SpoolFileOffset() = %v, %v, want %v", offset, err, 1)
+			}
+			if err := MarkSpoolFileReplayed(files[0]); err != nil {
+				t.Fatal(err)
+			}
+			if offset, err := SpoolFileOffset(files[0]); err != nil || offset != 0 {
+				t.Errorf("SpoolFileOffset() after replay = %v, %v, want %v", offset, err, 0)
+			}
+			files, _ = ListSpoolFiles(dir)
+			if len(files) != tt.wantFiles-1 {
+				t.Errorf("ListSpoolFiles() after replay = %v files, want %v", len(files), tt.wantFiles-1)
+			}
+		})
+	}
+}
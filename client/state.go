@@ -0,0 +1,194 @@
+package client
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/MagalixTechnologies/core/logger"
+)
+
+// State connection state of the agent gateway client
+type State int
+
+const (
+	// StateDisconnected there is no connection with the agent gateway
+	StateDisconnected State = iota
+	// StateConnecting dialing the agent gateway
+	StateConnecting
+	// StateHello connected and negotiating the protocol version and capabilities
+	StateHello
+	// StateAuthorizing authorizing the agent
+	StateAuthorizing
+	// StateReady authorized, packets can be sent
+	StateReady
+	// StateDormant gave up connecting, the client waits before trying again
+	StateDormant
+)
+
+var stateNames = map[State]string{
+	StateDisconnected: "disconnected",
+	StateConnecting:   "connecting",
+	StateHello:        "hello",
+	StateAuthorizing:  "authorizing",
+	StateReady:        "ready",
+	StateDormant:      "dormant",
+}
+
+func (s State) String() string {
+	if name, ok := stateNames[s]; ok {
+		return name
+	}
+	return fmt.Sprintf("state(%d)", int(s))
+}
+
+// MarshalText marshals the state as its name
+func (s State) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// StateTransition a change of the connection state
+type StateTransition struct {
+	From State
+	To   State
+	Time time.Time
+}
+
+// stateSubscriberBuffer transitions buffered for a subscriber, the oldest are dropped if it doesn't keep up
+const stateSubscriberBuffer = 16
+
+// stateMachine holds the connection state and notifies subscribers about transitions
+type stateMachine struct {
+	sync.Mutex
+
+	state State
+	since time.Time
+	// changed is closed and replaced on every transition to wake up waiters
+	changed     chan struct{}
+	subscribers map[chan StateTransition]struct{}
+}
+
+func newStateMachine(state State) *stateMachine {
+	return &stateMachine{
+		state:       state,
+		since:       time.Now(),
+		changed:     make(chan struct{}),
+		subscribers: map[chan StateTransition]struct{}{},
+	}
+}
+
+// get returns the current state and the time it was entered
+func (m *stateMachine) get() (State, time.Time) {
+	m.Lock()
+	defer m.Unlock()
+	return m.state, m.since
+}
+
+// set changes the state, returns false if it is already in the state
+func (m *stateMachine) set(state State) bool {
+	m.Lock()
+	defer m.Unlock()
+	return m.setLocked(state)
+}
+
+// setUnless changes the state unless it is in the unless state
+func (m *stateMachine) setUnless(state State, unless State) bool {
+	m.Lock()
+	defer m.Unlock()
+	if m.state == unless {
+		return false
+	}
+	return m.setLocked(state)
+}
+
+// transition changes the state only if it is in the from state
+func (m *stateMachine) transition(from State, to State) bool {
+	m.Lock()
+	defer m.Unlock()
+	if m.state != from {
+		return false
+	}
+	return m.setLocked(to)
+}
+
+func (m *stateMachine) setLocked(state State) bool {
+	if m.state == state {
+		return false
+	}
+	transition := StateTransition{
+		From: m.state,
+		To:   state,
+		Time: time.Now(),
+	}
+	m.state = state
+	m.since = transition.Time
+	close(m.changed)
+	m.changed = make(chan struct{})
+
+	logger.Infow("agent gateway connection state changed", "from", transition.From, "to", transition.To)
+
+	for ch := range m.subscribers {
+		notify(ch, transition)
+	}
+	return true
+}
+
+// notify sends a transition to a subscriber, dropping its oldest buffered transition if it doesn't keep up,
+// so the last transition it receives is always to the current state
+func notify(ch chan StateTransition, transition StateTransition) {
+	for {
+		select {
+		case ch <- transition:
+			return
+		default:
+		}
+		select {
+		case dropped := <-ch:
+			logger.Warnw("state subscriber is not keeping up, dropping transition", "from", dropped.From, "to", dropped.To)
+		default:
+		}
+	}
+}
+
+// subscribe returns a channel receiving transitions and a function to unsubscribe
+// the first transition received is to the current state, from itself
+func (m *stateMachine) subscribe() (<-chan StateTransition, func()) {
+	ch := make(chan StateTransition, stateSubscriberBuffer)
+	m.Lock()
+	ch <- StateTransition{From: m.state, To: m.state, Time: m.since}
+	m.subscribers[ch] = struct{}{}
+	m.Unlock()
+
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			m.Lock()
+			delete(m.subscribers, ch)
+			m.Unlock()
+		})
+	}
+}
+
+// wait waits until the state is entered, 0 timeout waits indefinitely
+// returns false if timeout occurred
+func (m *stateMachine) wait(state State, timeout time.Duration) bool {
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+	for {
+		m.Lock()
+		current, changed := m.state, m.changed
+		m.Unlock()
+		if current == state {
+			return true
+		}
+		select {
+		case <-changed:
+		case <-expired:
+			return false
+		}
+	}
+}
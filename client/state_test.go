@@ -0,0 +1,109 @@
+package client
+
+import (
+	"testing"
+	"time"
+)
+
+func TestStateMachine_Transitions(t *testing.T) {
+	tests := []struct {
+		name      string
+		steps     func(m *stateMachine)
+		wantState State
+		wantCount int
+	}{
+		{
+			name: "handshake",
+			steps: func(m *stateMachine) {
+				m.set(StateConnecting)
+				m.transition(StateConnecting, StateHello)
+				m.transition(StateHello, StateAuthorizing)
+				m.transition(StateAuthorizing, StateReady)
+			},
+			wantState: StateReady,
+			wantCount: 5,
+		},
+		{
+			name: "stale handshake is ignored",
+			steps: func(m *stateMachine) {
+				m.set(StateConnecting)
+				m.set(StateDisconnected)
+				m.transition(StateConnecting, StateHello)
+			},
+			wantState: StateDisconnected,
+			wantCount: 3,
+		},
+		{
+			name: "disconnect doesn't wake dormant",
+			steps: func(m *stateMachine) {
+				m.set(StateDormant)
+				m.setUnless(StateDisconnected, StateDormant)
+			},
+			wantState: StateDormant,
+			wantCount: 2,
+		},
+		{
+			name: "same state is not a transition",
+			steps: func(m *stateMachine) {
+				m.set(StateConnecting)
+				m.set(StateConnecting)
+			},
+			wantState: StateConnecting,
+			wantCount: 2,
+		},
+		{
+			name: "oldest transitions are dropped for a slow subscriber",
+			steps: func(m *stateMachine) {
+				for i := 0; i < stateSubscriberBuffer; i++ {
+					m.set(StateConnecting)
+					m.set(StateDisconnected)
+				}
+				m.set(StateReady)
+			},
+			wantState: StateReady,
+			wantCount: stateSubscriberBuffer,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newStateMachine(StateDisconnected)
+			transitions, unsubscribe := m.subscribe()
+			tt.steps(m)
+			unsubscribe()
+
+			if state, _ := m.get(); state != tt.wantState {
+				t.Errorf("state = %v, want %v", state, tt.wantState)
+			}
+			if len(transitions) != tt.wantCount {
+				t.Errorf("transitions = %v, want %v", len(transitions), tt.wantCount)
+			}
+			// the current state is received first unless dropped, the final state is received last
+			first := <-transitions
+			if tt.wantCount < stateSubscriberBuffer && (first.From != StateDisconnected || first.To != StateDisconnected) {
+				t.Errorf("first transition = %+v, want the initial state", first)
+			}
+			last := first
+			for len(transitions) > 0 {
+				last = <-transitions
+			}
+			if last.To != tt.wantState {
+				t.Errorf("last transition to = %v, want %v", last.To, tt.wantState)
+			}
+		})
+	}
+}
+
+func TestStateMachine_Wait(t *testing.T) {
+	m := newStateMachine(StateDisconnected)
+	if m.wait(StateReady, 10*time.Millisecond) {
+		t.Fatalf("wait() = true before ready")
+	}
+
+	go func() {
+		m.set(StateConnecting)
+		m.set(StateReady)
+	}()
+	if !m.wait(StateReady, 0) {
+		t.Errorf("wait() = false, want true")
+	}
+}
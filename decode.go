@@ -0,0 +1,58 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/MagalixCorp/magalix-agent/v2/client"
+	"github.com/MagalixCorp/magalix-agent/v2/proto"
+)
+
+// decodedFrame a captured frame printed by decode
+type decodedFrame struct {
+	Time      time.Time        `json:"time"`
+	Direction string           `json:"direction"`
+	Kind      proto.PacketKind `json:"kind"`
+	Response  bool             `json:"response,omitempty"`
+	Enveloped bool             `json:"enveloped,omitempty"`
+	Codec     string           `json:"codec,omitempty"`
+	Format    string           `json:"format"`
+	Size      int              `json:"size"`
+	Redacted  bool             `json:"redacted,omitempty"`
+	Error     string           `json:"error,omitempty"`
+	Packet    interface{}      `json:"packet,omitempty"`
+}
+
+// decode prints frames of a capture file as json
+func decode(args map[string]interface{}) {
+	path := args["<capture>"].(string)
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+
+	err := client.ReadCaptureFile(path, func(record *client.CaptureRecord) error {
+		frame := decodedFrame{
+			Time:      record.Time,
+			Direction: record.Direction,
+			Kind:      record.Kind,
+			Response:  record.Response,
+			Enveloped: record.Enveloped,
+			Codec:     record.Codec,
+			Format:    record.Format,
+			Size:      len(record.Payload),
+			Redacted:  record.Redacted,
+			Error:     record.Error,
+		}
+		packet, err := client.DecodeCaptureRecord(record)
+		if err != nil {
+			frame.Error = fmt.Sprintf("unable to decode packet, error: %s", err)
+		}
+		frame.Packet = packet
+		return encoder.Encode(frame)
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "unable to decode capture file %s, error: %s\n", path, err)
+		os.Exit(1)
+	}
+}
@@ -4,9 +4,13 @@ import (
 	"context"
 	"fmt"
 	"golang.org/x/sync/errgroup"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/MagalixCorp/magalix-agent/v2/agent"
+	"github.com/MagalixCorp/magalix-agent/v2/health"
 	"github.com/MagalixCorp/magalix-agent/v2/kuber"
 	"github.com/MagalixTechnologies/core/logger"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
@@ -62,6 +66,12 @@ type EntitiesWatcher struct {
 	sendEntitiesResync agent.EntitiesResyncHandler
 
 	cancelWorker context.CancelFunc
+	// watchOnce sets up watchers on the first start, so the watcher can be restarted
+	watchOnce sync.Once
+	// watching is closed once watchers are set up
+	watching chan struct{}
+
+	health *health.Component
 }
 
 func NewEntitiesWatcher(
@@ -78,6 +88,7 @@ func NewEntitiesWatcher(
 		watchersByKind: map[string]kuber.Watcher{},
 
 		deltasQueue: make(chan agent.Delta, deltasBufferChanSize),
+		watching:    make(chan struct{}),
 	}
 	return ew
 }
@@ -90,12 +101,33 @@ func (ew *EntitiesWatcher) SetEntitiesResyncHandler(handler agent.EntitiesResync
 	ew.sendEntitiesResync = handler
 }
 
-func (ew *EntitiesWatcher) Start(ctx context.Context) error {
-	// this method should be called only once
+// SetHealth sets the component informers sync and deltas flushes are reported to
+func (ew *EntitiesWatcher) SetHealth(component *health.Component) {
+	ew.health = component
+}
 
+func (ew *EntitiesWatcher) Start(ctx context.Context) error {
 	// TODO: if a packet expires or failed to be sent
 	// we need to force a full resync to get all new updates
 
+	ew.watchOnce.Do(ew.watch)
+
+	cancelCtx, cancel := context.WithCancel(ctx)
+	ew.cancelWorker = cancel
+	eg, egCtx := errgroup.WithContext(cancelCtx)
+	eg.Go(func() error {
+		ew.deltasWorker(egCtx)
+		return nil
+	})
+	eg.Go(func() error {
+		ew.snapshotWorker(egCtx)
+		return nil
+	})
+	return eg.Wait()
+}
+
+// watch creates watchers of watched resources and waits for their caches to sync
+func (ew *EntitiesWatcher) watch() {
 	for _, gvrk := range watchedResources {
 		w := ew.observer.Watch(gvrk)
 		ew.watchers[gvrk] = w
@@ -111,19 +143,31 @@ func (ew *EntitiesWatcher) Start(ctx context.Context) error {
 	for _, watcher := range ew.watchers {
 		watcher.AddEventHandler(ew)
 	}
+	close(ew.watching)
+}
 
-	cancelCtx, cancel := context.WithCancel(ctx)
-	ew.cancelWorker = cancel
-	eg, egCtx := errgroup.WithContext(cancelCtx)
-	eg.Go(func() error {
-		ew.deltasWorker(egCtx)
-		return nil
-	})
-	eg.Go(func() error {
-		ew.snapshotWorker(egCtx)
-		return nil
-	})
-	return eg.Wait()
+// InformerCounts gets the number of cached objects by resource, empty until watchers are set up
+func (ew *EntitiesWatcher) InformerCounts() map[string]int {
+	select {
+	case <-ew.watching:
+	default:
+		return map[string]int{}
+	}
+	counts := make(map[string]int, len(ew.watchers))
+	for gvrk, watcher := range ew.watchers {
+		objects, err := watcher.Lister().List(labels.Everything())
+		if err != nil {
+			logger.Warnw("unable to list cached objects", "resource", gvrk.Resource, "error", err)
+			continue
+		}
+		counts[gvrk.Resource] = len(objects)
+	}
+	return counts
+}
+
+// DeltasQueueLength gets the number of deltas waiting to be batched
+func (ew *EntitiesWatcher) DeltasQueueLength() int {
+	return len(ew.deltasQueue)
 }
 
 func (ew *EntitiesWatcher) Stop() error {
@@ -395,6 +439,7 @@ func (ew *EntitiesWatcher) deltasWorker(ctx context.Context) {
 				if err != nil {
 					logger.Errorf("Failed to send %d deltas. %w", len(deltas), err)
 				}
+				ew.reportHealth(err)
 				break
 			}
 		}
@@ -428,6 +473,26 @@ func (ew *EntitiesWatcher) snapshotWorker(ctx context.Context) {
 	}
 }
 
+// reportHealth reports a deltas flush, the watcher is unhealthy if it failed or an informer is not synced
+func (ew *EntitiesWatcher) reportHealth(err error) {
+	if err != nil {
+		ew.health.Failure(fmt.Errorf("unable to send deltas, error: %w", err))
+		return
+	}
+	var unsynced []string
+	for gvrk, watcher := range ew.watchers {
+		if !watcher.HasSynced() {
+			unsynced = append(unsynced, gvrk.Resource)
+		}
+	}
+	if len(unsynced) > 0 {
+		sort.Strings(unsynced)
+		ew.health.Failure(fmt.Errorf("informers are not synced: %s", strings.Join(unsynced, ", ")))
+		return
+	}
+	ew.health.Success()
+}
+
 func packetGvrk(gvrk kuber.GroupVersionResourceKind) agent.GroupVersionResourceKind {
 	return agent.GroupVersionResourceKind{
 		GroupVersionResource: gvrk.GroupVersionResource,
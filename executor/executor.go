@@ -4,10 +4,12 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
-	"golang.org/x/sync/errgroup"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/MagalixCorp/magalix-agent/v2/agent"
+	"github.com/MagalixCorp/magalix-agent/v2/health"
 	"github.com/MagalixCorp/magalix-agent/v2/kuber"
 	"github.com/MagalixCorp/magalix-agent/v2/utils"
 	"github.com/MagalixTechnologies/core/logger"
@@ -39,6 +41,22 @@ type Executor struct {
 	inProgressJobs         map[string]bool
 	cancelWorkers          context.CancelFunc
 	sendAutomationFeedback agent.AutomationFeedbackHandler
+
+	// resumed is closed while automations are executed, workers wait on it while paused
+	resumed  chan struct{}
+	resumedM sync.Mutex
+
+	// workersCtx is set while the executor is started, each worker has its own cancel so the pool can shrink
+	workersCtx    context.Context
+	workerCancels []context.CancelFunc
+	workers       sync.WaitGroup
+	// configM guards dryRun, workersCount and the workers pool
+	configM sync.Mutex
+
+	health *health.Component
+	// submitTimeouts automations not queued in time, counted rather than reported as unhealthy
+	// as the queue is expected to fill up while paused
+	submitTimeouts int64
 }
 
 // NewExecutor creates a new executor
@@ -56,7 +74,9 @@ func NewExecutor(
 		workersCount:    workersCount,
 		inProgressJobs:  map[string]bool{},
 		automationsChan: make(chan *agent.Automation, automationsBufferLength),
+		resumed:         make(chan struct{}),
 	}
+	close(executor.resumed)
 
 	return executor
 }
@@ -83,6 +103,11 @@ func (executor *Executor) SetAutomationFeedbackHandler(handler agent.AutomationF
 	executor.sendAutomationFeedback = handler
 }
 
+// SetHealth sets the component the workers health is reported to
+func (executor *Executor) SetHealth(component *health.Component) {
+	executor.health = component
+}
+
 func (executor *Executor) Start(ctx context.Context) error {
 	if executor.cancelWorkers != nil {
 		executor.cancelWorkers()
@@ -90,15 +115,74 @@ func (executor *Executor) Start(ctx context.Context) error {
 
 	cancelCtx, cancel := context.WithCancel(ctx)
 	defer cancel()
-	eg, ctx := errgroup.WithContext(cancelCtx)
 	executor.cancelWorkers = cancel
-	for i := 0; i < executor.workersCount; i++ {
-		eg.Go(func() error {
+
+	executor.configM.Lock()
+	executor.workersCtx = cancelCtx
+	executor.resize()
+	executor.configM.Unlock()
+	executor.health.Success()
+
+	<-cancelCtx.Done()
+	executor.configM.Lock()
+	executor.workersCtx = nil
+	executor.workerCancels = nil
+	executor.configM.Unlock()
+	executor.workers.Wait()
+	return nil
+}
+
+// SetWorkers resizes the workers pool, removed workers complete the automation they are executing
+func (executor *Executor) SetWorkers(workers int) {
+	executor.configM.Lock()
+	defer executor.configM.Unlock()
+	executor.workersCount = workers
+	if executor.workersCtx != nil {
+		executor.resize()
+	}
+	logger.Infow("executor workers have been changed", "workers", workers)
+}
+
+// SetDryRun enables or disables skipping automations instead of executing them
+func (executor *Executor) SetDryRun(dryRun bool) {
+	executor.configM.Lock()
+	defer executor.configM.Unlock()
+	executor.dryRun = dryRun
+	logger.Infow("executor dry run has been changed", "dry-run", dryRun)
+}
+
+func (executor *Executor) isDryRun() bool {
+	executor.configM.Lock()
+	defer executor.configM.Unlock()
+	return executor.dryRun
+}
+
+// resize starts or stops workers to match the workers count, configM must be locked
+func (executor *Executor) resize() {
+	for len(executor.workerCancels) < executor.workersCount {
+		ctx, cancel := context.WithCancel(executor.workersCtx)
+		executor.workerCancels = append(executor.workerCancels, cancel)
+		executor.workers.Add(1)
+		go func() {
+			defer executor.workers.Done()
 			executor.executorWorker(ctx)
-			return nil
-		})
+		}()
 	}
-	return eg.Wait()
+	for len(executor.workerCancels) > executor.workersCount {
+		last := len(executor.workerCancels) - 1
+		executor.workerCancels[last]()
+		executor.workerCancels = executor.workerCancels[:last]
+	}
+}
+
+// QueueLength gets the number of automations waiting for a worker
+func (executor *Executor) QueueLength() int {
+	return len(executor.automationsChan)
+}
+
+// SubmitTimeouts gets the number of automations not queued in time since start
+func (executor *Executor) SubmitTimeouts() int {
+	return int(atomic.LoadInt64(&executor.submitTimeouts))
 }
 
 func (executor *Executor) Stop() error {
@@ -110,6 +194,35 @@ func (executor *Executor) Stop() error {
 	return nil
 }
 
+// Pause stops workers from picking up automations until Resume is called
+// automations already being executed are completed
+func (executor *Executor) Pause() {
+	executor.resumedM.Lock()
+	defer executor.resumedM.Unlock()
+	select {
+	case <-executor.resumed:
+		executor.resumed = make(chan struct{})
+	default:
+	}
+}
+
+// Resume resumes executing automations
+func (executor *Executor) Resume() {
+	executor.resumedM.Lock()
+	defer executor.resumedM.Unlock()
+	select {
+	case <-executor.resumed:
+	default:
+		close(executor.resumed)
+	}
+}
+
+func (executor *Executor) waitResumed() <-chan struct{} {
+	executor.resumedM.Lock()
+	defer executor.resumedM.Unlock()
+	return executor.resumed
+}
+
 func (executor *Executor) handleExecutionError(
 	automation *agent.Automation, err error,
 ) *agent.AutomationFeedback {
@@ -141,10 +254,12 @@ func (executor *Executor) submitAutomation(
 	select {
 	case executor.automationsChan <- automation:
 	case <-time.After(timeout):
-		return fmt.Errorf(
+		err := fmt.Errorf(
 			"timeout (after %s) waiting to push automation into buffer chan",
 			automationsBufferTimeout,
 		)
+		atomic.AddInt64(&executor.submitTimeouts, 1)
+		return err
 	}
 	return nil
 }
@@ -152,6 +267,13 @@ func (executor *Executor) submitAutomation(
 func (executor *Executor) executorWorker(ctx context.Context) {
 	logger.Debug("Executor worker started")
 	for {
+		select {
+		case <-executor.waitResumed():
+		case <-ctx.Done():
+			logger.Debug("Executor worker stopped")
+			return
+		}
+
 		select {
 		case automation := <-executor.automationsChan:
 
@@ -167,6 +289,9 @@ func (executor *Executor) executorWorker(ctx context.Context) {
 
 			delete(executor.inProgressJobs, automation.ID)
 
+			// a worker picking up automations means the buffer is drained again
+			executor.health.Success()
+
 			err = executor.sendAutomationFeedback(&agent.AutomationFeedback{
 				ID:             response.ID,
 				NamespaceName:  response.NamespaceName,
@@ -224,15 +349,16 @@ func (executor *Executor) execute(
 	recommendedResources := buildRecommendedResourcesFromAutomation(originalResources, automation)
 
 	trace, _ := json.Marshal(recommendedResources)
+	dryRun := executor.isDryRun()
 	_logger.Debugw(
 		"executing automation",
-		"dry run", executor.dryRun,
+		"dry run", dryRun,
 		"cpu unit", "milliCore",
 		"memory unit", "mibiByte",
 		"trace", string(trace),
 	)
 
-	if executor.dryRun {
+	if dryRun {
 		response := executor.handleExecutionSkipping(automation, "dry run enabled")
 		return response, nil
 	} else {
@@ -1,6 +1,7 @@
 package gateway
 
 import (
+	"context"
 	"github.com/MagalixCorp/magalix-agent/v2/agent"
 	"github.com/MagalixCorp/magalix-agent/v2/client"
 	"github.com/MagalixCorp/magalix-agent/v2/proto"
@@ -20,12 +21,7 @@ func (g *MagalixGateway) SetAutomationHandler(handler agent.AutomationHandler) {
 		panic("automation handler is nil")
 	}
 	g.submitAutomation = handler
-	g.gwClient.AddListener(proto.PacketKindAutomation, func(in []byte) ([]byte, error) {
-		var automation proto.PacketAutomation
-		if err := proto.DecodeSnappy(in, &automation); err != nil {
-			return nil, err
-		}
-
+	g.commands.Register(proto.PacketKindAutomation, func(ctx context.Context, automation *proto.PacketAutomation) (*proto.PacketAutomationResponse, error) {
 		containerResources := agent.ContainerResources{
 			Requests: &agent.RequestLimit{
 				CPU:    nil,
@@ -55,14 +51,14 @@ func (g *MagalixGateway) SetAutomationHandler(handler agent.AutomationHandler) {
 		})
 		if err != nil {
 			errMessage := err.Error()
-			return proto.EncodeSnappy(proto.PacketAutomationResponse{
+			return &proto.PacketAutomationResponse{
 				ID:    automation.ID,
 				Error: &errMessage,
-			})
+			}, nil
 		}
 
-		return proto.EncodeSnappy(proto.PacketAutomationResponse{})
-	})
+		return &proto.PacketAutomationResponse{}, nil
+	}, CommandOptions{})
 }
 
 func (g *MagalixGateway) SendAutomationFeedback(feedback *agent.AutomationFeedback) error {
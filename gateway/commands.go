@@ -0,0 +1,212 @@
+package gateway
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/MagalixCorp/magalix-agent/v2/client"
+	"github.com/MagalixCorp/magalix-agent/v2/proto"
+	"github.com/MagalixTechnologies/core/logger"
+)
+
+const (
+	defaultCommandTimeout     = time.Minute
+	defaultCommandConcurrency = 10
+)
+
+var (
+	contextType = reflect.TypeOf((*context.Context)(nil)).Elem()
+	errorType   = reflect.TypeOf((*error)(nil)).Elem()
+)
+
+// CommandOptions limits of a command, zero values use defaults
+type CommandOptions struct {
+	// Timeout max time to wait for a free slot and handle a command
+	Timeout time.Duration
+	// Concurrency max number of commands of the kind handled at once
+	Concurrency int
+}
+
+// CommandStats counters of a command kind
+type CommandStats struct {
+	Calls    int
+	Failures int
+	Panics   int
+	Timeouts int
+	// Duration total time spent handling commands
+	Duration    time.Duration
+	MaxDuration time.Duration
+}
+
+type command struct {
+	kind    proto.PacketKind
+	handler reflect.Value
+	request reflect.Type
+	timeout time.Duration
+	slots   chan struct{}
+
+	statsM sync.Mutex
+	stats  CommandStats
+}
+
+// Commands a registry of commands sent by the agent gateway
+// requests are decoded and responses are encoded with the codec negotiated with the agent gateway
+type Commands struct {
+	sync.Mutex
+
+	client   *client.Client
+	commands map[proto.PacketKind]*command
+}
+
+// NewCommands creates a command registry listening on the client
+func NewCommands(client *client.Client) *Commands {
+	return &Commands{
+		client:   client,
+		commands: map[proto.PacketKind]*command{},
+	}
+}
+
+// Register registers a handler for a command kind
+// handler must be a func(context.Context, *Request) (Response, error), a nil response is not encoded
+// the context is canceled when the command times out
+func (c *Commands) Register(kind proto.PacketKind, handler interface{}, options CommandOptions) {
+	value := reflect.ValueOf(handler)
+	handlerType := value.Type()
+	if handlerType.Kind() != reflect.Func ||
+		handlerType.NumIn() != 2 || handlerType.In(0) != contextType || handlerType.In(1).Kind() != reflect.Ptr ||
+		handlerType.NumOut() != 2 || handlerType.Out(1) != errorType {
+		panic(fmt.Sprintf("invalid handler of command %s: %s", kind, handlerType))
+	}
+	if options.Timeout <= 0 {
+		options.Timeout = defaultCommandTimeout
+	}
+	if options.Concurrency <= 0 {
+		options.Concurrency = defaultCommandConcurrency
+	}
+
+	cmd := &command{
+		kind:    kind,
+		handler: value,
+		request: handlerType.In(1).Elem(),
+		timeout: options.Timeout,
+		slots:   make(chan struct{}, options.Concurrency),
+	}
+
+	c.Lock()
+	c.commands[kind] = cmd
+	c.Unlock()
+
+	c.client.AddListener(kind, func(in []byte) ([]byte, error) {
+		return c.handle(cmd, in)
+	})
+}
+
+// Stats gets counters of registered commands by kind
+func (c *Commands) Stats() map[proto.PacketKind]CommandStats {
+	c.Lock()
+	defer c.Unlock()
+	stats := map[proto.PacketKind]CommandStats{}
+	for kind, cmd := range c.commands {
+		cmd.statsM.Lock()
+		stats[kind] = cmd.stats
+		cmd.statsM.Unlock()
+	}
+	return stats
+}
+
+type commandResult struct {
+	response reflect.Value
+	err      error
+	panicked bool
+}
+
+func (c *Commands) handle(cmd *command, in []byte) ([]byte, error) {
+	started := time.Now()
+	ctx, cancel := context.WithTimeout(context.Background(), cmd.timeout)
+	defer cancel()
+
+	request := reflect.New(cmd.request)
+	if err := c.client.Decode(in, request.Interface()); err != nil {
+		cmd.record(started, err, false, false)
+		logger.Errorw("unable to decode command", "kind", cmd.kind, "error", err)
+		return nil, err
+	}
+
+	select {
+	case cmd.slots <- struct{}{}:
+	case <-ctx.Done():
+		err := fmt.Errorf("timeout waiting for a free slot to handle command %s", cmd.kind)
+		cmd.record(started, err, false, true)
+		logger.Errorw("unable to handle command", "kind", cmd.kind, "error", err)
+		return nil, err
+	}
+
+	done := make(chan commandResult, 1)
+	go func() {
+		defer func() { <-cmd.slots }()
+		defer func() {
+			if r := recover(); r != nil {
+				done <- commandResult{err: fmt.Errorf("command %s panicked: %v", cmd.kind, r), panicked: true}
+			}
+		}()
+		out := cmd.handler.Call([]reflect.Value{reflect.ValueOf(ctx), request})
+		err, _ := out[1].Interface().(error)
+		done <- commandResult{response: out[0], err: err}
+	}()
+
+	var result commandResult
+	select {
+	case result = <-done:
+	case <-ctx.Done():
+		err := fmt.Errorf("timeout handling command %s after %s", cmd.kind, cmd.timeout)
+		cmd.record(started, err, false, true)
+		logger.Errorw("unable to handle command", "kind", cmd.kind, "error", err)
+		return nil, err
+	}
+
+	cmd.record(started, result.err, result.panicked, false)
+	if result.err != nil {
+		logger.Errorw("unable to handle command", "kind", cmd.kind, "error", result.err, "duration", time.Since(started))
+		return nil, result.err
+	}
+	logger.Infow("command has been handled", "kind", cmd.kind, "duration", time.Since(started))
+
+	if isNil(result.response) {
+		return nil, nil
+	}
+	return c.client.Encode(result.response.Interface())
+}
+
+func (cmd *command) record(started time.Time, err error, panicked bool, timedOut bool) {
+	duration := time.Since(started)
+	cmd.statsM.Lock()
+	defer cmd.statsM.Unlock()
+	cmd.stats.Calls++
+	cmd.stats.Duration += duration
+	if duration > cmd.stats.MaxDuration {
+		cmd.stats.MaxDuration = duration
+	}
+	if err != nil {
+		cmd.stats.Failures++
+	}
+	if panicked {
+		cmd.stats.Panics++
+	}
+	if timedOut {
+		cmd.stats.Timeouts++
+	}
+}
+
+func isNil(value reflect.Value) bool {
+	if !value.IsValid() {
+		return true
+	}
+	switch value.Kind() {
+	case reflect.Ptr, reflect.Interface, reflect.Map, reflect.Slice:
+		return value.IsNil()
+	}
+	return false
+}
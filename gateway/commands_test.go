@@ -0,0 +1,91 @@
+package gateway
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/MagalixCorp/magalix-agent/v2/client"
+	"github.com/MagalixCorp/magalix-agent/v2/proto"
+)
+
+func TestCommands_Handle(t *testing.T) {
+	tests := []struct {
+		name      string
+		handler   interface{}
+		wantErr   bool
+		wantLevel string
+		wantStats CommandStats
+	}{
+		{
+			name: "response is encoded",
+			handler: func(ctx context.Context, in *proto.PacketLogLevel) (*proto.PacketLogLevel, error) {
+				return &proto.PacketLogLevel{Level: in.Level + "!"}, nil
+			},
+			wantLevel: "debug!",
+			wantStats: CommandStats{Calls: 1},
+		},
+		{
+			name: "error",
+			handler: func(ctx context.Context, in *proto.PacketLogLevel) (interface{}, error) {
+				return nil, errors.New("failed")
+			},
+			wantErr:   true,
+			wantStats: CommandStats{Calls: 1, Failures: 1},
+		},
+		{
+			name: "panic is recovered",
+			handler: func(ctx context.Context, in *proto.PacketLogLevel) (interface{}, error) {
+				panic("boom")
+			},
+			wantErr:   true,
+			wantStats: CommandStats{Calls: 1, Failures: 1, Panics: 1},
+		},
+		{
+			name: "timeout",
+			handler: func(ctx context.Context, in *proto.PacketLogLevel) (interface{}, error) {
+				<-ctx.Done()
+				time.Sleep(10 * time.Millisecond)
+				return nil, nil
+			},
+			wantErr:   true,
+			wantStats: CommandStats{Calls: 1, Failures: 1, Timeouts: 1},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gwClient := client.InitClient(client.Options{
+				GatewayURLs: []string{"ws://localhost"},
+				PipeStore:   client.NewDefaultPipeStore(),
+				Bandwidth:   client.NewBandwidth(0, 0, nil),
+			})
+			commands := NewCommands(gwClient)
+			commands.Register(proto.PacketKindLogLevel, tt.handler, CommandOptions{Timeout: 50 * time.Millisecond})
+
+			in, err := gwClient.Encode(proto.PacketLogLevel{Level: "debug"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			out, err := commands.handle(commands.commands[proto.PacketKindLogLevel], in)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("handle() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantLevel != "" {
+				var response proto.PacketLogLevel
+				if err := gwClient.Decode(out, &response); err != nil {
+					t.Fatal(err)
+				}
+				if response.Level != tt.wantLevel {
+					t.Errorf("response level = %v, want %v", response.Level, tt.wantLevel)
+				}
+			}
+
+			stats := commands.Stats()[proto.PacketKindLogLevel]
+			stats.Duration, stats.MaxDuration = 0, 0
+			if stats != tt.wantStats {
+				t.Errorf("Stats() = %+v, want %+v", stats, tt.wantStats)
+			}
+		})
+	}
+}
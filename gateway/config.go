@@ -0,0 +1,44 @@
+package gateway
+
+import (
+	"context"
+	"time"
+
+	"github.com/MagalixCorp/magalix-agent/v2/agent"
+	"github.com/MagalixCorp/magalix-agent/v2/proto"
+)
+
+func (g *MagalixGateway) SetConfigHandler(handler agent.ConfigHandler) {
+	if handler == nil {
+		panic("config handler is nil")
+	}
+	g.applyConfig = handler
+	g.commands.Register(proto.PacketKindConfig, func(ctx context.Context, config *proto.PacketConfig) (*proto.PacketConfigResponse, error) {
+		update := &agent.ConfigUpdate{
+			Version:  config.Version,
+			DryRun:   config.DryRun,
+			LogLevel: config.LogLevel,
+		}
+		if config.MetricsInterval != nil {
+			interval := time.Duration(*config.MetricsInterval) * time.Second
+			update.MetricsInterval = &interval
+		}
+		if config.ExecutorWorkers != nil {
+			workers := int(*config.ExecutorWorkers)
+			update.ExecutorWorkers = &workers
+		}
+
+		result, err := g.applyConfig(update)
+		if err != nil {
+			return nil, err
+		}
+		return &proto.PacketConfigResponse{
+			Version:         result.Version,
+			MetricsInterval: int64(result.MetricsInterval / time.Second),
+			DryRun:          result.DryRun,
+			ExecutorWorkers: int32(result.ExecutorWorkers),
+			LogLevel:        result.LogLevel,
+			Errors:          result.Errors,
+		}, nil
+	}, CommandOptions{Concurrency: 1})
+}
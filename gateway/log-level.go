@@ -1,9 +1,10 @@
 package gateway
 
 import (
+	"context"
+
 	"github.com/MagalixCorp/magalix-agent/v2/agent"
 	"github.com/MagalixCorp/magalix-agent/v2/proto"
-	"github.com/MagalixTechnologies/core/logger"
 )
 
 func (g *MagalixGateway) SetChangeLogLevelHandler(handler agent.ChangeLogLevelHandler) {
@@ -11,17 +12,9 @@ func (g *MagalixGateway) SetChangeLogLevelHandler(handler agent.ChangeLogLevelHa
 		panic("change log level handler is nil")
 	}
 	g.changeLogLevel = handler
-	g.gwClient.AddListener(proto.PacketKindLogLevel, func(in []byte) ([]byte, error) {
-		var logLevel proto.PacketLogLevel
-		if err := proto.DecodeSnappy(in, &logLevel); err != nil {
-			logger.Error("Failed to decode log level packet")
-			return nil, err
-		}
-
-		err := g.changeLogLevel(&agent.LogLevel{
-			Level:logLevel.Level,
+	g.commands.Register(proto.PacketKindLogLevel, func(ctx context.Context, logLevel *proto.PacketLogLevel) (interface{}, error) {
+		return nil, g.changeLogLevel(&agent.LogLevel{
+			Level: logLevel.Level,
 		})
-
-		return nil, err
-	})
+	}, CommandOptions{Concurrency: 1})
 }
@@ -2,8 +2,11 @@ package gateway
 
 import (
 	"context"
+	"fmt"
 	"github.com/MagalixCorp/magalix-agent/v2/agent"
 	"github.com/MagalixCorp/magalix-agent/v2/client"
+	"github.com/MagalixCorp/magalix-agent/v2/health"
+	"github.com/MagalixCorp/magalix-agent/v2/proto"
 	"github.com/MagalixTechnologies/core/logger"
 	"github.com/MagalixTechnologies/uuid-go"
 	"go.uber.org/zap/zapcore"
@@ -11,11 +14,11 @@ import (
 )
 
 type MagalixGateway struct {
-	MgxAgentGatewayUrl string
+	MgxAgentGatewayUrls []string
 
-	AccountID    uuid.UUID
-	ClusterID    uuid.UUID
-	ClientSecret []byte
+	AccountID     uuid.UUID
+	ClusterID     uuid.UUID
+	Authenticator client.Authenticator
 
 	AgentVersion string
 	AgentID      string
@@ -32,63 +35,39 @@ type MagalixGateway struct {
 	ShouldSendLogs bool
 
 	gwClient         *client.Client
-	connectedChan    chan bool
+	commands         *Commands
 	cancelWorkers    context.CancelFunc
 	submitAutomation agent.AutomationHandler
 	triggerRestart   agent.RestartHandler
 	changeLogLevel   agent.ChangeLogLevelHandler
+	applyConfig      agent.ConfigHandler
+	readiness        agent.ReadinessHandler
+	health           *health.Component
 }
 
-func New(
-	gatewayUrl string,
-	accountID uuid.UUID,
-	clusterID uuid.UUID,
-	secret []byte,
-	agentVersion string,
-	agentID string,
-	k8sServerVersion string,
-	agentPermissions string,
-	protoHandshake time.Duration,
-	protoWriteTime time.Duration,
-	protoReadTime time.Duration,
-	protoReconnectTime time.Duration,
-	protoBackoff time.Duration,
-	sendLogs bool,
-) *MagalixGateway {
-	connected := make(chan bool)
-	return &MagalixGateway{
-		MgxAgentGatewayUrl: gatewayUrl,
-		AccountID:          accountID,
-		ClusterID:          clusterID,
-		ClientSecret:       secret,
-		AgentVersion:       agentVersion,
-		AgentID:            agentID,
-		K8sServerVersion:   k8sServerVersion,
-		AgentPermissions:   agentPermissions,
-		ProtoHandshake:     protoHandshake,
-		ProtoWriteTime:     protoWriteTime,
-		ProtoReadTime:      protoReadTime,
-		ProtoReconnectTime: protoReconnectTime,
-		ProtoBackoff:       protoBackoff,
-		ShouldSendLogs:     sendLogs,
-		connectedChan:      connected,
-		gwClient: client.InitClient(
-			agentVersion,
-			agentID,
-			accountID,
-			clusterID,
-			secret,
-			k8sServerVersion,
-			agentPermissions,
-			gatewayUrl,
-			protoHandshake,
-			protoWriteTime,
-			protoReadTime,
-			protoReconnectTime,
-			protoBackoff,
-			sendLogs,
-		),
+// Options options of the agent gateway client
+type Options = client.Options
+
+func New(options Options) *MagalixGateway {
+	g := &MagalixGateway{
+		MgxAgentGatewayUrls: options.GatewayURLs,
+		AccountID:           options.AccountID,
+		ClusterID:           options.ClusterID,
+		Authenticator:       options.Authenticator,
+		AgentVersion:        options.Version,
+		AgentID:             options.StartID,
+		K8sServerVersion:    options.ServerVersion,
+		AgentPermissions:    options.AgentPermissions,
+		ProtoHandshake:      options.ProtoHandshake,
+		ProtoWriteTime:      options.ProtoWrite,
+		ProtoReadTime:       options.ProtoRead,
+		ProtoReconnectTime:  options.ProtoReconnect,
+		ProtoBackoff:        options.ProtoBackoff,
+		ShouldSendLogs:      options.SendLogs,
+		gwClient:            client.InitClient(options),
 	}
+	g.commands = NewCommands(g.gwClient)
+	return g
 }
 
 func (g *MagalixGateway) Start(ctx context.Context) error {
@@ -100,7 +79,66 @@ func (g *MagalixGateway) Start(ctx context.Context) error {
 	g.cancelWorkers = cancel
 	defer g.gwClient.Recover()
 
-	return g.gwClient.Connect(cancelCtx, g.connectedChan)
+	// subscribed before connecting so no transition is missed
+	transitions, unsubscribe := g.gwClient.Subscribe()
+	go g.watchState(cancelCtx, transitions, unsubscribe)
+	return g.gwClient.Connect(cancelCtx)
+}
+
+func (g *MagalixGateway) SetReadinessHandler(handler agent.ReadinessHandler) {
+	if handler == nil {
+		panic("readiness handler is nil")
+	}
+	g.readiness = handler
+}
+
+// SetHealth sets the component the connection health is reported to
+func (g *MagalixGateway) SetHealth(component *health.Component) {
+	g.health = component
+}
+
+// watchState calls the readiness handler and reports health when the connection becomes ready or stops being ready
+// the subscription starts with the current state, so health is reported even if no transition follows, e.g. in spool mode
+func (g *MagalixGateway) watchState(ctx context.Context, transitions <-chan client.StateTransition, unsubscribe func()) {
+	defer unsubscribe()
+	// ready is tracked here rather than taken from transitions, as a subscriber may miss some of them
+	ready := false
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case transition := <-transitions:
+			if transition.To == client.StateReady {
+				g.health.Success()
+			} else {
+				g.health.Failure(fmt.Errorf("connection is %s", transition.To))
+			}
+			if (transition.To == client.StateReady) == ready {
+				continue
+			}
+			ready = !ready
+			if g.readiness != nil {
+				g.readiness(ready)
+			}
+		}
+	}
+}
+
+// Sync sends packets buffered in the client until the context is done
+// packets other than logs piped meanwhile are rejected, returns an error if any of them is dropped
+func (g *MagalixGateway) Sync(ctx context.Context) error {
+	report := g.gwClient.Drain(ctx)
+	logger.Infow(
+		"gateway has been drained",
+		"sent", report.Sent,
+		"rejected", report.Rejected,
+		"remaining", report.Remaining,
+		"persisted", report.Persisted,
+	)
+	if dropped := report.Dropped(); dropped > 0 {
+		return fmt.Errorf("%d packets were dropped while draining", dropped)
+	}
+	return nil
 }
 
 func (g *MagalixGateway) Stop() error {
@@ -110,14 +148,41 @@ func (g *MagalixGateway) Stop() error {
 
 func (g *MagalixGateway) WaitAuthorization() {
 	logger.Info("waiting for connection and authorization")
-	if g.gwClient.IsReady() {
-		return
-	}
 	// Intentionally used without a timeout so it blocks indefinitely when not authorized
-	<-g.connectedChan
+	g.gwClient.WaitForConnection(0)
 	logger.Info("Connected and authorized")
 }
 
+// PipeStats gets usage of the pipe and packets evicted to stay within its budget
+func (g *MagalixGateway) PipeStats() client.PipeStats {
+	return g.gwClient.PipeStats()
+}
+
+// SendLatencies gets round trip times of packets sent to the agent gateway by kind
+func (g *MagalixGateway) SendLatencies() map[proto.PacketKind]client.SendLatency {
+	return g.gwClient.SendLatencies()
+}
+
+// Throughput gets the outbound throughput to the agent gateway
+func (g *MagalixGateway) Throughput() client.Throughput {
+	return g.gwClient.Throughput()
+}
+
+// CommandStats gets counters of commands handled by kind
+func (g *MagalixGateway) CommandStats() map[proto.PacketKind]CommandStats {
+	return g.commands.Stats()
+}
+
+// State returns the connection state and the time it was entered
+func (g *MagalixGateway) State() (client.State, time.Time) {
+	return g.gwClient.State()
+}
+
+// EndpointsHealth returns health of the configured agent gateway endpoints
+func (g *MagalixGateway) EndpointsHealth() []client.EndpointHealth {
+	return g.gwClient.EndpointsHealth()
+}
+
 func (g *MagalixGateway) GetLogsWriteSyncer() zapcore.WriteSyncer {
 	return g.gwClient
 }
@@ -5,24 +5,12 @@ import (
 	"github.com/MagalixCorp/magalix-agent/v2/client"
 	"github.com/MagalixCorp/magalix-agent/v2/proto"
 	"github.com/MagalixCorp/magalix-agent/v2/utils"
-	"math"
 	"time"
 )
 
-const metricsBatchMaxSize = 1000
-
 func (g *MagalixGateway) SendMetrics(metrics []*agent.Metric) error {
-	noOfBatches := int(math.Ceil(float64(len(metrics))/float64(metricsBatchMaxSize)))
-	lastBatchSize := len(metrics) % metricsBatchMaxSize
-	for i := 0; i < noOfBatches; i++ {
-		start := i * metricsBatchMaxSize
-		var end int
-		if i == noOfBatches- 1 && lastBatchSize > 0 {
-			end = start + lastBatchSize
-		} else {
-			end = start + metricsBatchMaxSize
-		}
-		g.sendMetricsBatch(g.gwClient, metrics[start:end])
+	for _, batch := range agent.MetricsBatches(metrics, agent.MetricsBatchMaxSize) {
+		g.sendMetricsBatch(g.gwClient, batch)
 	}
 	return nil
 }
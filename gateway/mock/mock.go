@@ -0,0 +1,522 @@
+// Package mock is a local agent gateway speaking the websocket channel protocol
+// it answers hello and authorization, records received packets and sends scripted commands to the agent
+package mock
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/MagalixCorp/magalix-agent/v2/client"
+	"github.com/MagalixCorp/magalix-agent/v2/proto"
+	"github.com/MagalixTechnologies/channel"
+	"github.com/MagalixTechnologies/core/logger"
+	"github.com/MagalixTechnologies/uuid-go"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// questionSize the agent refuses authorization questions shorter than 1024 bytes
+	questionSize = 1024
+
+	channelTimeout = 30 * time.Second
+)
+
+// inboundKinds packet kinds sent by the agent
+var inboundKinds = []proto.PacketKind{
+	proto.PacketKindHello,
+	proto.PacketKindAuthorizationRequest,
+	proto.PacketKindAuthorizationAnswer,
+	proto.PacketKindPing,
+	proto.PacketKindBye,
+	proto.PacketKindLogs,
+	proto.PacketKindMetricsStoreV2Request,
+	proto.PacketKindEntitiesDeltasRequest,
+	proto.PacketKindEntitiesResyncRequest,
+	proto.PacketKindAutomationFeedback,
+	proto.PacketKindRawStoreRequest,
+	proto.PacketKindChunk,
+}
+
+// handshakeKinds packet kinds never wrapped in an envelope
+var handshakeKinds = map[proto.PacketKind]bool{
+	proto.PacketKindHello:                true,
+	proto.PacketKindAuthorizationRequest: true,
+	proto.PacketKindAuthorizationAnswer:  true,
+	proto.PacketKindPing:                 true,
+}
+
+// outboundKinds packet kinds sent to the agent
+var outboundKinds = []proto.PacketKind{
+	proto.PacketKindAutomation,
+	proto.PacketKindRestart,
+	proto.PacketKindLogLevel,
+	proto.PacketKindConfig,
+	proto.PacketKindChunk,
+}
+
+// Packet a packet received from the agent
+type Packet struct {
+	Time time.Time
+	Kind proto.PacketKind
+	// ID idempotency id of an enveloped packet
+	ID string
+	// Data the packet encoded with its format, decompressed
+	Data   []byte
+	Format string
+}
+
+// Decode decodes the packet
+func (p Packet) Decode(out interface{}) error {
+	format, ok := proto.GetFormat(p.Format)
+	if !ok {
+		return fmt.Errorf("unsupported format %s", p.Format)
+	}
+	return format.Unmarshal(p.Data, out)
+}
+
+// session a connected agent
+type session struct {
+	hello      proto.PacketHello
+	codec      proto.Codec
+	format     proto.Format
+	enveloped  bool
+	question   []byte
+	authorized bool
+	acked      map[string]bool
+}
+
+// Gateway a mock agent gateway
+type Gateway struct {
+	sync.Mutex
+	// changed is closed and replaced whenever a packet is recorded or an agent is authorized
+	changed chan struct{}
+
+	secret []byte
+	codec  string
+	format string
+
+	server   *channel.Server
+	listener net.Listener
+	http     *http.Server
+
+	sessions    map[uuid.UUID]*session
+	authorized  []uuid.UUID
+	received    []Packet
+	reassembler *client.Reassembler
+}
+
+// New creates a mock gateway negotiating the codec and format when the agent supports them
+// authorization answers are verified with secret, any answer is accepted if it is empty
+func New(secret []byte, codec string, format string) *Gateway {
+	return &Gateway{
+		changed:     make(chan struct{}),
+		secret:      secret,
+		codec:       codec,
+		format:      format,
+		sessions:    map[uuid.UUID]*session{},
+		reassembler: client.NewReassembler(time.Minute),
+	}
+}
+
+// Start starts listening on the address, e.g. 127.0.0.1:0 picks a free port
+func (g *Gateway) Start(address string) error {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return fmt.Errorf("unable to listen on %s, error: %w", address, err)
+	}
+	g.listener = listener
+
+	// the channel server registers a handler on the default mux, a unique path keeps it unused,
+	// connections are served by the mock own http server
+	g.server = channel.NewServer(address, "/mock-gateway/"+uuid.NewV4().String(), channel.ChannelOptions{
+		ProtoHandshake: channelTimeout,
+		ProtoWrite:     channelTimeout,
+		ProtoRead:      channelTimeout,
+		ProtoReconnect: time.Second,
+	})
+	onDisconnect := g.disconnected
+	g.server.SetHooks(nil, &onDisconnect)
+	for _, kind := range inboundKinds {
+		kind := kind
+		err := g.server.AddListener(kind.String(), func(_ context.Context, peer uuid.UUID, in []byte) ([]byte, error) {
+			return g.handle(peer, kind, in)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	go g.server.Channel.Init()
+
+	upgrader := websocket.Upgrader{}
+	g.http = &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			conn, err := upgrader.Upgrade(w, r, nil)
+			if err != nil {
+				logger.Warnw("unable to upgrade mock gateway connection", "error", err)
+				return
+			}
+			defer conn.Close()
+			peer := g.server.Channel.NewPeer(conn, r.RequestURI)
+			logger.Infow("agent connected to mock gateway", "peer", peer.ID, "address", r.RemoteAddr)
+			g.server.Channel.HandlePeer(peer)
+		}),
+	}
+	go func() {
+		if err := g.http.Serve(listener); err != nil && err != http.ErrServerClosed {
+			logger.Errorw("mock gateway stopped serving", "error", err)
+		}
+	}()
+	return nil
+}
+
+// URL the address agents connect to
+func (g *Gateway) URL() string {
+	return "ws://" + g.listener.Addr().String() + "/"
+}
+
+// Close stops listening and closes connections
+func (g *Gateway) Close() error {
+	if g.http == nil {
+		return nil
+	}
+	return g.http.Close()
+}
+
+// Received gets packets received from agents, all kinds if kind is empty
+func (g *Gateway) Received(kind proto.PacketKind) []Packet {
+	g.Lock()
+	defer g.Unlock()
+	packets := []Packet{}
+	for _, packet := range g.received {
+		if kind == "" || packet.Kind == kind {
+			packets = append(packets, packet)
+		}
+	}
+	return packets
+}
+
+// WaitReceived waits until count packets of the kind are received, returns false on timeout
+func (g *Gateway) WaitReceived(kind proto.PacketKind, count int, timeout time.Duration) ([]Packet, bool) {
+	var packets []Packet
+	ok := g.wait(timeout, func() bool {
+		packets = g.Received(kind)
+		return len(packets) >= count
+	})
+	return packets, ok
+}
+
+// WaitAuthorized waits until an agent is authorized, returns false on timeout
+func (g *Gateway) WaitAuthorized(timeout time.Duration) bool {
+	return g.wait(timeout, func() bool {
+		g.Lock()
+		defer g.Unlock()
+		return len(g.authorized) > 0
+	})
+}
+
+func (g *Gateway) wait(timeout time.Duration, done func() bool) bool {
+	deadline := time.After(timeout)
+	for {
+		g.Lock()
+		changed := g.changed
+		g.Unlock()
+		if done() {
+			return true
+		}
+		select {
+		case <-changed:
+		case <-deadline:
+			return false
+		}
+	}
+}
+
+// notify wakes up waiters, must be called with the lock held
+func (g *Gateway) notify() {
+	close(g.changed)
+	g.changed = make(chan struct{})
+}
+
+// Send sends a packet to the last authorized agent and decodes the response into out if not nil
+func (g *Gateway) Send(kind proto.PacketKind, in interface{}, out interface{}) error {
+	g.Lock()
+	if len(g.authorized) == 0 {
+		g.Unlock()
+		return errors.New("no agent is authorized")
+	}
+	peer := g.authorized[len(g.authorized)-1]
+	s := g.sessions[peer]
+	g.Unlock()
+
+	req, err := proto.EncodePacket(s.format, s.codec, kind, in)
+	if err != nil {
+		return err
+	}
+	res, err := g.server.Send(peer, kind.String(), req)
+	if err != nil {
+		return err
+	}
+	if out == nil || len(res) == 0 {
+		return nil
+	}
+	return proto.DecodePacket(s.format, s.codec, res, out)
+}
+
+// SendAutomation sends an automation to the agent
+func (g *Gateway) SendAutomation(automation proto.PacketAutomation) (proto.PacketAutomationResponse, error) {
+	var response proto.PacketAutomationResponse
+	err := g.Send(proto.PacketKindAutomation, automation, &response)
+	return response, err
+}
+
+// SendRestart asks the agent to restart
+func (g *Gateway) SendRestart(status int) error {
+	return g.Send(proto.PacketKindRestart, proto.PacketRestart{Status: status}, nil)
+}
+
+// SendLogLevel changes the log level of the agent
+func (g *Gateway) SendLogLevel(level string) error {
+	return g.Send(proto.PacketKindLogLevel, proto.PacketLogLevel{Level: level}, nil)
+}
+
+// SendConfig pushes a runtime config to the agent, the response has the effective config or validation errors
+func (g *Gateway) SendConfig(config proto.PacketConfig) (proto.PacketConfigResponse, error) {
+	var response proto.PacketConfigResponse
+	err := g.Send(proto.PacketKindConfig, config, &response)
+	return response, err
+}
+
+func (g *Gateway) disconnected(peer uuid.UUID) {
+	g.Lock()
+	defer g.Unlock()
+	delete(g.sessions, peer)
+	for i, id := range g.authorized {
+		if id == peer {
+			g.authorized = append(g.authorized[:i], g.authorized[i+1:]...)
+			break
+		}
+	}
+	logger.Infow("agent disconnected from mock gateway", "peer", peer)
+}
+
+// capabilities advertised in hello
+func (g *Gateway) capabilities() proto.Capabilities {
+	capabilities := proto.Capabilities{
+		proto.CapabilityPacketsV2,
+		proto.CapabilityEnvelope,
+		proto.CodecCapability(g.codec),
+		proto.FormatCapability(g.format),
+	}
+	for _, kind := range append(inboundKinds, outboundKinds...) {
+		capabilities = append(capabilities, proto.KindCapability(kind))
+	}
+	return capabilities
+}
+
+func (g *Gateway) handle(peer uuid.UUID, kind proto.PacketKind, in []byte) ([]byte, error) {
+	if kind == proto.PacketKindHello {
+		return g.handleHello(peer, in)
+	}
+
+	g.Lock()
+	s, ok := g.sessions[peer]
+	g.Unlock()
+	if !ok {
+		return nil, channel.ApplyReason(channel.BadRequest, "hello is expected first", nil)
+	}
+	payload, err := s.codec.Decompress(in)
+	if err != nil {
+		return nil, channel.ApplyReason(channel.BadRequest, "unable to decompress packet", err)
+	}
+
+	switch kind {
+	case proto.PacketKindAuthorizationRequest:
+		return g.handleAuthorizationRequest(s)
+	case proto.PacketKindAuthorizationAnswer:
+		return g.handleAuthorizationAnswer(peer, s, payload)
+	}
+	if !s.authorized {
+		return nil, channel.ApplyReason(channel.BadRequest, "agent is not authorized", nil)
+	}
+	if kind == proto.PacketKindPing {
+		var ping proto.PacketPing
+		if err := s.format.Unmarshal(payload, &ping); err != nil {
+			return nil, channel.ApplyReason(channel.BadRequest, "unable to decode ping", err)
+		}
+		return proto.EncodePacket(s.format, s.codec, kind, proto.PacketPong{Number: ping.Number, Started: time.Now().UTC()})
+	}
+
+	id := ""
+	if s.enveloped && !handshakeKinds[kind] {
+		id, payload, err = unwrap(s.format, payload)
+		if err != nil {
+			return nil, channel.ApplyReason(channel.BadRequest, "unable to decode envelope", err)
+		}
+	}
+
+	g.Lock()
+	duplicate := id != "" && s.acked[id]
+	if id != "" {
+		s.acked[id] = true
+	}
+	g.Unlock()
+	if !duplicate {
+		if err := g.record(kind, id, payload, s.format); err != nil {
+			return nil, channel.ApplyReason(channel.BadRequest, "unable to handle packet", err)
+		}
+	}
+
+	if id != "" {
+		return proto.EncodePacket(s.format, s.codec, kind, proto.PacketEnvelopeAck{ID: id})
+	}
+	if response, ok := proto.NewResponse(kind); ok {
+		return proto.EncodePacket(s.format, s.codec, kind, response)
+	}
+	return nil, nil
+}
+
+func (g *Gateway) handleHello(peer uuid.UUID, in []byte) ([]byte, error) {
+	var hello proto.PacketHello
+	if err := proto.DecodeGOB(in, &hello); err != nil {
+		return nil, channel.ApplyReason(channel.BadRequest, "unable to decode hello", err)
+	}
+
+	s := &session{
+		hello:     hello,
+		enveloped: hello.Capabilities.Has(proto.CapabilityEnvelope),
+		acked:     map[string]bool{},
+	}
+	// the agent picks the only codec and format advertised if it supports them
+	s.codec, _ = proto.GetCodec(proto.CodecSnappy)
+	if codec, ok := proto.GetCodec(g.codec); ok && hello.Capabilities.Has(proto.CodecCapability(g.codec)) {
+		s.codec = codec
+	}
+	s.format, _ = proto.GetFormat(proto.FormatJSON)
+	if format, ok := proto.GetFormat(g.format); ok && hello.Capabilities.Has(proto.FormatCapability(g.format)) {
+		s.format = format
+	}
+
+	g.Lock()
+	g.sessions[peer] = s
+	g.Unlock()
+
+	logger.Infow(
+		"mock gateway received hello",
+		"peer", peer,
+		"build", hello.Build,
+		"account_id", hello.AccountID,
+		"cluster_id", hello.ClusterID,
+		"codec", s.codec.Name(),
+		"format", s.format.Name(),
+	)
+	return proto.EncodeGOB(proto.PacketHello{
+		Major:        client.ProtocolMajorVersion,
+		Minor:        client.ProtocolMinorVersion,
+		Build:        "mock",
+		Capabilities: g.capabilities(),
+	})
+}
+
+func (g *Gateway) handleAuthorizationRequest(s *session) ([]byte, error) {
+	question := make([]byte, questionSize)
+	if _, err := rand.Read(question); err != nil {
+		return nil, err
+	}
+	g.Lock()
+	s.question = question
+	g.Unlock()
+	return proto.EncodePacket(
+		s.format, s.codec, proto.PacketKindAuthorizationRequest,
+		proto.PacketAuthorizationQuestion{Token: question},
+	)
+}
+
+func (g *Gateway) handleAuthorizationAnswer(peer uuid.UUID, s *session, payload []byte) ([]byte, error) {
+	var answer proto.PacketAuthorizationAnswer
+	if err := s.format.Unmarshal(payload, &answer); err != nil {
+		return nil, channel.ApplyReason(channel.BadRequest, "unable to decode authorization answer", err)
+	}
+
+	g.Lock()
+	question := s.question
+	g.Unlock()
+	if len(g.secret) > 0 {
+		expected, err := client.SecretAnswer(question, g.secret)
+		if err != nil {
+			return nil, err
+		}
+		if string(expected) != string(answer.Token) {
+			logger.Warnw("mock gateway rejected authorization answer", "peer", peer)
+			return nil, channel.ApplyReason(channel.BadRequest, "invalid authorization answer", nil)
+		}
+	}
+
+	g.Lock()
+	s.authorized = true
+	g.authorized = append(g.authorized, peer)
+	g.notify()
+	g.Unlock()
+
+	logger.Infow("agent is authorized by mock gateway", "peer", peer)
+	return proto.EncodePacket(
+		s.format, s.codec, proto.PacketKindAuthorizationAnswer,
+		proto.PacketAuthorizationSuccess{},
+	)
+}
+
+// record records a packet, chunks are recorded once reassembled as a packet of their kind
+func (g *Gateway) record(kind proto.PacketKind, id string, payload []byte, format proto.Format) error {
+	packet := Packet{
+		Time:   time.Now().UTC(),
+		Kind:   kind,
+		ID:     id,
+		Data:   payload,
+		Format: format.Name(),
+	}
+	if kind == proto.PacketKindChunk {
+		var chunk proto.PacketChunk
+		if err := format.Unmarshal(payload, &chunk); err != nil {
+			return err
+		}
+		data, complete, err := g.reassembler.Add(&chunk)
+		if err != nil || !complete {
+			return err
+		}
+		packet.Kind, packet.ID, packet.Data, packet.Format = chunk.Kind, "", data, chunk.Format
+		if packet.Format == "" {
+			packet.Format = proto.FormatJSON
+		}
+	}
+
+	logger.Infow("mock gateway received packet", "kind", packet.Kind, "id", packet.ID, "size", len(packet.Data))
+	g.Lock()
+	g.received = append(g.received, packet)
+	g.notify()
+	g.Unlock()
+	return nil
+}
+
+// unwrap decodes an envelope, returns its id and the wrapped packet encoded with the format
+func unwrap(format proto.Format, payload []byte) (string, []byte, error) {
+	if format.Name() == proto.FormatJSON {
+		var envelope struct {
+			ID   string          `json:"id"`
+			Data json.RawMessage `json:"data"`
+		}
+		err := json.Unmarshal(payload, &envelope)
+		return envelope.ID, envelope.Data, err
+	}
+	var envelope proto.PacketEnvelope
+	if err := format.Unmarshal(payload, &envelope); err != nil {
+		return "", nil, err
+	}
+	data, _ := envelope.Data.([]byte)
+	return envelope.ID, data, nil
+}
@@ -0,0 +1,94 @@
+package mock
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/MagalixCorp/magalix-agent/v2/client"
+	"github.com/MagalixCorp/magalix-agent/v2/proto"
+	"github.com/MagalixTechnologies/uuid-go"
+)
+
+func TestGateway(t *testing.T) {
+	tests := []struct {
+		name   string
+		codec  string
+		format string
+	}{
+		{name: "json", codec: proto.CodecSnappy, format: proto.FormatJSON},
+		{name: "protobuf", codec: proto.CodecZstd, format: proto.FormatProtobuf},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			secret := []byte("secret")
+			gateway := New(secret, tt.codec, tt.format)
+			if err := gateway.Start("127.0.0.1:0"); err != nil {
+				t.Fatal(err)
+			}
+			defer gateway.Close()
+
+			gwClient := client.InitClient(client.Options{
+				GatewayURLs:    []string{gateway.URL()},
+				AllowPlaintext: true,
+				Version:        "test",
+				AccountID:      uuid.NewV4(),
+				ClusterID:      uuid.NewV4(),
+				Authenticator:  client.NewSecretAuthenticator(secret),
+				ProtoHandshake: 5 * time.Second,
+				ProtoWrite:     5 * time.Second,
+				ProtoRead:      5 * time.Second,
+				ProtoReconnect: 100 * time.Millisecond,
+				ProtoBackoff:   100 * time.Millisecond,
+				PipeStore:      client.NewDefaultPipeStore(),
+				Codecs:         []string{tt.codec},
+				Formats:        []string{tt.format},
+				Bandwidth:      client.NewBandwidth(0, 0, nil),
+			})
+			levels := make(chan string, 1)
+			gwClient.AddListener(proto.PacketKindLogLevel, func(in []byte) ([]byte, error) {
+				var packet proto.PacketLogLevel
+				if err := gwClient.Decode(in, &packet); err != nil {
+					return nil, err
+				}
+				levels <- packet.Level
+				return nil, nil
+			})
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			go gwClient.Connect(ctx)
+
+			if !gateway.WaitAuthorized(10 * time.Second) {
+				t.Fatal("agent is not authorized")
+			}
+
+			gwClient.Pipe(client.Package{
+				Kind: proto.PacketKindLogs,
+				Data: proto.PacketLogs{{Date: time.Now().UTC(), Data: "hello"}},
+			})
+			packets, ok := gateway.WaitReceived(proto.PacketKindLogs, 1, 10*time.Second)
+			if !ok {
+				t.Fatal("logs are not received")
+			}
+			var logs proto.PacketLogs
+			if err := packets[0].Decode(&logs); err != nil {
+				t.Fatal(err)
+			}
+			if len(logs) != 1 || logs[0].Data != "hello" {
+				t.Fatalf("received logs = %+v", logs)
+			}
+
+			if err := gateway.SendLogLevel("debug"); err != nil {
+				t.Fatal(err)
+			}
+			select {
+			case level := <-levels:
+				if level != "debug" {
+					t.Fatalf("log level = %s, want debug", level)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("log level is not received")
+			}
+		})
+	}
+}
@@ -0,0 +1,70 @@
+package gateway
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/MagalixCorp/magalix-agent/v2/client"
+	"github.com/MagalixTechnologies/core/logger"
+)
+
+const replayPacketRetries = 10
+
+// Replay uploads packets written by spool mode to the agent gateway
+// files are replayed oldest first and packets in the order they were written
+// replayed files are renamed so they are skipped on the next run, the progress within a file is
+// recorded after every packet so an interrupted replay resumes where it stopped
+func (g *MagalixGateway) Replay(ctx context.Context, spoolDir string) error {
+	files, err := client.ListSpoolFiles(spoolDir)
+	if err != nil {
+		return err
+	}
+	if len(files) == 0 {
+		logger.Infow("nothing to replay", "dir", spoolDir)
+		return nil
+	}
+
+	go func() {
+		if err := g.Start(ctx); err != nil {
+			logger.Errorw("gateway client stopped", "error", err)
+		}
+	}()
+	g.WaitAuthorization()
+
+	for _, file := range files {
+		// records replayed by an interrupted run are skipped, so the gateway doesn't get them twice
+		offset, err := client.SpoolFileOffset(file)
+		if err != nil {
+			return err
+		}
+		index, packets := 0, 0
+		err = client.ReadSpoolFile(file, func(record *client.SpoolRecord) error {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			index++
+			if index <= offset {
+				return nil
+			}
+			err := g.gwClient.WithBackoffLimit(func() error {
+				_, err := g.gwClient.SendRaw(record.Kind, record.Codec, record.Payload)
+				return err
+			}, replayPacketRetries)
+			if err != nil {
+				return err
+			}
+			packets++
+			return client.SetSpoolFileOffset(file, index)
+		})
+		if err != nil {
+			return fmt.Errorf("unable to replay spool file %s, error: %w", file, err)
+		}
+
+		if err := client.MarkSpoolFileReplayed(file); err != nil {
+			return fmt.Errorf("unable to mark spool file %s as replayed, error: %w", file, err)
+		}
+		logger.Infow("spool file has been replayed", "file", file, "packets", packets, "skipped", offset)
+	}
+
+	return nil
+}
@@ -1,6 +1,8 @@
 package gateway
 
 import (
+	"context"
+
 	"github.com/MagalixCorp/magalix-agent/v2/agent"
 	"github.com/MagalixCorp/magalix-agent/v2/proto"
 )
@@ -10,14 +12,7 @@ func (g *MagalixGateway) SetRestartHandler(handler agent.RestartHandler) {
 		panic("restart handler is nil")
 	}
 	g.triggerRestart = handler
-	g.gwClient.AddListener(proto.PacketKindRestart, func(in []byte) ([]byte, error) {
-		var restart proto.PacketRestart
-		if err := proto.DecodeSnappy(in, &restart); err != nil {
-			return nil, err
-		}
-
-		err := g.triggerRestart()
-
-		return nil, err
-	})
+	g.commands.Register(proto.PacketKindRestart, func(ctx context.Context, restart *proto.PacketRestart) (interface{}, error) {
+		return nil, g.triggerRestart()
+	}, CommandOptions{Concurrency: 1})
 }
\ No newline at end of file
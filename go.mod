@@ -10,6 +10,8 @@ require (
 	github.com/docopt/docopt-go v0.0.0-20180111231733-ee0de3bc6815
 	github.com/evanphx/json-patch v4.2.0+incompatible // indirect
 	github.com/golang/snappy v0.0.1
+	github.com/gorilla/websocket v1.4.1
+	github.com/klauspost/compress v1.11.13
 	github.com/pkg/errors v0.8.1
 	github.com/reconquest/health-go v0.0.0-20181113092653-ea90ecace101
 	github.com/reconquest/sign-go v0.0.0-20181113092801-8d4f8c5854ae
@@ -20,7 +22,8 @@ require (
 	golang.org/x/net v0.0.0-20191209160850-c0dbc17a3553
 	golang.org/x/oauth2 v0.0.0-20191202225959-858c2ad4c8b6 // indirect
 	golang.org/x/sync v0.0.0-20190911185100-cd5d95a43a6e
-	golang.org/x/time v0.0.0-20191024005414-555d28b269f0 // indirect
+	golang.org/x/time v0.0.0-20191024005414-555d28b269f0
+	google.golang.org/protobuf v1.28.1
 	k8s.io/api v0.18.8
 	k8s.io/apimachinery v0.18.8
 	k8s.io/client-go v0.18.8
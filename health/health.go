@@ -0,0 +1,199 @@
+// Package health keeps the health of agent components reported by the components themselves,
+// readiness and liveness of the agent are computed from it
+package health
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Options how the health of a component is computed
+type Options struct {
+	// StaleAfter the component is unhealthy if it didn't succeed for this long since it first reported,
+	// 0 disables it
+	StaleAfter time.Duration
+	// Live a component not reporting at all for StaleAfter fails liveness, so a stuck component
+	// gets the agent restarted, a component that never reported is stuck StaleAfter after it is registered
+	Live bool
+}
+
+// Status health of a component
+type Status struct {
+	Name    string `json:"name"`
+	Healthy bool   `json:"healthy"`
+	// Stale the component didn't succeed for longer than its threshold
+	Stale bool `json:"stale"`
+	// Live the component is not stuck
+	Live        bool      `json:"live"`
+	LastSuccess time.Time `json:"last_success,omitempty"`
+	LastFailure time.Time `json:"last_failure,omitempty"`
+	LastError   string    `json:"last_error,omitempty"`
+	Since       time.Time `json:"since"`
+}
+
+// Component a component reporting its health, methods are safe to call on a nil component
+type Component struct {
+	sync.Mutex
+	name       string
+	options    Options
+	registered time.Time
+	// reported the component reported at least once
+	reported    bool
+	failing     bool
+	lastSuccess time.Time
+	lastFailure time.Time
+	lastError   string
+	since       time.Time
+}
+
+// Success records the component works, the previous error is kept for troubleshooting
+func (c *Component) Success() {
+	if c == nil {
+		return
+	}
+	c.Lock()
+	defer c.Unlock()
+	now := time.Now()
+	if c.failing || !c.reported {
+		c.since = now
+	}
+	c.reported = true
+	c.failing = false
+	c.lastSuccess = now
+}
+
+// Failure records the component doesn't work until the next success
+func (c *Component) Failure(err error) {
+	if c == nil {
+		return
+	}
+	c.Lock()
+	defer c.Unlock()
+	now := time.Now()
+	if !c.failing || !c.reported {
+		c.since = now
+	}
+	c.reported = true
+	c.failing = true
+	c.lastFailure = now
+	if err != nil {
+		c.lastError = err.Error()
+	}
+}
+
+// StaleAfter gets the threshold of the component, 0 for a nil component
+func (c *Component) StaleAfter() time.Duration {
+	if c == nil {
+		return 0
+	}
+	c.Lock()
+	defer c.Unlock()
+	return c.options.StaleAfter
+}
+
+// SetStaleAfter changes the threshold, e.g. when the component changes how often it reports
+func (c *Component) SetStaleAfter(staleAfter time.Duration) {
+	if c == nil {
+		return
+	}
+	c.Lock()
+	defer c.Unlock()
+	c.options.StaleAfter = staleAfter
+}
+
+// Status gets the health of the component
+func (c *Component) Status() Status {
+	c.Lock()
+	defer c.Unlock()
+	status := Status{
+		Name:        c.name,
+		LastSuccess: c.lastSuccess,
+		LastFailure: c.lastFailure,
+		LastError:   c.lastError,
+		Since:       c.since,
+	}
+	// staleness is measured from the first report until the first success,
+	// so components started late, e.g. after authorization, are not stale meanwhile
+	last := c.lastSuccess
+	if last.IsZero() {
+		last = c.since
+	}
+	status.Stale = c.reported && c.options.StaleAfter > 0 && time.Since(last) > c.options.StaleAfter
+	// a failing component still reports, only a component not reporting at all is stuck
+	// a component that never reported is stuck as well, e.g. when its start hangs
+	lastReport := c.registered
+	if c.reported {
+		lastReport = c.lastSuccess
+		if c.lastFailure.After(lastReport) {
+			lastReport = c.lastFailure
+		}
+	}
+	stuck := c.options.StaleAfter > 0 && time.Since(lastReport) > c.options.StaleAfter
+	status.Live = !c.options.Live || !stuck
+	status.Healthy = c.reported && !c.failing && !status.Stale
+	return status
+}
+
+// Registry components reporting their health
+type Registry struct {
+	sync.Mutex
+	components map[string]*Component
+}
+
+// NewRegistry creates an empty registry
+func NewRegistry() *Registry {
+	return &Registry{components: map[string]*Component{}}
+}
+
+// Register adds a component, registering an existing name returns the same component
+func (r *Registry) Register(name string, options Options) *Component {
+	r.Lock()
+	defer r.Unlock()
+	if component, ok := r.components[name]; ok {
+		return component
+	}
+	now := time.Now()
+	component := &Component{name: name, options: options, registered: now, since: now}
+	r.components[name] = component
+	return component
+}
+
+// Statuses gets the health of all components sorted by name
+func (r *Registry) Statuses() []Status {
+	r.Lock()
+	components := make([]*Component, 0, len(r.components))
+	for _, component := range r.components {
+		components = append(components, component)
+	}
+	r.Unlock()
+
+	statuses := make([]Status, 0, len(components))
+	for _, component := range components {
+		statuses = append(statuses, component.Status())
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].Name < statuses[j].Name
+	})
+	return statuses
+}
+
+// Ready all components are healthy
+func (r *Registry) Ready() bool {
+	for _, status := range r.Statuses() {
+		if !status.Healthy {
+			return false
+		}
+	}
+	return true
+}
+
+// Live no component required for liveness is stale
+func (r *Registry) Live() bool {
+	for _, status := range r.Statuses() {
+		if !status.Live {
+			return false
+		}
+	}
+	return true
+}
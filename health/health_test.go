@@ -0,0 +1,94 @@
+package health
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestRegistry(t *testing.T) {
+	tests := []struct {
+		name      string
+		options   Options
+		report    func(c *Component)
+		wantReady bool
+		wantLive  bool
+	}{
+		{
+			name:      "not reported",
+			options:   Options{StaleAfter: time.Hour, Live: true},
+			report:    func(c *Component) {},
+			wantReady: false,
+			wantLive:  true,
+		},
+		{
+			name:      "success",
+			options:   Options{StaleAfter: time.Hour, Live: true},
+			report:    func(c *Component) { c.Success() },
+			wantReady: true,
+			wantLive:  true,
+		},
+		{
+			name:    "failure",
+			options: Options{StaleAfter: time.Hour, Live: true},
+			report: func(c *Component) {
+				c.Success()
+				c.Failure(errors.New("failed"))
+			},
+			wantReady: false,
+			wantLive:  true,
+		},
+		{
+			name:    "failing but reporting is live",
+			options: Options{StaleAfter: 20 * time.Millisecond, Live: true},
+			report: func(c *Component) {
+				c.Success()
+				time.Sleep(30 * time.Millisecond)
+				c.Failure(errors.New("failed"))
+			},
+			wantReady: false,
+			wantLive:  true,
+		},
+		{
+			name:    "stuck",
+			options: Options{StaleAfter: 10 * time.Millisecond, Live: true},
+			report: func(c *Component) {
+				c.Success()
+				time.Sleep(20 * time.Millisecond)
+			},
+			wantReady: false,
+			wantLive:  false,
+		},
+		{
+			name:      "never reported is stuck",
+			options:   Options{StaleAfter: 10 * time.Millisecond, Live: true},
+			report:    func(c *Component) { time.Sleep(20 * time.Millisecond) },
+			wantReady: false,
+			wantLive:  false,
+		},
+		{
+			name:    "stuck but not required for liveness",
+			options: Options{StaleAfter: 10 * time.Millisecond},
+			report: func(c *Component) {
+				c.Success()
+				time.Sleep(20 * time.Millisecond)
+			},
+			wantReady: false,
+			wantLive:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			registry := NewRegistry()
+			registry.Register("healthy", Options{}).Success()
+			tt.report(registry.Register("test", tt.options))
+
+			if ready := registry.Ready(); ready != tt.wantReady {
+				t.Errorf("Ready() = %v, want %v, statuses %+v", ready, tt.wantReady, registry.Statuses())
+			}
+			if live := registry.Live(); live != tt.wantLive {
+				t.Errorf("Live() = %v, want %v, statuses %+v", live, tt.wantLive, registry.Statuses())
+			}
+		})
+	}
+}
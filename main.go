@@ -14,8 +14,12 @@ import (
 	"github.com/MagalixCorp/magalix-agent/v2/agent"
 	"github.com/MagalixCorp/magalix-agent/v2/client"
 	"github.com/MagalixCorp/magalix-agent/v2/gateway"
+	"github.com/MagalixCorp/magalix-agent/v2/health"
 	"github.com/MagalixCorp/magalix-agent/v2/kuber"
 	"github.com/MagalixCorp/magalix-agent/v2/metrics"
+	"github.com/MagalixCorp/magalix-agent/v2/proto"
+	"github.com/MagalixCorp/magalix-agent/v2/sink"
+	"github.com/MagalixCorp/magalix-agent/v2/telemetry"
 	"github.com/MagalixCorp/magalix-agent/v2/utils"
 	"github.com/MagalixTechnologies/core/logger"
 	"github.com/MagalixTechnologies/uuid-go"
@@ -31,17 +35,51 @@ var usage = `agent - magalix services agent.
 
 Usage:
   agent -h | --help
-  agent [options] (--kube-url= | --kube-incluster) [--skip-namespace=]... [--source=]...
+  agent [options] (--kube-url= | --kube-incluster) [--skip-namespace=]... [--source=]... [--pipe-quota=]... [--pipe-weight=]... [--sink=]... [--remote-write-label=]...
+  agent replay --spool-dir=<path> [options]
+  agent decode <capture>
+  agent mock-gateway [options]
 
 Options:
   --gateway <address>                        Connect to specified Magalix Kubernetes Agent gateway.
+                                              Accepts a comma separated list of addresses,
+                                              the first one is the primary and the rest are
+                                              used in order when it fails.
                                               [default: wss://gateway.agent.magalix.cloud]
+  --gateway-plaintext                        Dial ws:// gateway addresses without tls, only meant
+                                              for the local mock gateway. ws:// addresses are
+                                              upgraded to wss:// otherwise.
+  --gateway-failover-after <failures>        Fail over to the next gateway after consecutive
+                                              connection or authorization failures.
+                                              [default: 3]
+  --gateway-failback-after <duration>        Fail back to the primary gateway after this time.
+                                              [default: 30m]
+  --gateway-give-up <policy>                 What to do when unable to connect and authorize
+                                              with the gateway. Supported policies are:
+                                              * exit - exit, so the agent is restarted;
+                                              * dormant - stop connecting for a period, then retry;
+                                              [default: exit]
+  --gateway-dormant-period <duration>        Time to stay dormant with the dormant give up policy.
+                                              [default: 15m]
   --account-id <identifier>                  Your account ID in Magalix.
                                               [default: $ACCOUNT_ID]
   --cluster-id <identifier>                  Your cluster ID in Magalix.
                                               [default: $CLUSTER_ID]
   --client-secret <secret>                   Unique and secret client token.
                                               [default: $SECRET]
+  --auth <method>                            Authentication method with the gateway.
+                                              Supported methods are:
+                                              * secret - challenge using --client-secret;
+                                              * mtls - client certificate from --tls-cert and --tls-key;
+                                              * token - bearer token read from --token-file;
+                                              [default: secret]
+  --tls-cert <filepath>                      Client certificate for mtls authentication.
+  --tls-key <filepath>                       Client certificate key for mtls authentication.
+  --tls-ca-cert <filepath>                   CA certificate to verify the gateway with mtls
+                                              authentication.
+  --token-file <filepath>                    Bearer token file for token authentication,
+                                              re-read on every connection.
+                                              [default: /var/run/secrets/magalix/token]
   --kube-url <url>                           Use specified URL and token for access to kubernetes
                                               cluster.
   --kube-insecure                            Insecure skip SSL verify.
@@ -68,12 +106,51 @@ Options:
                                               [default: 5]
   --metrics-interval <duration>              Metrics request and send interval.
                                               [default: 1m]
+  --telemetry-interval <duration>            Interval of collecting and sending telemetry of the
+                                              agent itself as agent metrics, also served on
+                                              /telemetry of the probes server, 0 disables it.
+                                              [default: 1m]
   --events-buffer-flush-interval <duration>  Events batch writer flush interval(Deprecated).
                                               [default: 10s]
   --events-buffer-size <size>                Events batch writer buffer size(Deprecated).
                                               [default: 20]
   --executor-workers <number>                 Executor concurrent workers count
                                               [default: 5]
+  --compression <codecs>                     Comma separated payload compression codecs in order
+                                              of preference, the first one supported by the
+                                              gateway is used. Supported codecs are:
+                                              * zstd;
+                                              * snappy;
+                                              * none;
+                                              [default: zstd,snappy]
+  --format <formats>                         Comma separated packet formats in order of
+                                              preference, the first one supported by the
+                                              gateway is used, json is used if none is.
+                                              Supported formats are:
+                                              * protobuf;
+                                              * json;
+                                              [default: protobuf,json]
+  --zstd-level <level>                       Zstd compression level.
+                                              [default: 3]
+  --chunk-size <bytes>                       Split packets larger than this into chunks sent
+                                              and retried separately, 0 disables chunking.
+                                              [default: 1048576]
+  --proxy <url>                              Connect to the gateway through an http (CONNECT) or
+                                              socks5 proxy, e.g. socks5://proxy:1080. By default
+                                              HTTPS_PROXY and NO_PROXY environment variables are used.
+  --proxy-user <user>                        Proxy authentication user.
+  --proxy-password <password>                Proxy authentication password, can be specified as
+                                              an environment variable, e.g. $PROXY_PASSWORD.
+  --proxy-ca-cert <filepath>                 CA bundle trusted in addition to system roots, for
+                                              TLS intercepting proxies.
+  --bandwidth-limit <bytes>                  Max bytes per second sent to the gateway,
+                                              0 means unlimited.
+                                              [default: 0]
+  --bandwidth-burst <bytes>                  Max bytes sent at once above the bandwidth limit.
+                                              [default: 1048576]
+  --bandwidth-bypass <kinds>                 Comma separated packet kinds sent without waiting
+                                              for the bandwidth limit.
+                                              [default: hello,authorization/request,authorization/answer,ping,automation/feedback]
   --timeout-proto-handshake <duration>       Timeout to do a websocket handshake.
                                               [default: 10s]
   --timeout-proto-write <duration>           Timeout to write a message to websocket channel.
@@ -94,8 +171,83 @@ Options:
   --disable-scalar                           Disable in-agent scalar. (Deprecated)
   --port <port>                              Port to start the server on for liveness and readiness probes
                                                [default: 80]
+  --drain-timeout <duration>                 Max time to send buffered data to the gateway on
+                                              termination or restart.
+                                              [default: 20s]
   --dry-run                                  Disable automation execution.
+  --config-file <path>                       Persist the runtime config pushed by the gateway to
+                                              the file, it overrides options on start.
   --no-send-logs                             Disable sending logs to the backend.
+  --pipe-store <type>                        Storage of packets pending to be sent to the gateway.
+                                              Supported types are:
+                                              * memory;
+                                              * disk - survives agent restarts;
+                                              [default: memory]
+  --pipe-store-dir <path>                    Directory used by the disk pipe store.
+                                              [default: /var/lib/magalix-agent/pipe]
+  --pipe-budget <bytes>                      Max encoded size of packets pending to be sent,
+                                              0 means unlimited.
+                                              [default: 0]
+  --pipe-quota <kind:bytes>                  Max encoded size of pending packets of a kind,
+                                              e.g. metrics/store_v2:67108864, can be specified
+                                              multiple times.
+  --pipe-eviction <policy>                   Packets evicted first when a budget is exceeded.
+                                              Supported policies are:
+                                              * drop-oldest;
+                                              * drop-lowest-priority;
+                                              * downsample-metrics - thin queued metrics evenly
+                                                across time, other packets are dropped oldest first;
+                                              [default: drop-oldest]
+  --pipe-schedule <mode>                     Order of sending pending packets.
+                                              Supported modes are:
+                                              * priority - strictly by priority then time;
+                                              * fair - each packet kind gets a share of send
+                                                bandwidth by its weight;
+                                              [default: priority]
+  --pipe-weight <kind:weight>                Weight of a packet kind with fair scheduling, kinds
+                                              not specified have weight 1, e.g. logs:1,
+                                              can be specified multiple times.
+  --pipe-aging <duration>                    Raise priority of a waiting packet by one every
+                                              period with fair scheduling, 0 disables aging.
+                                              [default: 1m]
+  --pipe-starvation <duration>               Report packets waiting longer as starved.
+                                              [default: 10m]
+  --spool-dir <path>                         Write packets to rotating spool files in the directory
+                                              instead of sending them to the gateway (air-gapped mode).
+                                              With replay, upload spool files from the directory
+                                              to the gateway.
+  --spool-file-size <bytes>                  Max size of a spool file before starting a new one.
+                                              [default: 67108864]
+  --spool-max-files <number>                 Max number of spool files to keep, oldest are removed
+                                              first, 0 means unlimited.
+                                              [default: 0]
+  --sink <type:target>                       Also send metrics, deltas and resyncs to a sink,
+                                              can be specified multiple times.
+                                              Supported types are:
+                                              * file - append json lines to a file path;
+                                              * webhook - post json to an http(s) url;
+                                              * remote-write - push metrics to a prometheus remote
+                                                write url;
+  --sink-buffer <number>                     Max number of sends queued for each sink, oldest
+                                              are dropped first.
+                                              [default: 1000]
+  --sink-timeout <duration>                  Timeout of requests sent by sinks.
+                                              [default: 10s]
+  --sink-sync-timeout <duration>             Max time each sink has to send buffered data on
+                                              termination or restart.
+                                              [default: 10s]
+  --remote-write-label <name=value>           External label added to metrics pushed by
+                                              remote-write sinks, can be specified multiple times.
+                                              cluster_id is added unless it is specified.
+  --prometheus-metrics                       Serve the latest collected metrics in prometheus
+                                              text format on /metrics of the probes server.
+  --capture <path>                           Write frames exchanged with the gateway to the file
+                                              for debugging, read it with agent decode.
+                                              Authorization tokens are redacted.
+  --mock-listen <address>                    Address the mock gateway listens on.
+                                              [default: 127.0.0.1:8090]
+  --mock-secret <secret>                     Base64 secret the mock gateway verifies authorization
+                                              answers with, any answer is accepted if empty.
   --debug                                    Enable debug messages.
   --trace                                    Enable debug and trace messages.
   --trace-log <path>                         Write log messages to specified file. (Deprecated)
@@ -107,6 +259,13 @@ Options:
 
 var version = "[manual build]"
 
+const (
+	// healthStaleIntervals metrics are stale when not sent for this many intervals
+	healthStaleIntervals = 3
+	// entitiesStaleAfter deltas are flushed at least every 10 seconds
+	entitiesStaleAfter = 5 * time.Minute
+)
+
 var startID string
 
 func main() {
@@ -115,6 +274,15 @@ func main() {
 		panic(err)
 	}
 
+	if args["decode"].(bool) {
+		decode(args)
+		return
+	}
+	if args["mock-gateway"].(bool) {
+		mockGateway(args)
+		return
+	}
+
 	logger.Infow(
 		"magalix agent started.....",
 		"version", version,
@@ -128,7 +296,8 @@ func main() {
 	}
 
 	port := args["--port"].(string)
-	probes := NewProbesServer(":" + port)
+	healthRegistry := health.NewRegistry()
+	probes := NewProbesServer(":"+port, healthRegistry)
 	go func() {
 		err = probes.Start()
 		if err != nil {
@@ -142,17 +311,39 @@ func main() {
 	accountID := utils.ExpandEnvUUID(args, "--account-id")
 	clusterID := utils.ExpandEnvUUID(args, "--cluster-id")
 
-	secret, err := base64.StdEncoding.DecodeString(
-		utils.ExpandEnv(args, "--client-secret", false),
+	authenticator, err := getAuthenticator(args)
+	if err != nil {
+		logger.Fatalw("unable to initialize authentication", "error", err)
+		os.Exit(1)
+	}
+
+	zstdCodec, err := proto.NewZstdCodec(utils.MustParseInt(args, "--zstd-level"))
+	if err != nil {
+		logger.Fatalw("unable to initialize zstd compression", "error", err)
+		os.Exit(1)
+	}
+	proto.RegisterCodec(zstdCodec)
+
+	proxy, err := getProxy(args)
+	if err != nil {
+		logger.Fatalw("unable to initialize proxy", "error", err)
+		os.Exit(1)
+	}
+
+	giveUpPolicy, err := client.NewGiveUpPolicy(
+		args["--gateway-give-up"].(string),
+		utils.MustParseDuration(args, "--gateway-dormant-period"),
 	)
 	if err != nil {
-		logger.Fatalw(
-			"unable to decode base64 secret specified as --client-secret flag",
-			"error", err,
-		)
+		logger.Fatalw("unable to initialize gateway give up policy", "error", err)
 		os.Exit(1)
 	}
 
+	if args["replay"].(bool) {
+		replay(args, accountID, clusterID, authenticator, proxy, giveUpPolicy)
+		return
+	}
+
 	kRestConfig, err := getKRestConfig(args)
 
 	kube, err := kuber.InitKubernetes(kRestConfig)
@@ -172,28 +363,30 @@ func main() {
 		logger.Warnw("Failed to get agent permissions", "error", err)
 	}
 
-	gatewayUrl := args["--gateway"].(string)
-	protoHandshakeTime := utils.MustParseDuration(args, "--timeout-proto-handshake")
-	protoWriteTime := utils.MustParseDuration(args, "--timeout-proto-write")
-	protoReadTime := utils.MustParseDuration(args, "--timeout-proto-read")
-	protoReconnectTime := utils.MustParseDuration(args, "--timeout-proto-reconnect")
-	protoBackoffTime := utils.MustParseDuration(args, "--timeout-proto-backoff")
-	sendLogs := !args["--no-send-logs"].(bool)
-	mgxGateway := gateway.New(
-		gatewayUrl,
+	pipeStore, err := getPipeStore(args)
+	if err != nil {
+		logger.Fatalw("unable to initialize pipe store", "error", err)
+		os.Exit(1)
+	}
+	spool, err := getSpool(args)
+	if err != nil {
+		logger.Fatalw("unable to initialize spool", "error", err)
+		os.Exit(1)
+	}
+	mgxGateway := getGateway(
+		args,
 		accountID,
 		clusterID,
-		secret,
-		version,
-		startID,
+		authenticator,
 		k8sServerVersion,
 		agentPermissions,
-		protoHandshakeTime,
-		protoWriteTime,
-		protoReadTime,
-		protoReconnectTime,
-		protoBackoffTime,
-		sendLogs)
+		pipeStore,
+		spool,
+		proxy,
+		giveUpPolicy,
+	)
+	probes.SetConnectionState(mgxGateway.State)
+	mgxGateway.SetHealth(healthRegistry.Register("gateway", health.Options{}))
 
 	logLevel := args["--log-level"].(string)
 	if err := ConfigureGlobalLogger(accountID, clusterID, logLevel, mgxGateway.GetLogsWriteSyncer()); err != nil {
@@ -238,6 +431,15 @@ func main() {
 	}
 	ew := entities.NewEntitiesWatcher(observer, k8sMinorVersion)
 
+	metricsSource.SetHealth(healthRegistry.Register("metrics", health.Options{
+		StaleAfter: healthStaleIntervals * metricsInterval,
+		Live:       true,
+	}))
+	ew.SetHealth(healthRegistry.Register("entities", health.Options{
+		StaleAfter: entitiesStaleAfter,
+		Live:       true,
+	}))
+
 	executorWorkers := utils.MustParseInt(args, "--executor-workers")
 	dryRun := args["--dry-run"].(bool)
 	automationExecutor := executor.NewExecutor(
@@ -246,19 +448,52 @@ func main() {
 		executorWorkers,
 		dryRun,
 	)
+	automationExecutor.SetHealth(healthRegistry.Register("executor", health.Options{}))
+
+	sinks, err := getSinks(args, clusterID)
+	if err != nil {
+		logger.Fatalw("unable to initialize sinks", "error", err)
+		os.Exit(1)
+	}
+	if args["--prometheus-metrics"].(bool) {
+		prometheus := sink.NewPrometheus()
+		probes.SetMetrics(prometheus)
+		sinks = append(sinks, agent.NewBufferedSink(prometheus, utils.MustParseInt(args, "--sink-buffer")))
+	}
+
+	var telemetrySource agent.MetricsSource
+	if telemetryInterval := utils.MustParseDuration(args, "--telemetry-interval"); telemetryInterval > 0 {
+		collector := telemetry.NewCollector(telemetryInterval, mgxGateway, ew, metricsSource, automationExecutor)
+		probes.SetTelemetry(func() interface{} { return collector.Latest() })
+		telemetrySource = collector
+	}
 
 	// init gateway
 	mgxAgent := agent.New(
 		metricsSource,
+		telemetrySource,
 		ew,
 		automationExecutor,
 		mgxGateway,
+		sinks,
 		func(level *agent.LogLevel) error {
 			return ConfigureGlobalLogger(accountID, clusterID, level.Level, mgxGateway.GetLogsWriteSyncer())
 		},
+		utils.MustParseDuration(args, "--drain-timeout"),
 	)
+	mgxAgent.SetSinkSyncTimeout(utils.MustParseDuration(args, "--sink-sync-timeout"))
+	mgxAgent.SetConfig(agent.Config{
+		MetricsInterval: metricsInterval,
+		DryRun:          dryRun,
+		ExecutorWorkers: executorWorkers,
+		LogLevel:        logLevel,
+	})
+	if configFile, ok := args["--config-file"].(string); ok && configFile != "" {
+		mgxAgent.SetConfigStore(agent.NewFileConfigStore(configFile))
+	}
 
-	probes.IsReady = true
+	probes.SetComponentsHealth(mgxAgent.ComponentsHealth)
+	probes.SetReady(true)
 
 	err = mgxAgent.Start()
 	if err != nil {
@@ -315,6 +550,193 @@ func getKRestConfig(
 	return
 }
 
+func getGateway(
+	args map[string]interface{},
+	accountID uuid.UUID,
+	clusterID uuid.UUID,
+	authenticator client.Authenticator,
+	k8sServerVersion string,
+	agentPermissions string,
+	pipeStore client.PipeStore,
+	spool *client.Spool,
+	proxy *client.ProxyConfig,
+	giveUpPolicy client.GiveUpPolicy,
+) *gateway.MagalixGateway {
+	gatewayUrls := strings.Split(args["--gateway"].(string), ",")
+	failoverAfter := utils.MustParseInt(args, "--gateway-failover-after")
+	failbackAfter := utils.MustParseDuration(args, "--gateway-failback-after")
+	protoHandshakeTime := utils.MustParseDuration(args, "--timeout-proto-handshake")
+	protoWriteTime := utils.MustParseDuration(args, "--timeout-proto-write")
+	protoReadTime := utils.MustParseDuration(args, "--timeout-proto-read")
+	protoReconnectTime := utils.MustParseDuration(args, "--timeout-proto-reconnect")
+	protoBackoffTime := utils.MustParseDuration(args, "--timeout-proto-backoff")
+	sendLogs := !args["--no-send-logs"].(bool)
+	codecs := strings.Split(args["--compression"].(string), ",")
+	formats := strings.Split(args["--format"].(string), ",")
+	chunkSize := utils.MustParseInt(args, "--chunk-size")
+	var bypass []proto.PacketKind
+	for _, kind := range strings.Split(args["--bandwidth-bypass"].(string), ",") {
+		bypass = append(bypass, proto.PacketKind(kind))
+	}
+	bandwidth := client.NewBandwidth(
+		utils.MustParseInt(args, "--bandwidth-limit"),
+		utils.MustParseInt(args, "--bandwidth-burst"),
+		bypass,
+	)
+	capture, err := getCapture(args)
+	if err != nil {
+		logger.Fatalw("unable to initialize capture", "error", err)
+		os.Exit(1)
+	}
+	return gateway.New(gateway.Options{
+		GatewayURLs:      gatewayUrls,
+		AllowPlaintext:   args["--gateway-plaintext"].(bool),
+		Version:          version,
+		StartID:          startID,
+		AccountID:        accountID,
+		ClusterID:        clusterID,
+		Authenticator:    authenticator,
+		ServerVersion:    k8sServerVersion,
+		AgentPermissions: agentPermissions,
+		ProtoHandshake:   protoHandshakeTime,
+		ProtoWrite:       protoWriteTime,
+		ProtoRead:        protoReadTime,
+		ProtoReconnect:   protoReconnectTime,
+		ProtoBackoff:     protoBackoffTime,
+		SendLogs:         sendLogs,
+		PipeStore:        pipeStore,
+		Spool:            spool,
+		Capture:          capture,
+		Codecs:           codecs,
+		Formats:          formats,
+		ChunkSize:        chunkSize,
+		FailoverAfter:    failoverAfter,
+		FailbackAfter:    failbackAfter,
+		Proxy:            proxy,
+		GiveUpPolicy:     giveUpPolicy,
+		Bandwidth:        bandwidth,
+	})
+}
+
+func getAuthenticator(args map[string]interface{}) (client.Authenticator, error) {
+	switch method := args["--auth"].(string); method {
+	case "secret":
+		secret, err := base64.StdEncoding.DecodeString(
+			utils.ExpandEnv(args, "--client-secret", false),
+		)
+		if err != nil {
+			return nil, fmt.Errorf("unable to decode base64 secret specified as --client-secret flag, error: %w", err)
+		}
+		return client.NewSecretAuthenticator(secret), nil
+	case "mtls":
+		certFile, _ := args["--tls-cert"].(string)
+		keyFile, _ := args["--tls-key"].(string)
+		caFile, _ := args["--tls-ca-cert"].(string)
+		if certFile == "" || keyFile == "" {
+			return nil, fmt.Errorf("--tls-cert and --tls-key are required for mtls authentication")
+		}
+		return client.NewTLSAuthenticator(certFile, keyFile, caFile), nil
+	case "token":
+		return client.NewTokenFileAuthenticator(args["--token-file"].(string)), nil
+	default:
+		return nil, fmt.Errorf("unsupported authentication method %s", method)
+	}
+}
+
+func getProxy(args map[string]interface{}) (*client.ProxyConfig, error) {
+	proxyURL, _ := args["--proxy"].(string)
+	proxyUser, _ := args["--proxy-user"].(string)
+	proxyCAFile, _ := args["--proxy-ca-cert"].(string)
+	return client.NewProxyConfig(
+		proxyURL,
+		proxyUser,
+		utils.ExpandEnv(args, "--proxy-password", true),
+		proxyCAFile,
+	)
+}
+
+func getSpool(args map[string]interface{}) (*client.Spool, error) {
+	spoolDir, ok := args["--spool-dir"].(string)
+	if !ok || spoolDir == "" {
+		return nil, nil
+	}
+	return client.NewSpool(
+		spoolDir,
+		int64(utils.MustParseInt(args, "--spool-file-size")),
+		utils.MustParseInt(args, "--spool-max-files"),
+	)
+}
+
+func getSinks(args map[string]interface{}, clusterID uuid.UUID) ([]agent.Sink, error) {
+	specs, _ := args["--sink"].([]string)
+	size := utils.MustParseInt(args, "--sink-buffer")
+	timeout := utils.MustParseDuration(args, "--sink-timeout")
+
+	externalLabels := map[string]string{"cluster_id": clusterID.String()}
+	labels, _ := args["--remote-write-label"].([]string)
+	for _, label := range labels {
+		parts := strings.SplitN(label, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid remote write label %q, expected <name>=<value>", label)
+		}
+		externalLabels[parts[0]] = parts[1]
+	}
+
+	sinks := make([]agent.Sink, 0, len(specs))
+	for _, spec := range specs {
+		s, err := sink.Parse(spec, timeout, size, externalLabels)
+		if err != nil {
+			return nil, err
+		}
+		sinks = append(sinks, agent.NewBufferedSink(s, size))
+	}
+	return sinks, nil
+}
+
+func getCapture(args map[string]interface{}) (*client.Capture, error) {
+	path, ok := args["--capture"].(string)
+	if !ok || path == "" {
+		return nil, nil
+	}
+	return client.NewCapture(path)
+}
+
+func getPipeStore(args map[string]interface{}) (client.PipeStore, error) {
+	quotas, _ := args["--pipe-quota"].([]string)
+	budget, err := client.NewPipeBudget(
+		utils.MustParseInt(args, "--pipe-budget"),
+		quotas,
+		args["--pipe-eviction"].(string),
+	)
+	if err != nil {
+		return nil, err
+	}
+	weights, _ := args["--pipe-weight"].([]string)
+	schedule, err := client.NewPipeSchedule(
+		args["--pipe-schedule"].(string),
+		weights,
+		utils.MustParseDuration(args, "--pipe-aging"),
+		utils.MustParseDuration(args, "--pipe-starvation"),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	switch storeType := args["--pipe-store"].(string); storeType {
+	case "memory":
+		return client.NewMemoryPipeStore(budget, schedule), nil
+	case "disk":
+		return client.NewDiskPipeStore(
+			args["--pipe-store-dir"].(string),
+			client.DefaultDiskCompactThreshold,
+			budget,
+			schedule,
+		)
+	default:
+		return nil, fmt.Errorf("unsupported pipe store %s", storeType)
+	}
+}
+
 // ConfigureGlobalLogger sets additional info and log level for global logger
 func ConfigureGlobalLogger(accountId uuid.UUID, clusterId uuid.UUID, level string, logsSink zapcore.WriteSyncer) error {
 	var loggerLevel logger.Level
@@ -85,6 +85,8 @@ type kubeletTimeouts struct {
 type Kubelet struct {
 	previous         map[string]KubeletValue
 	previousMutex    *sync.Mutex
+	scrapes          map[string]time.Duration
+	scrapesMutex     sync.Mutex
 	timeouts         kubeletTimeouts
 	kubeletClient    *KubeletClient
 	EntitiesProvider EntitiesProvider
@@ -102,6 +104,7 @@ func NewKubelet(
 		EntitiesProvider: entitiesProvider,
 		previous:         map[string]KubeletValue{},
 		previousMutex:    &sync.Mutex{},
+		scrapes:          map[string]time.Duration{},
 		timeouts: kubeletTimeouts{
 			backoff: backOff{
 				sleep:      backOffSleep,
@@ -466,6 +469,11 @@ func (kubelet *Kubelet) GetMetrics() (result []*agent.Metric, err error) {
 	pr, err := alltogether.NewConcurrentProcessor(
 		nodes,
 		func(node corev1.Node) error {
+			started := time.Now()
+			defer func() {
+				kubelet.recordScrape(node.Name, time.Since(started))
+			}()
+
 			nodeIP := GetNodeIP(&node)
 			logger.Debugf(
 				"{kubelet} requesting metrics from node %s",
@@ -844,6 +852,23 @@ func (kubelet *Kubelet) GetMetrics() (result []*agent.Metric, err error) {
 	return result, nil
 }
 
+// ScrapeDurations gets the duration of the last scrape of every node, retries included
+func (kubelet *Kubelet) ScrapeDurations() map[string]time.Duration {
+	kubelet.scrapesMutex.Lock()
+	defer kubelet.scrapesMutex.Unlock()
+	durations := make(map[string]time.Duration, len(kubelet.scrapes))
+	for node, duration := range kubelet.scrapes {
+		durations[node] = duration
+	}
+	return durations
+}
+
+func (kubelet *Kubelet) recordScrape(node string, duration time.Duration) {
+	kubelet.scrapesMutex.Lock()
+	defer kubelet.scrapesMutex.Unlock()
+	kubelet.scrapes[node] = duration
+}
+
 func (kubelet *Kubelet) collectGarbage() {
 	for key, previous := range kubelet.previous {
 		if time.Since(previous.Timestamp) > time.Hour {
@@ -4,16 +4,22 @@ import (
 	"context"
 	"fmt"
 	"github.com/MagalixCorp/magalix-agent/v2/agent"
+	"github.com/MagalixCorp/magalix-agent/v2/health"
 	"github.com/MagalixCorp/magalix-agent/v2/kuber"
 	"github.com/MagalixTechnologies/core/logger"
+	"sync"
 	"time"
 )
 
 type Metrics struct {
 	source          MetricsSource
 	metricsInterval time.Duration
+	// intervalChanged is signaled when the interval is changed so the ticker is re-created
+	intervalChanged chan struct{}
+	intervalM       sync.Mutex
 	cancelWorker    context.CancelFunc
 	sendMetrics     agent.MetricsHandler
+	health          *health.Component
 }
 
 func NewMetrics(
@@ -42,6 +48,7 @@ func NewMetrics(
 	return &Metrics{
 		source:          kubelet,
 		metricsInterval: metricsInterval,
+		intervalChanged: make(chan struct{}, 1),
 	}, nil
 }
 
@@ -49,6 +56,11 @@ func (m *Metrics) SetMetricsHandler(handler agent.MetricsHandler) {
 	m.sendMetrics = handler
 }
 
+// SetHealth sets the component successful collections are reported to
+func (m *Metrics) SetHealth(component *health.Component) {
+	m.health = component
+}
+
 func (m *Metrics) Start(ctx context.Context) error {
 	if m.cancelWorker != nil {
 		m.cancelWorker()
@@ -57,28 +69,67 @@ func (m *Metrics) Start(ctx context.Context) error {
 	cancelCtx, cancel := context.WithCancel(ctx)
 	m.cancelWorker = cancel
 
-	ticker := time.NewTicker(m.metricsInterval)
+	ticker := time.NewTicker(m.interval())
 	for {
 		select {
 		case <-cancelCtx.Done():
 			ticker.Stop()
 			logger.Debug("Metrics worker stopped")
 			return nil
+		case <-m.intervalChanged:
+			ticker.Stop()
+			ticker = time.NewTicker(m.interval())
 		case <-ticker.C:
 			metrics, err := m.source.GetMetrics()
 			if err != nil {
 				logger.Errorf("failed to get metrics. %w", err)
+				m.health.Failure(err)
 				continue
 			}
 
 			err = m.sendMetrics(metrics)
 			if err != nil {
 				logger.Errorf("failed to send metrics. %w", err)
+				m.health.Failure(err)
+				continue
 			}
+			m.health.Success()
 		}
 	}
 }
 
+// SetInterval changes the interval of collecting metrics, the staleness threshold of the health is scaled with it
+func (m *Metrics) SetInterval(interval time.Duration) {
+	m.intervalM.Lock()
+	previous := m.metricsInterval
+	m.metricsInterval = interval
+	m.intervalM.Unlock()
+
+	if staleAfter := m.health.StaleAfter(); staleAfter > 0 && previous > 0 {
+		m.health.SetStaleAfter(time.Duration(float64(staleAfter) * float64(interval) / float64(previous)))
+	}
+	select {
+	case m.intervalChanged <- struct{}{}:
+	default:
+	}
+	logger.Infow("metrics interval has been changed", "interval", interval)
+}
+
+func (m *Metrics) interval() time.Duration {
+	m.intervalM.Lock()
+	defer m.intervalM.Unlock()
+	return m.metricsInterval
+}
+
+// ScrapeDurations gets the duration of the last scrape of every node, empty if the source doesn't measure it
+func (m *Metrics) ScrapeDurations() map[string]time.Duration {
+	source, ok := m.source.(ScrapeDurationsSource)
+	if !ok {
+		return map[string]time.Duration{}
+	}
+	return source.ScrapeDurations()
+}
+
 func (m *Metrics) Stop() error {
 	if m.cancelWorker == nil {
 		return nil
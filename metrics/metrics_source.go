@@ -1,6 +1,8 @@
 package metrics
 
 import (
+	"time"
+
 	"github.com/MagalixCorp/magalix-agent/v2/agent"
 	corev1 "k8s.io/api/core/v1"
 )
@@ -16,3 +18,8 @@ type EntitiesProvider interface {
 type MetricsSource interface {
 	GetMetrics() ([]*agent.Metric, error)
 }
+
+// ScrapeDurationsSource a metrics source measuring how long scraping every node takes
+type ScrapeDurationsSource interface {
+	ScrapeDurations() map[string]time.Duration
+}
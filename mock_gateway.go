@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/signal"
+	"reflect"
+	"strings"
+	"syscall"
+
+	"github.com/MagalixCorp/magalix-agent/v2/gateway/mock"
+	"github.com/MagalixCorp/magalix-agent/v2/proto"
+	"github.com/MagalixCorp/magalix-agent/v2/utils"
+	"github.com/MagalixTechnologies/core/logger"
+)
+
+// mockGateway runs a local agent gateway, packets received from agents are logged
+// and commands read from stdin as `<kind> [json packet]` lines are sent to the last authorized agent
+func mockGateway(args map[string]interface{}) {
+	secret, err := base64.StdEncoding.DecodeString(utils.ExpandEnv(args, "--mock-secret", true))
+	if err != nil {
+		logger.Fatalw("unable to decode base64 secret specified as --mock-secret flag", "error", err)
+		os.Exit(1)
+	}
+	zstdCodec, err := proto.NewZstdCodec(utils.MustParseInt(args, "--zstd-level"))
+	if err != nil {
+		logger.Fatalw("unable to initialize zstd compression", "error", err)
+		os.Exit(1)
+	}
+	proto.RegisterCodec(zstdCodec)
+
+	// the mock advertises a single codec and format, the first ones in the lists
+	codec := strings.Split(args["--compression"].(string), ",")[0]
+	format := strings.Split(args["--format"].(string), ",")[0]
+
+	gateway := mock.New(secret, codec, format)
+	if err := gateway.Start(args["--mock-listen"].(string)); err != nil {
+		logger.Fatalw("unable to start mock gateway", "error", err)
+		os.Exit(1)
+	}
+	defer gateway.Close()
+	logger.Infow("mock gateway started", "url", gateway.URL(), "codec", codec, "format", format)
+
+	go func() {
+		scanner := bufio.NewScanner(os.Stdin)
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if line == "" {
+				continue
+			}
+			response, err := sendMockCommand(gateway, line)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "unable to send command, error: %s\n", err)
+				continue
+			}
+			out, _ := json.Marshal(response)
+			fmt.Println(string(out))
+		}
+	}()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	<-signals
+}
+
+// sendMockCommand sends a `<kind> [json packet]` line to the agent and returns its response
+func sendMockCommand(gateway *mock.Gateway, line string) (interface{}, error) {
+	parts := strings.SplitN(line, " ", 2)
+	kind := proto.PacketKind(parts[0])
+	packet, ok := proto.NewPacket(kind)
+	if !ok {
+		return nil, fmt.Errorf("unknown packet kind %s", kind)
+	}
+	if len(parts) > 1 {
+		if err := json.Unmarshal([]byte(parts[1]), packet); err != nil {
+			return nil, fmt.Errorf("unable to decode %s packet, error: %w", kind, err)
+		}
+	}
+	response, _ := proto.NewResponse(kind)
+	err := gateway.Send(kind, reflect.ValueOf(packet).Elem().Interface(), response)
+	return response, err
+}
@@ -1,32 +1,97 @@
 package main
 
 import (
+	"encoding/json"
 	"net/http"
+	"sync"
+	"time"
 
+	"github.com/MagalixCorp/magalix-agent/v2/agent"
+	"github.com/MagalixCorp/magalix-agent/v2/client"
+	"github.com/MagalixCorp/magalix-agent/v2/health"
 	"github.com/MagalixTechnologies/core/logger"
 )
 
 const (
-	liveness  = "/live"
-	readiness = "/ready"
+	liveness      = "/live"
+	readiness     = "/ready"
+	state         = "/state"
+	healthz       = "/healthz"
+	telemetryPath = "/telemetry"
+	metricsPath   = "/metrics"
 )
 
+// ProbesServer serves probes while the agent is being created, so the fields set by setters are guarded
 type ProbesServer struct {
+	sync.Mutex
 	address string
 
-	IsReady bool
+	// Health components reporting their health, readiness and liveness are computed from it
+	Health *health.Registry
+
+	isReady bool
+	// connectionState returns the state of the connection with the gateway, nil until the gateway is created
+	connectionState func() (client.State, time.Time)
+	// componentsHealth returns the state of supervised components, nil until the agent is created
+	componentsHealth func() map[string]agent.ComponentHealth
+	// telemetry returns the latest telemetry of the agent, nil if telemetry is disabled
+	telemetry func() interface{}
+	// metrics serves the latest collected metrics in prometheus text format, nil if not enabled
+	metrics http.Handler
 }
 
-func NewProbesServer(address string) *ProbesServer {
+func NewProbesServer(address string, registry *health.Registry) *ProbesServer {
 	return &ProbesServer{
 		address: address,
-		IsReady: false,
+		isReady: false,
+		Health:  registry,
 	}
 }
 
+// SetReady sets whether the agent is started
+func (p *ProbesServer) SetReady(ready bool) {
+	p.Lock()
+	defer p.Unlock()
+	p.isReady = ready
+}
+
+func (p *ProbesServer) SetConnectionState(connectionState func() (client.State, time.Time)) {
+	p.Lock()
+	defer p.Unlock()
+	p.connectionState = connectionState
+}
+
+func (p *ProbesServer) SetComponentsHealth(componentsHealth func() map[string]agent.ComponentHealth) {
+	p.Lock()
+	defer p.Unlock()
+	p.componentsHealth = componentsHealth
+}
+
+func (p *ProbesServer) SetTelemetry(telemetry func() interface{}) {
+	p.Lock()
+	defer p.Unlock()
+	p.telemetry = telemetry
+}
+
+func (p *ProbesServer) SetMetrics(metrics http.Handler) {
+	p.Lock()
+	defer p.Unlock()
+	p.metrics = metrics
+}
+
+func (p *ProbesServer) ready() bool {
+	p.Lock()
+	defer p.Unlock()
+	return p.isReady
+}
+
 func (p *ProbesServer) Start() error {
 	http.HandleFunc(liveness, p.livenessProbeHandler)
 	http.HandleFunc(readiness, p.readinessProbeHandler)
+	http.HandleFunc(state, p.stateHandler)
+	http.HandleFunc(healthz, p.healthHandler)
+	http.HandleFunc(telemetryPath, p.telemetryHandler)
+	http.HandleFunc(metricsPath, p.metricsHandler)
 
 	logger.Infow("Starting server....", "address", p.address)
 	defer func() {
@@ -36,14 +101,88 @@ func (p *ProbesServer) Start() error {
 	return http.ListenAndServe(p.address, nil)
 }
 
+// livenessProbeHandler fails when a component required for liveness is stuck
 func (p *ProbesServer) livenessProbeHandler(w http.ResponseWriter, req *http.Request) {
-	w.WriteHeader(200)
+	if p.Health.Live() {
+		w.WriteHeader(200)
+	} else {
+		w.WriteHeader(503)
+	}
 }
 
+// readinessProbeHandler fails until the agent is started and while any component is unhealthy
 func (p *ProbesServer) readinessProbeHandler(w http.ResponseWriter, req *http.Request) {
-	if p.IsReady {
+	if p.ready() && p.Health.Ready() {
 		w.WriteHeader(200)
 	} else {
 		w.WriteHeader(503)
 	}
 }
+
+// telemetryHandler responds with the latest telemetry of the agent
+func (p *ProbesServer) telemetryHandler(w http.ResponseWriter, req *http.Request) {
+	p.Lock()
+	telemetry := p.telemetry
+	p.Unlock()
+	if telemetry == nil {
+		w.WriteHeader(404)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(telemetry())
+}
+
+// metricsHandler responds with the latest collected metrics
+func (p *ProbesServer) metricsHandler(w http.ResponseWriter, req *http.Request) {
+	p.Lock()
+	metrics := p.metrics
+	p.Unlock()
+	if metrics == nil {
+		w.WriteHeader(404)
+		return
+	}
+	metrics.ServeHTTP(w, req)
+}
+
+// healthHandler responds with the health of every component
+func (p *ProbesServer) healthHandler(w http.ResponseWriter, req *http.Request) {
+	response := struct {
+		Ready      bool                             `json:"ready"`
+		Live       bool                             `json:"live"`
+		Components []health.Status                  `json:"components"`
+		Supervised map[string]agent.ComponentHealth `json:"supervised,omitempty"`
+	}{
+		Ready:      p.ready() && p.Health.Ready(),
+		Live:       p.Health.Live(),
+		Components: p.Health.Statuses(),
+	}
+	p.Lock()
+	componentsHealth := p.componentsHealth
+	p.Unlock()
+	if componentsHealth != nil {
+		response.Supervised = componentsHealth()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if !response.Ready {
+		w.WriteHeader(503)
+	}
+	_ = json.NewEncoder(w).Encode(response)
+}
+
+// stateHandler responds with the state of the connection with the gateway
+func (p *ProbesServer) stateHandler(w http.ResponseWriter, req *http.Request) {
+	p.Lock()
+	getConnectionState := p.connectionState
+	p.Unlock()
+	if getConnectionState == nil {
+		w.WriteHeader(503)
+		return
+	}
+	connectionState, since := getConnectionState()
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(struct {
+		State client.State `json:"state"`
+		Since time.Time    `json:"since"`
+	}{connectionState, since})
+}
@@ -0,0 +1,42 @@
+package proto
+
+// Capability a feature exchanged in hello
+// a feature is enabled only when both the agent and the agent gateway advertise it
+type Capability string
+
+const (
+	// CapabilityPacketsV2 packets without ids
+	CapabilityPacketsV2 Capability = "packets/v2"
+	// CapabilityEnvelope piped packets are wrapped in an envelope with an idempotency id
+	// the agent gateway acknowledges the id in the response
+	CapabilityEnvelope Capability = "envelope/v1"
+)
+
+// KindCapability capability of sending or handling a packet kind
+func KindCapability(kind PacketKind) Capability {
+	return Capability("kind/" + kind.String())
+}
+
+// Capabilities a set of capabilities
+type Capabilities []Capability
+
+// Has checks if the set contains the capability
+func (c Capabilities) Has(capability Capability) bool {
+	for _, item := range c {
+		if item == capability {
+			return true
+		}
+	}
+	return false
+}
+
+// Intersect returns capabilities found in both sets
+func (c Capabilities) Intersect(other Capabilities) Capabilities {
+	res := Capabilities{}
+	for _, item := range c {
+		if other.Has(item) {
+			res = append(res, item)
+		}
+	}
+	return res
+}
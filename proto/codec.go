@@ -0,0 +1,132 @@
+package proto
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	CodecNone   = "none"
+	CodecSnappy = "snappy"
+	CodecZstd   = "zstd"
+
+	// DefaultZstdLevel zstd encoder level used unless configured otherwise
+	DefaultZstdLevel = 3
+)
+
+// Codec compresses packets encoded with a format
+type Codec interface {
+	Name() string
+	Compress(in []byte) ([]byte, error)
+	Decompress(in []byte) ([]byte, error)
+}
+
+var (
+	codecsM sync.RWMutex
+	codecs  = map[string]Codec{}
+)
+
+func init() {
+	RegisterCodec(noneCodec{})
+	RegisterCodec(snappyCodec{})
+	codec, err := NewZstdCodec(DefaultZstdLevel)
+	if err != nil {
+		panic(err)
+	}
+	RegisterCodec(codec)
+}
+
+// RegisterCodec adds a codec to the registry, replacing a codec with the same name
+func RegisterCodec(codec Codec) {
+	codecsM.Lock()
+	defer codecsM.Unlock()
+	codecs[codec.Name()] = codec
+}
+
+// GetCodec gets a registered codec by name
+func GetCodec(name string) (Codec, bool) {
+	codecsM.RLock()
+	defer codecsM.RUnlock()
+	codec, ok := codecs[name]
+	return codec, ok
+}
+
+// CodecCapability capability of encoding packets with a codec
+func CodecCapability(name string) Capability {
+	return Capability("codec/" + name)
+}
+
+// EncodeWith encodes a packet to json and compresses it with the codec
+func EncodeWith(codec Codec, in interface{}) ([]byte, error) {
+	return EncodePacket(jsonFormat{}, codec, "", in)
+}
+
+// DecodeWith decompresses a packet with the codec and decodes it from json
+func DecodeWith(codec Codec, in []byte, out interface{}) error {
+	return DecodePacket(jsonFormat{}, codec, in, out)
+}
+
+type noneCodec struct{}
+
+func (noneCodec) Name() string {
+	return CodecNone
+}
+
+func (noneCodec) Compress(in []byte) ([]byte, error) {
+	return in, nil
+}
+
+func (noneCodec) Decompress(in []byte) ([]byte, error) {
+	return in, nil
+}
+
+type snappyCodec struct{}
+
+func (snappyCodec) Name() string {
+	return CodecSnappy
+}
+
+func (snappyCodec) Compress(in []byte) ([]byte, error) {
+	return snappy.Encode(nil, in), nil
+}
+
+func (snappyCodec) Decompress(in []byte) ([]byte, error) {
+	return snappy.Decode(nil, in)
+}
+
+type zstdCodec struct {
+	encoder *zstd.Encoder
+	decoder *zstd.Decoder
+}
+
+// NewZstdCodec creates a zstd codec with the given zstd compression level
+// the level is mapped to the closest level supported by the encoder
+func NewZstdCodec(level int) (Codec, error) {
+	encoder, err := zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(level)))
+	if err != nil {
+		return nil, fmt.Errorf("unable to create zstd encoder, error: %w", err)
+	}
+	decoder, err := zstd.NewReader(nil)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create zstd decoder, error: %w", err)
+	}
+	return &zstdCodec{
+		encoder: encoder,
+		decoder: decoder,
+	}, nil
+}
+
+func (c *zstdCodec) Name() string {
+	return CodecZstd
+}
+
+func (c *zstdCodec) Compress(in []byte) ([]byte, error) {
+	return c.encoder.EncodeAll(in, nil), nil
+}
+
+func (c *zstdCodec) Decompress(in []byte) ([]byte, error) {
+	return c.decoder.DecodeAll(in, nil)
+}
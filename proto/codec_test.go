@@ -0,0 +1,29 @@
+package proto
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCodecs_RoundTrip(t *testing.T) {
+	in := PacketLogLevel{Level: "debug"}
+	for _, name := range []string{CodecNone, CodecSnappy, CodecZstd} {
+		t.Run(name, func(t *testing.T) {
+			codec, ok := GetCodec(name)
+			if !ok {
+				t.Fatalf("GetCodec(%s) codec is not registered", name)
+			}
+			encoded, err := EncodeWith(codec, in)
+			if err != nil {
+				t.Fatalf("EncodeWith() error = %v", err)
+			}
+			var out PacketLogLevel
+			if err := DecodeWith(codec, encoded, &out); err != nil {
+				t.Fatalf("DecodeWith() error = %v", err)
+			}
+			if !reflect.DeepEqual(in, out) {
+				t.Errorf("DecodeWith() = %v, want %v", out, in)
+			}
+		})
+	}
+}
@@ -0,0 +1,161 @@
+package proto
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"runtime/debug"
+	"sync"
+)
+
+const (
+	FormatJSON     = "json"
+	FormatProtobuf = "protobuf"
+)
+
+// Format serializes packets before they are compressed with a codec
+// json is supported by every agent gateway and used when no other format is negotiated
+type Format interface {
+	Name() string
+	// Marshal encodes a packet of the kind, the kind is needed to encode json.RawMessage packets
+	Marshal(kind PacketKind, in interface{}) ([]byte, error)
+	Unmarshal(in []byte, out interface{}) error
+}
+
+var (
+	formatsM sync.RWMutex
+	formats  = map[string]Format{}
+)
+
+func init() {
+	RegisterFormat(jsonFormat{})
+	RegisterFormat(protobufFormat{})
+}
+
+// RegisterFormat adds a format to the registry, replacing a format with the same name
+func RegisterFormat(format Format) {
+	formatsM.Lock()
+	defer formatsM.Unlock()
+	formats[format.Name()] = format
+}
+
+// GetFormat gets a registered format by name, empty name is json
+func GetFormat(name string) (Format, bool) {
+	if name == "" {
+		name = FormatJSON
+	}
+	formatsM.RLock()
+	defer formatsM.RUnlock()
+	format, ok := formats[name]
+	return format, ok
+}
+
+// FormatCapability capability of encoding packets with a format
+func FormatCapability(name string) Capability {
+	return Capability("format/" + name)
+}
+
+// packetTypes packets sent as requests by kind
+var packetTypes = map[PacketKind]reflect.Type{
+	PacketKindHello:                 reflect.TypeOf(PacketHello{}),
+	PacketKindAuthorizationRequest:  reflect.TypeOf(PacketAuthorizationRequest{}),
+	PacketKindAuthorizationAnswer:   reflect.TypeOf(PacketAuthorizationAnswer{}),
+	PacketKindLogs:                  reflect.TypeOf(PacketLogs{}),
+	PacketKindMetricsStoreV2Request: reflect.TypeOf(PacketMetricsStoreV2Request{}),
+	PacketKindEntitiesDeltasRequest: reflect.TypeOf(PacketEntitiesDeltasRequest{}),
+	PacketKindEntitiesResyncRequest: reflect.TypeOf(PacketEntitiesResyncRequest{}),
+	PacketKindBye:                   reflect.TypeOf(PacketBye{}),
+	PacketKindAutomation:            reflect.TypeOf(PacketAutomation{}),
+	PacketKindAutomationFeedback:    reflect.TypeOf(PacketAutomationFeedbackRequest{}),
+	PacketKindRestart:               reflect.TypeOf(PacketRestart{}),
+	PacketKindRawStoreRequest:       reflect.TypeOf(json.RawMessage{}),
+	PacketKindLogLevel:              reflect.TypeOf(PacketLogLevel{}),
+	PacketKindConfig:                reflect.TypeOf(PacketConfig{}),
+	PacketKindChunk:                 reflect.TypeOf(PacketChunk{}),
+	PacketKindPing:                  reflect.TypeOf(PacketPing{}),
+}
+
+// NewPacket creates a pointer to an empty request packet of the kind
+func NewPacket(kind PacketKind) (interface{}, bool) {
+	packetType, ok := packetTypes[kind]
+	if !ok {
+		return nil, false
+	}
+	return reflect.New(packetType).Interface(), true
+}
+
+// responseTypes responses to request packets by kind, kinds not listed have no response
+var responseTypes = map[PacketKind]reflect.Type{
+	PacketKindHello:                 reflect.TypeOf(PacketHello{}),
+	PacketKindAuthorizationRequest:  reflect.TypeOf(PacketAuthorizationQuestion{}),
+	PacketKindAuthorizationAnswer:   reflect.TypeOf(PacketAuthorizationSuccess{}),
+	PacketKindPing:                  reflect.TypeOf(PacketPong{}),
+	PacketKindAutomation:            reflect.TypeOf(PacketAutomationResponse{}),
+	PacketKindEntitiesDeltasRequest: reflect.TypeOf(PacketEntitiesDeltasResponse{}),
+	PacketKindEntitiesResyncRequest: reflect.TypeOf(PacketEntitiesResyncResponse{}),
+	PacketKindChunk:                 reflect.TypeOf(PacketChunkResponse{}),
+	PacketKindConfig:                reflect.TypeOf(PacketConfigResponse{}),
+}
+
+// NewResponse creates a pointer to an empty response to a request packet of the kind
+func NewResponse(kind PacketKind) (interface{}, bool) {
+	responseType, ok := responseTypes[kind]
+	if !ok {
+		return nil, false
+	}
+	return reflect.New(responseType).Interface(), true
+}
+
+// Transcode re-encodes a request packet of the kind from a format to another one
+func Transcode(kind PacketKind, from Format, to Format, in []byte) ([]byte, error) {
+	if from.Name() == to.Name() {
+		return in, nil
+	}
+	packet, ok := NewPacket(kind)
+	if !ok {
+		return nil, fmt.Errorf("unknown packet kind %s", kind)
+	}
+	if err := from.Unmarshal(in, packet); err != nil {
+		return nil, fmt.Errorf("unable to decode %s packet from %s, error: %w", kind, from.Name(), err)
+	}
+	return to.Marshal(kind, reflect.ValueOf(packet).Elem().Interface())
+}
+
+// EncodePacket encodes a packet of the kind with the format and compresses it with the codec
+func EncodePacket(format Format, codec Codec, kind PacketKind, in interface{}) (out []byte, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			stack := string(debug.Stack())
+			err = fmt.Errorf("%s panic: %v", stack, r)
+		}
+	}()
+
+	encoded, err := format.Marshal(kind, in)
+	if err != nil {
+		return nil, fmt.Errorf("unable to encode to %s, error: %w", format.Name(), err)
+	}
+	return codec.Compress(encoded)
+}
+
+// DecodePacket decompresses a packet with the codec and decodes it with the format
+func DecodePacket(format Format, codec Codec, in []byte, out interface{}) error {
+	encoded, err := codec.Decompress(in)
+	if err != nil {
+		return fmt.Errorf("unable to decode from %s, error: %w", codec.Name(), err)
+	}
+	return format.Unmarshal(encoded, out)
+}
+
+type jsonFormat struct{}
+
+func (jsonFormat) Name() string {
+	return FormatJSON
+}
+
+func (jsonFormat) Marshal(kind PacketKind, in interface{}) ([]byte, error) {
+	return json.Marshal(in)
+}
+
+func (jsonFormat) Unmarshal(in []byte, out interface{}) error {
+	return json.Unmarshal(in, out)
+}
@@ -0,0 +1,160 @@
+package proto
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/MagalixTechnologies/uuid-go"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+func TestFormats_RoundTrip(t *testing.T) {
+	now := time.Date(2020, 10, 1, 12, 0, 0, 42, time.UTC)
+	cpu := int64(100)
+	message := "failed"
+	dryRun := false
+	gvrk := GroupVersionResourceKind{
+		GroupVersionResource: schema.GroupVersionResource{Group: "apps", Version: "v1", Resource: "deployments"},
+		Kind:                 "Deployment",
+	}
+	object := unstructured.Unstructured{Object: map[string]interface{}{
+		"kind":     "Deployment",
+		"metadata": map[string]interface{}{"name": "web"},
+	}}
+
+	tests := []struct {
+		name string
+		kind PacketKind
+		in   interface{}
+	}{
+		{
+			name: "hello",
+			kind: PacketKindHello,
+			in: PacketHello{
+				Major:        2,
+				Build:        "abc",
+				AccountID:    uuid.NewV4(),
+				Capabilities: Capabilities{CapabilityEnvelope},
+			},
+		},
+		{
+			name: "ping",
+			kind: PacketKindPing,
+			in:   PacketPing{Number: 3, Started: now},
+		},
+		{
+			name: "logs",
+			kind: PacketKindLogs,
+			in:   PacketLogs{{Date: now, Data: "line"}},
+		},
+		{
+			name: "metrics",
+			kind: PacketKindMetricsStoreV2Request,
+			in: PacketMetricsStoreV2Request{{
+				Name:           "cpu",
+				NodeName:       "node",
+				Timestamp:      now,
+				Value:          7,
+				AdditionalTags: map[string]interface{}{"zone": "a", "count": float64(2)},
+			}},
+		},
+		{
+			name: "automation",
+			kind: PacketKindAutomation,
+			in: PacketAutomation{
+				ID:                 "1",
+				ContainerResources: ContainerResources{Requests: &RequestLimit{CPU: &cpu}},
+			},
+		},
+		{
+			name: "automation response",
+			kind: PacketKindAutomation,
+			in:   PacketAutomationResponse{ID: "1", Error: &message},
+		},
+		{
+			name: "entities deltas",
+			kind: PacketKindEntitiesDeltasRequest,
+			in: PacketEntitiesDeltasRequest{
+				Items: []PacketEntityDelta{{
+					Gvrk:      gvrk,
+					DeltaKind: EntityEventTypeUpsert,
+					Data:      object,
+					Parent:    &ParentController{Kind: "ReplicaSet", Parent: &ParentController{Kind: "Deployment"}},
+					Timestamp: now,
+				}},
+				Timestamp: now,
+			},
+		},
+		{
+			name: "entities resync",
+			kind: PacketKindEntitiesResyncRequest,
+			in: PacketEntitiesResyncRequest{
+				Timestamp: now,
+				Snapshot: map[string]PacketEntitiesResyncItem{
+					"deployments": {Gvrk: gvrk, Data: []*unstructured.Unstructured{&object}},
+				},
+			},
+		},
+		{
+			name: "chunk",
+			kind: PacketKindChunk,
+			in:   PacketChunk{TransferID: "t", Kind: PacketKindLogs, Index: 1, Total: 2, Data: []byte("x"), Format: FormatProtobuf},
+		},
+		{
+			name: "config",
+			kind: PacketKindConfig,
+			in:   PacketConfig{Version: 3, DryRun: &dryRun, LogLevel: &message},
+		},
+		{
+			name: "config response",
+			kind: PacketKindConfig,
+			in:   PacketConfigResponse{Version: 3, MetricsInterval: 60, ExecutorWorkers: 5, LogLevel: "info", Errors: []string{"invalid"}},
+		},
+	}
+	for _, tt := range tests {
+		for _, name := range []string{FormatJSON, FormatProtobuf} {
+			t.Run(tt.name+"/"+name, func(t *testing.T) {
+				format, ok := GetFormat(name)
+				if !ok {
+					t.Fatalf("GetFormat(%s) format is not registered", name)
+				}
+				encoded, err := format.Marshal(tt.kind, tt.in)
+				if err != nil {
+					t.Fatalf("Marshal() error = %v", err)
+				}
+				out := reflect.New(reflect.TypeOf(tt.in))
+				if err := format.Unmarshal(encoded, out.Interface()); err != nil {
+					t.Fatalf("Unmarshal() error = %v", err)
+				}
+				if got := out.Elem().Interface(); !reflect.DeepEqual(got, tt.in) {
+					t.Errorf("Unmarshal() = %+v, want %+v", got, tt.in)
+				}
+			})
+		}
+	}
+}
+
+func TestTranscode(t *testing.T) {
+	jsonFormat, _ := GetFormat(FormatJSON)
+	protobufFormat, _ := GetFormat(FormatProtobuf)
+	in := PacketAutomationFeedbackRequest{ID: "1", Status: AutomationExecuted}
+
+	raw, err := json.Marshal(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encoded, err := Transcode(PacketKindAutomationFeedback, jsonFormat, protobufFormat, raw)
+	if err != nil {
+		t.Fatalf("Transcode() error = %v", err)
+	}
+	var out PacketAutomationFeedbackRequest
+	if err := protobufFormat.Unmarshal(encoded, &out); err != nil {
+		t.Fatalf("Unmarshal() error = %v", err)
+	}
+	if out != in {
+		t.Errorf("Unmarshal() = %+v, want %+v", out, in)
+	}
+}
@@ -25,6 +25,10 @@ const (
 	PacketKindRawStoreRequest PacketKind = "raw/store"
 
 	PacketKindLogLevel PacketKind = "loglevel"
+
+	PacketKindConfig PacketKind = "config"
+
+	PacketKindChunk PacketKind = "chunk"
 )
 
 const (
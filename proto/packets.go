@@ -6,12 +6,9 @@ import (
 	"bytes"
 	"encoding/gob"
 	"encoding/json"
-	"fmt"
-	"runtime/debug"
 	"time"
 
 	"github.com/MagalixTechnologies/uuid-go"
-	"github.com/golang/snappy"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime/schema"
 
@@ -40,6 +37,10 @@ type PacketHello struct {
 	PacketV2Enabled  bool      `json:"packet_v2_enabled,omitempty"`
 	ServerVersion    string    `json:"server_version"`
 	AgentPermissions string    `json:"agent_permissions"`
+
+	// Capabilities features supported by the sender
+	// empty for agent gateways that don't negotiate capabilities
+	Capabilities Capabilities `json:"capabilities,omitempty"`
 }
 
 type PacketAuthorizationRequest struct {
@@ -166,6 +167,27 @@ type PacketLogLevel struct {
 	Level string `json:"level"`
 }
 
+// PacketConfig runtime configuration pushed by the agent gateway, unset fields keep their current value
+type PacketConfig struct {
+	Version int64 `json:"version"`
+	// MetricsInterval in seconds
+	MetricsInterval *int64  `json:"metrics_interval,omitempty"`
+	DryRun          *bool   `json:"dry_run,omitempty"`
+	ExecutorWorkers *int32  `json:"executor_workers,omitempty"`
+	LogLevel        *string `json:"log_level,omitempty"`
+}
+
+// PacketConfigResponse effective runtime configuration, errors are set if the config was rejected
+type PacketConfigResponse struct {
+	Version int64 `json:"version"`
+	// MetricsInterval in seconds
+	MetricsInterval int64    `json:"metrics_interval"`
+	DryRun          bool     `json:"dry_run"`
+	ExecutorWorkers int32    `json:"executor_workers"`
+	LogLevel        string   `json:"log_level"`
+	Errors          []string `json:"errors,omitempty"`
+}
+
 type EntityDeltaKind string
 
 const (
@@ -215,6 +237,33 @@ type PacketEntitiesResyncRequest struct {
 }
 type PacketEntitiesResyncResponse struct{}
 
+// PacketChunk a part of a packet that is too large to be sent at once
+// parts of the same transfer are reassembled by the receiver and handled as a packet of Kind
+type PacketChunk struct {
+	TransferID string     `json:"transfer_id"`
+	Kind       PacketKind `json:"kind"`
+	Index      int        `json:"index"`
+	Total      int        `json:"total"`
+	// Data part of the packet encoded with Format
+	Data []byte `json:"data"`
+	// Format of the chunked packet, empty means json
+	Format string `json:"format,omitempty"`
+}
+
+type PacketChunkResponse struct{}
+
+// PacketEnvelope wraps a packet with an idempotency id
+// the agent gateway handles an id once, a retried packet is only acknowledged again
+type PacketEnvelope struct {
+	ID   string      `json:"id"`
+	Data interface{} `json:"data"`
+}
+
+// PacketEnvelopeAck response to an enveloped packet
+type PacketEnvelopeAck struct {
+	ID string `json:"id"`
+}
+
 // Deprecated: Fall back to EncodeGOB. Kept only for backward compatibility. Should be removed.
 func Encode(in interface{}) (out []byte, err error) {
 	return EncodeGOB(in)
@@ -226,27 +275,11 @@ func Decode(in []byte, out interface{}) error {
 }
 
 func EncodeSnappy(in interface{}) (out []byte, err error) {
-	defer func() {
-		if r := recover(); r != nil {
-			stack := string(debug.Stack())
-			err = fmt.Errorf("%s panic: %v", stack, r)
-		}
-	}()
-
-	jsonIn, err := json.Marshal(in)
-	if err != nil {
-		return nil, fmt.Errorf("unable to encode to snappy, error: %w", err)
-	}
-	out = snappy.Encode(nil, jsonIn)
-	return out, err
+	return EncodeWith(snappyCodec{}, in)
 }
 
 func DecodeSnappy(in []byte, out interface{}) error {
-	jsonIn, err := snappy.Decode(nil, in)
-	if err != nil {
-		return fmt.Errorf("unable to decode to snappy, error: %w", err)
-	}
-	return json.Unmarshal(jsonIn, out)
+	return DecodeWith(snappyCodec{}, in, out)
 }
 
 func DecodeGOB(in []byte, out interface{}) error {
@@ -0,0 +1,618 @@
+package proto
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"time"
+
+	"github.com/MagalixCorp/magalix-agent/v2/proto/pb"
+	"github.com/MagalixTechnologies/uuid-go"
+	protobuf "google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/structpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// protobufFormat encodes packets with the schema defined in pb/packets.proto
+type protobufFormat struct{}
+
+func (protobufFormat) Name() string {
+	return FormatProtobuf
+}
+
+func (f protobufFormat) Marshal(kind PacketKind, in interface{}) ([]byte, error) {
+	message, err := f.toMessage(kind, in)
+	if err != nil {
+		return nil, err
+	}
+	return protobuf.Marshal(message)
+}
+
+func (protobufFormat) Unmarshal(in []byte, out interface{}) error {
+	message, err := newMessage(out)
+	if err != nil {
+		return err
+	}
+	if err := protobuf.Unmarshal(in, message); err != nil {
+		return err
+	}
+	return fromMessage(message, out)
+}
+
+// toMessage converts a packet to its protobuf message
+// json.RawMessage packets are decoded as the packet type of the kind first
+func (f protobufFormat) toMessage(kind PacketKind, in interface{}) (protobuf.Message, error) {
+	if value := reflect.ValueOf(in); value.Kind() == reflect.Ptr && !value.IsNil() {
+		in = value.Elem().Interface()
+	}
+
+	switch in := in.(type) {
+	case json.RawMessage:
+		if kind == PacketKindRawStoreRequest {
+			return &pb.RawStoreRequest{Data: in}, nil
+		}
+		packet, ok := NewPacket(kind)
+		if !ok {
+			return nil, fmt.Errorf("unknown packet kind %q", kind)
+		}
+		if err := json.Unmarshal(in, packet); err != nil {
+			return nil, fmt.Errorf("unable to decode json %s packet, error: %w", kind, err)
+		}
+		return f.toMessage(kind, packet)
+	case PacketEnvelope:
+		data, err := f.Marshal(kind, in.Data)
+		if err != nil {
+			return nil, err
+		}
+		return &pb.Envelope{Id: in.ID, Data: data}, nil
+	case PacketEnvelopeAck:
+		return &pb.EnvelopeAck{Id: in.ID}, nil
+	case PacketHello:
+		capabilities := make([]string, len(in.Capabilities))
+		for i, capability := range in.Capabilities {
+			capabilities[i] = string(capability)
+		}
+		return &pb.Hello{
+			Major:            uint32(in.Major),
+			Minor:            uint32(in.Minor),
+			Build:            in.Build,
+			StartId:          in.StartID,
+			AccountId:        uuidBytes(in.AccountID),
+			ClusterId:        uuidBytes(in.ClusterID),
+			PacketV2Enabled:  in.PacketV2Enabled,
+			ServerVersion:    in.ServerVersion,
+			AgentPermissions: in.AgentPermissions,
+			Capabilities:     capabilities,
+		}, nil
+	case PacketAuthorizationRequest:
+		return &pb.AuthorizationRequest{
+			AccountId: uuidBytes(in.AccountID),
+			ClusterId: uuidBytes(in.ClusterID),
+		}, nil
+	case PacketAuthorizationQuestion:
+		return &pb.AuthorizationQuestion{Token: in.Token}, nil
+	case PacketAuthorizationAnswer:
+		return &pb.AuthorizationAnswer{Token: in.Token}, nil
+	case PacketAuthorizationSuccess:
+		return &pb.AuthorizationSuccess{}, nil
+	case PacketAuthorizationFailure:
+		return &pb.AuthorizationFailure{}, nil
+	case PacketBye:
+		return &pb.Bye{Reason: in.Reason}, nil
+	case PacketPing:
+		return &pb.Ping{Number: int64(in.Number), Started: timestamp(in.Started)}, nil
+	case PacketPong:
+		return &pb.Pong{Number: int64(in.Number), Started: timestamp(in.Started)}, nil
+	case PacketLogs:
+		items := make([]*pb.LogItem, len(in))
+		for i, item := range in {
+			items[i] = &pb.LogItem{Date: timestamp(item.Date), Data: item.Data}
+		}
+		return &pb.Logs{Items: items}, nil
+	case PacketMetricsStoreV2Request:
+		items := make([]*pb.Metric, len(in))
+		for i, metric := range in {
+			message, err := metricToMessage(metric)
+			if err != nil {
+				return nil, err
+			}
+			items[i] = message
+		}
+		return &pb.MetricsStoreV2Request{Items: items}, nil
+	case PacketAutomation:
+		return &pb.Automation{
+			Id:             in.ID,
+			NamespaceName:  in.NamespaceName,
+			ControllerName: in.ControllerName,
+			ControllerKind: in.ControllerKind,
+			ContainerName:  in.ContainerName,
+			ContainerResources: &pb.ContainerResources{
+				Requests: requestLimitToMessage(in.ContainerResources.Requests),
+				Limits:   requestLimitToMessage(in.ContainerResources.Limits),
+			},
+		}, nil
+	case PacketAutomationResponse:
+		return &pb.AutomationResponse{Id: in.ID, Error: in.Error}, nil
+	case PacketAutomationFeedbackRequest:
+		return &pb.AutomationFeedbackRequest{
+			Id:             in.ID,
+			NamespaceName:  in.NamespaceName,
+			ControllerName: in.ControllerName,
+			ControllerKind: in.ControllerKind,
+			ContainerName:  in.ContainerName,
+			Status:         string(in.Status),
+			Message:        in.Message,
+		}, nil
+	case PacketRestart:
+		return &pb.Restart{Status: int64(in.Status)}, nil
+	case PacketLogLevel:
+		return &pb.LogLevel{Level: in.Level}, nil
+	case PacketConfig:
+		return &pb.Config{
+			Version:         in.Version,
+			MetricsInterval: in.MetricsInterval,
+			DryRun:          in.DryRun,
+			ExecutorWorkers: in.ExecutorWorkers,
+			LogLevel:        in.LogLevel,
+		}, nil
+	case PacketConfigResponse:
+		return &pb.ConfigResponse{
+			Version:         in.Version,
+			MetricsInterval: in.MetricsInterval,
+			DryRun:          in.DryRun,
+			ExecutorWorkers: in.ExecutorWorkers,
+			LogLevel:        in.LogLevel,
+			Errors:          in.Errors,
+		}, nil
+	case PacketEntitiesDeltasRequest:
+		items := make([]*pb.EntityDelta, len(in.Items))
+		for i, delta := range in.Items {
+			data, err := objectToBytes(&delta.Data)
+			if err != nil {
+				return nil, err
+			}
+			items[i] = &pb.EntityDelta{
+				Gvrk:      gvrkToMessage(delta.Gvrk),
+				DeltaKind: string(delta.DeltaKind),
+				Data:      data,
+				Parent:    parentToMessage(delta.Parent),
+				Timestamp: timestamp(delta.Timestamp),
+			}
+		}
+		return &pb.EntitiesDeltasRequest{Items: items, Timestamp: timestamp(in.Timestamp)}, nil
+	case PacketEntitiesDeltasResponse:
+		return &pb.EntitiesDeltasResponse{}, nil
+	case PacketEntitiesResyncRequest:
+		snapshot := make(map[string]*pb.EntitiesResyncItem, len(in.Snapshot))
+		for name, item := range in.Snapshot {
+			data := make([][]byte, len(item.Data))
+			for i, object := range item.Data {
+				encoded, err := objectToBytes(object)
+				if err != nil {
+					return nil, err
+				}
+				data[i] = encoded
+			}
+			snapshot[name] = &pb.EntitiesResyncItem{Gvrk: gvrkToMessage(item.Gvrk), Data: data}
+		}
+		return &pb.EntitiesResyncRequest{Timestamp: timestamp(in.Timestamp), Snapshot: snapshot}, nil
+	case PacketEntitiesResyncResponse:
+		return &pb.EntitiesResyncResponse{}, nil
+	case PacketChunk:
+		return &pb.Chunk{
+			TransferId: in.TransferID,
+			Kind:       in.Kind.String(),
+			Index:      int64(in.Index),
+			Total:      int64(in.Total),
+			Data:       in.Data,
+			Format:     in.Format,
+		}, nil
+	case PacketChunkResponse:
+		return &pb.ChunkResponse{}, nil
+	}
+	return nil, fmt.Errorf("packet %T of kind %q has no protobuf schema", in, kind)
+}
+
+// newMessage creates an empty protobuf message for a packet
+func newMessage(out interface{}) (protobuf.Message, error) {
+	switch out.(type) {
+	case *json.RawMessage:
+		return &pb.RawStoreRequest{}, nil
+	case *PacketEnvelope:
+		return &pb.Envelope{}, nil
+	case *PacketEnvelopeAck:
+		return &pb.EnvelopeAck{}, nil
+	case *PacketHello:
+		return &pb.Hello{}, nil
+	case *PacketAuthorizationRequest:
+		return &pb.AuthorizationRequest{}, nil
+	case *PacketAuthorizationQuestion:
+		return &pb.AuthorizationQuestion{}, nil
+	case *PacketAuthorizationAnswer:
+		return &pb.AuthorizationAnswer{}, nil
+	case *PacketAuthorizationSuccess:
+		return &pb.AuthorizationSuccess{}, nil
+	case *PacketAuthorizationFailure:
+		return &pb.AuthorizationFailure{}, nil
+	case *PacketBye:
+		return &pb.Bye{}, nil
+	case *PacketPing:
+		return &pb.Ping{}, nil
+	case *PacketPong:
+		return &pb.Pong{}, nil
+	case *PacketLogs:
+		return &pb.Logs{}, nil
+	case *PacketMetricsStoreV2Request:
+		return &pb.MetricsStoreV2Request{}, nil
+	case *PacketAutomation:
+		return &pb.Automation{}, nil
+	case *PacketAutomationResponse:
+		return &pb.AutomationResponse{}, nil
+	case *PacketAutomationFeedbackRequest:
+		return &pb.AutomationFeedbackRequest{}, nil
+	case *PacketRestart:
+		return &pb.Restart{}, nil
+	case *PacketLogLevel:
+		return &pb.LogLevel{}, nil
+	case *PacketConfig:
+		return &pb.Config{}, nil
+	case *PacketConfigResponse:
+		return &pb.ConfigResponse{}, nil
+	case *PacketEntitiesDeltasRequest:
+		return &pb.EntitiesDeltasRequest{}, nil
+	case *PacketEntitiesDeltasResponse:
+		return &pb.EntitiesDeltasResponse{}, nil
+	case *PacketEntitiesResyncRequest:
+		return &pb.EntitiesResyncRequest{}, nil
+	case *PacketEntitiesResyncResponse:
+		return &pb.EntitiesResyncResponse{}, nil
+	case *PacketChunk:
+		return &pb.Chunk{}, nil
+	case *PacketChunkResponse:
+		return &pb.ChunkResponse{}, nil
+	}
+	return nil, fmt.Errorf("packet %T has no protobuf schema", out)
+}
+
+// fromMessage converts a protobuf message created by newMessage to the packet
+func fromMessage(message protobuf.Message, out interface{}) error {
+	switch out := out.(type) {
+	case *json.RawMessage:
+		*out = message.(*pb.RawStoreRequest).Data
+	case *PacketEnvelope:
+		m := message.(*pb.Envelope)
+		// the wrapped packet is kept encoded, its type is known only by its kind
+		*out = PacketEnvelope{ID: m.Id, Data: m.Data}
+	case *PacketEnvelopeAck:
+		*out = PacketEnvelopeAck{ID: message.(*pb.EnvelopeAck).Id}
+	case *PacketHello:
+		m := message.(*pb.Hello)
+		accountID, err := uuidFromBytes(m.AccountId)
+		if err != nil {
+			return err
+		}
+		clusterID, err := uuidFromBytes(m.ClusterId)
+		if err != nil {
+			return err
+		}
+		var capabilities Capabilities
+		for _, capability := range m.Capabilities {
+			capabilities = append(capabilities, Capability(capability))
+		}
+		*out = PacketHello{
+			Major:            uint(m.Major),
+			Minor:            uint(m.Minor),
+			Build:            m.Build,
+			StartID:          m.StartId,
+			AccountID:        accountID,
+			ClusterID:        clusterID,
+			PacketV2Enabled:  m.PacketV2Enabled,
+			ServerVersion:    m.ServerVersion,
+			AgentPermissions: m.AgentPermissions,
+			Capabilities:     capabilities,
+		}
+	case *PacketAuthorizationRequest:
+		m := message.(*pb.AuthorizationRequest)
+		accountID, err := uuidFromBytes(m.AccountId)
+		if err != nil {
+			return err
+		}
+		clusterID, err := uuidFromBytes(m.ClusterId)
+		if err != nil {
+			return err
+		}
+		*out = PacketAuthorizationRequest{AccountID: accountID, ClusterID: clusterID}
+	case *PacketAuthorizationQuestion:
+		*out = PacketAuthorizationQuestion{Token: message.(*pb.AuthorizationQuestion).Token}
+	case *PacketAuthorizationAnswer:
+		*out = PacketAuthorizationAnswer{Token: message.(*pb.AuthorizationAnswer).Token}
+	case *PacketAuthorizationSuccess, *PacketAuthorizationFailure:
+	case *PacketBye:
+		*out = PacketBye{Reason: message.(*pb.Bye).Reason}
+	case *PacketPing:
+		m := message.(*pb.Ping)
+		*out = PacketPing{Number: int(m.Number), Started: fromTimestamp(m.Started)}
+	case *PacketPong:
+		m := message.(*pb.Pong)
+		*out = PacketPong{Number: int(m.Number), Started: fromTimestamp(m.Started)}
+	case *PacketLogs:
+		m := message.(*pb.Logs)
+		logs := make(PacketLogs, len(m.Items))
+		for i, item := range m.Items {
+			logs[i] = PacketLogItem{Date: fromTimestamp(item.Date), Data: item.Data}
+		}
+		*out = logs
+	case *PacketMetricsStoreV2Request:
+		m := message.(*pb.MetricsStoreV2Request)
+		metrics := make(PacketMetricsStoreV2Request, len(m.Items))
+		for i, item := range m.Items {
+			metrics[i] = metricFromMessage(item)
+		}
+		*out = metrics
+	case *PacketAutomation:
+		m := message.(*pb.Automation)
+		*out = PacketAutomation{
+			ID:             m.Id,
+			NamespaceName:  m.NamespaceName,
+			ControllerName: m.ControllerName,
+			ControllerKind: m.ControllerKind,
+			ContainerName:  m.ContainerName,
+			ContainerResources: ContainerResources{
+				Requests: requestLimitFromMessage(m.ContainerResources.GetRequests()),
+				Limits:   requestLimitFromMessage(m.ContainerResources.GetLimits()),
+			},
+		}
+	case *PacketAutomationResponse:
+		m := message.(*pb.AutomationResponse)
+		*out = PacketAutomationResponse{ID: m.Id, Error: m.Error}
+	case *PacketAutomationFeedbackRequest:
+		m := message.(*pb.AutomationFeedbackRequest)
+		*out = PacketAutomationFeedbackRequest{
+			ID:             m.Id,
+			NamespaceName:  m.NamespaceName,
+			ControllerName: m.ControllerName,
+			ControllerKind: m.ControllerKind,
+			ContainerName:  m.ContainerName,
+			Status:         AutomationStatus(m.Status),
+			Message:        m.Message,
+		}
+	case *PacketRestart:
+		*out = PacketRestart{Status: int(message.(*pb.Restart).Status)}
+	case *PacketLogLevel:
+		*out = PacketLogLevel{Level: message.(*pb.LogLevel).Level}
+	case *PacketConfig:
+		m := message.(*pb.Config)
+		*out = PacketConfig{
+			Version:         m.Version,
+			MetricsInterval: m.MetricsInterval,
+			DryRun:          m.DryRun,
+			ExecutorWorkers: m.ExecutorWorkers,
+			LogLevel:        m.LogLevel,
+		}
+	case *PacketConfigResponse:
+		m := message.(*pb.ConfigResponse)
+		*out = PacketConfigResponse{
+			Version:         m.Version,
+			MetricsInterval: m.MetricsInterval,
+			DryRun:          m.DryRun,
+			ExecutorWorkers: m.ExecutorWorkers,
+			LogLevel:        m.LogLevel,
+			Errors:          m.Errors,
+		}
+	case *PacketEntitiesDeltasRequest:
+		m := message.(*pb.EntitiesDeltasRequest)
+		items := make([]PacketEntityDelta, len(m.Items))
+		for i, item := range m.Items {
+			object, err := objectFromBytes(item.Data)
+			if err != nil {
+				return err
+			}
+			items[i] = PacketEntityDelta{
+				Gvrk:      gvrkFromMessage(item.Gvrk),
+				DeltaKind: EntityDeltaKind(item.DeltaKind),
+				Parent:    parentFromMessage(item.Parent),
+				Timestamp: fromTimestamp(item.Timestamp),
+			}
+			if object != nil {
+				items[i].Data = *object
+			}
+		}
+		*out = PacketEntitiesDeltasRequest{Items: items, Timestamp: fromTimestamp(m.Timestamp)}
+	case *PacketEntitiesDeltasResponse, *PacketEntitiesResyncResponse, *PacketChunkResponse:
+	case *PacketEntitiesResyncRequest:
+		m := message.(*pb.EntitiesResyncRequest)
+		snapshot := make(map[string]PacketEntitiesResyncItem, len(m.Snapshot))
+		for name, item := range m.Snapshot {
+			objects := make([]*unstructured.Unstructured, len(item.Data))
+			for i, data := range item.Data {
+				object, err := objectFromBytes(data)
+				if err != nil {
+					return err
+				}
+				objects[i] = object
+			}
+			snapshot[name] = PacketEntitiesResyncItem{Gvrk: gvrkFromMessage(item.Gvrk), Data: objects}
+		}
+		*out = PacketEntitiesResyncRequest{Timestamp: fromTimestamp(m.Timestamp), Snapshot: snapshot}
+	case *PacketChunk:
+		m := message.(*pb.Chunk)
+		*out = PacketChunk{
+			TransferID: m.TransferId,
+			Kind:       PacketKind(m.Kind),
+			Index:      int(m.Index),
+			Total:      int(m.Total),
+			Data:       m.Data,
+			Format:     m.Format,
+		}
+	default:
+		return fmt.Errorf("packet %T has no protobuf schema", out)
+	}
+	return nil
+}
+
+func metricToMessage(metric MetricStoreV2Request) (*pb.Metric, error) {
+	message := &pb.Metric{
+		Name:           metric.Name,
+		Type:           metric.Type,
+		NodeName:       metric.NodeName,
+		NodeIp:         metric.NodeIP,
+		NamespaceName:  metric.NamespaceName,
+		ControllerName: metric.ControllerName,
+		ControllerKind: metric.ControllerKind,
+		ContainerName:  metric.ContainerName,
+		Timestamp:      timestamp(metric.Timestamp),
+		Value:          metric.Value,
+		PodName:        metric.PodName,
+	}
+	if metric.AdditionalTags != nil {
+		tags, err := structpb.NewStruct(metric.AdditionalTags)
+		if err != nil {
+			// tags of types unknown to structpb are normalized to json types
+			tags, err = normalizedStruct(metric.AdditionalTags)
+			if err != nil {
+				return nil, fmt.Errorf("unable to encode additional tags of metric %s, error: %w", metric.Name, err)
+			}
+		}
+		message.AdditionalTags = tags
+	}
+	return message, nil
+}
+
+func metricFromMessage(message *pb.Metric) MetricStoreV2Request {
+	metric := MetricStoreV2Request{
+		Name:           message.Name,
+		Type:           message.Type,
+		NodeName:       message.NodeName,
+		NodeIP:         message.NodeIp,
+		NamespaceName:  message.NamespaceName,
+		ControllerName: message.ControllerName,
+		ControllerKind: message.ControllerKind,
+		ContainerName:  message.ContainerName,
+		Timestamp:      fromTimestamp(message.Timestamp),
+		Value:          message.Value,
+		PodName:        message.PodName,
+	}
+	if message.AdditionalTags != nil {
+		metric.AdditionalTags = message.AdditionalTags.AsMap()
+	}
+	return metric
+}
+
+func normalizedStruct(in map[string]interface{}) (*structpb.Struct, error) {
+	data, err := json.Marshal(in)
+	if err != nil {
+		return nil, err
+	}
+	var normalized map[string]interface{}
+	if err := json.Unmarshal(data, &normalized); err != nil {
+		return nil, err
+	}
+	return structpb.NewStruct(normalized)
+}
+
+func requestLimitToMessage(limit *RequestLimit) *pb.RequestLimit {
+	if limit == nil {
+		return nil
+	}
+	return &pb.RequestLimit{Cpu: limit.CPU, Memory: limit.Memory}
+}
+
+func requestLimitFromMessage(message *pb.RequestLimit) *RequestLimit {
+	if message == nil {
+		return nil
+	}
+	return &RequestLimit{CPU: message.Cpu, Memory: message.Memory}
+}
+
+func gvrkToMessage(gvrk GroupVersionResourceKind) *pb.GroupVersionResourceKind {
+	return &pb.GroupVersionResourceKind{
+		Group:    gvrk.Group,
+		Version:  gvrk.Version,
+		Resource: gvrk.Resource,
+		Kind:     gvrk.Kind,
+	}
+}
+
+func gvrkFromMessage(message *pb.GroupVersionResourceKind) GroupVersionResourceKind {
+	return GroupVersionResourceKind{
+		GroupVersionResource: schema.GroupVersionResource{
+			Group:    message.GetGroup(),
+			Version:  message.GetVersion(),
+			Resource: message.GetResource(),
+		},
+		Kind: message.GetKind(),
+	}
+}
+
+func parentToMessage(parent *ParentController) *pb.ParentController {
+	if parent == nil {
+		return nil
+	}
+	return &pb.ParentController{
+		Kind:       parent.Kind,
+		Name:       parent.Name,
+		ApiVersion: parent.APIVersion,
+		IsWatched:  parent.IsWatched,
+		Parent:     parentToMessage(parent.Parent),
+	}
+}
+
+func parentFromMessage(message *pb.ParentController) *ParentController {
+	if message == nil {
+		return nil
+	}
+	return &ParentController{
+		Kind:       message.Kind,
+		Name:       message.Name,
+		APIVersion: message.ApiVersion,
+		IsWatched:  message.IsWatched,
+		Parent:     parentFromMessage(message.Parent),
+	}
+}
+
+// objectToBytes encodes a kubernetes object to json, nil objects are empty
+func objectToBytes(object *unstructured.Unstructured) ([]byte, error) {
+	if object == nil || object.Object == nil {
+		return nil, nil
+	}
+	return json.Marshal(object.Object)
+}
+
+func objectFromBytes(data []byte) (*unstructured.Unstructured, error) {
+	if len(data) == 0 {
+		return nil, nil
+	}
+	object := &unstructured.Unstructured{}
+	if err := json.Unmarshal(data, &object.Object); err != nil {
+		return nil, fmt.Errorf("unable to decode kubernetes object, error: %w", err)
+	}
+	return object, nil
+}
+
+// timestamp converts a time to a protobuf timestamp, zero time is nil
+func timestamp(t time.Time) *timestamppb.Timestamp {
+	if t.IsZero() {
+		return nil
+	}
+	return timestamppb.New(t)
+}
+
+func fromTimestamp(ts *timestamppb.Timestamp) time.Time {
+	if ts == nil {
+		return time.Time{}
+	}
+	return ts.AsTime()
+}
+
+func uuidBytes(id uuid.UUID) []byte {
+	return id[:]
+}
+
+func uuidFromBytes(data []byte) (uuid.UUID, error) {
+	if len(data) == 0 {
+		return uuid.Nil, nil
+	}
+	return uuid.FromBytes(data)
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"context"
+	"os"
+
+	"github.com/MagalixCorp/magalix-agent/v2/client"
+	"github.com/MagalixTechnologies/core/logger"
+	"github.com/MagalixTechnologies/uuid-go"
+)
+
+// replay uploads spool files written in air-gapped mode to the agent gateway
+func replay(
+	args map[string]interface{},
+	accountID uuid.UUID,
+	clusterID uuid.UUID,
+	authenticator client.Authenticator,
+	proxy *client.ProxyConfig,
+	giveUpPolicy client.GiveUpPolicy,
+) {
+	spoolDir := args["--spool-dir"].(string)
+	mgxGateway := getGateway(
+		args,
+		accountID,
+		clusterID,
+		authenticator,
+		"",
+		"",
+		client.NewDefaultPipeStore(),
+		nil,
+		proxy,
+		giveUpPolicy,
+	)
+
+	err := mgxGateway.Replay(context.Background(), spoolDir)
+	if err != nil {
+		logger.Fatalw("unable to replay spool files", "dir", spoolDir, "error", err)
+		os.Exit(1)
+	}
+	logger.Infow("spool files have been replayed", "dir", spoolDir)
+}
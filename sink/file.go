@@ -0,0 +1,87 @@
+package sink
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/MagalixCorp/magalix-agent/v2/agent"
+)
+
+// File writes records as json lines appended to a file
+type File struct {
+	sync.Mutex
+	path    string
+	file    *os.File
+	encoder *json.Encoder
+	// closed is set once the file is closed on stop, writes are refused so the file isn't reopened and leaked
+	closed bool
+}
+
+// NewFile creates a file sink, the file is opened on the first write
+func NewFile(path string) *File {
+	return &File{path: path}
+}
+
+func (f *File) Name() string {
+	return "file:" + f.path
+}
+
+// Start closes the file when the context is done, later writes are refused
+func (f *File) Start(ctx context.Context) error {
+	<-ctx.Done()
+
+	f.Lock()
+	defer f.Unlock()
+	f.closed = true
+	if f.file == nil {
+		return nil
+	}
+	err := f.file.Close()
+	f.file, f.encoder = nil, nil
+	return err
+}
+
+// Sync flushes written records to disk
+func (f *File) Sync(ctx context.Context) error {
+	f.Lock()
+	defer f.Unlock()
+	if f.file == nil {
+		return nil
+	}
+	return f.file.Sync()
+}
+
+func (f *File) SendMetrics(metrics []*agent.Metric) error {
+	return f.write(Record{Type: RecordTypeMetrics, Timestamp: time.Now().UTC(), Metrics: metrics})
+}
+
+func (f *File) SendEntitiesDeltas(deltas []*agent.Delta) error {
+	return f.write(Record{Type: RecordTypeDeltas, Timestamp: time.Now().UTC(), Deltas: deltas})
+}
+
+func (f *File) SendEntitiesResync(resync *agent.EntitiesResync) error {
+	return f.write(Record{Type: RecordTypeResync, Timestamp: time.Now().UTC(), Resync: resync})
+}
+
+func (f *File) write(record Record) error {
+	f.Lock()
+	defer f.Unlock()
+	if f.closed {
+		return fmt.Errorf("sink file %s is closed", f.path)
+	}
+	if f.file == nil {
+		file, err := os.OpenFile(f.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+		if err != nil {
+			return fmt.Errorf("unable to open sink file, error: %w", err)
+		}
+		f.file, f.encoder = file, json.NewEncoder(file)
+	}
+	if err := f.encoder.Encode(record); err != nil {
+		return fmt.Errorf("unable to write to sink file, error: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,35 @@
+package sink
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFile_WriteAfterStop(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sink")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := NewFile(filepath.Join(dir, "records.json"))
+	if err := file.SendEntitiesDeltas(nil); err != nil {
+		t.Fatalf("File.SendEntitiesDeltas() error = %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := file.Start(ctx); err != nil {
+		t.Fatalf("File.Start() error = %v", err)
+	}
+
+	if err := file.SendEntitiesDeltas(nil); err == nil {
+		t.Errorf("File.SendEntitiesDeltas() after stop error = nil, want an error")
+	}
+	if file.file != nil {
+		t.Errorf("File.SendEntitiesDeltas() after stop reopened the file")
+	}
+}
@@ -0,0 +1,193 @@
+package sink
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/MagalixCorp/magalix-agent/v2/agent"
+)
+
+const (
+	// prometheusNamespace prefix of exposed metric names
+	prometheusNamespace = "magalix_"
+	// prometheusContentType version 0.0.4 of the prometheus text format
+	prometheusContentType = "text/plain; version=0.0.4; charset=utf-8"
+)
+
+var prometheusInvalidChars = regexp.MustCompile(`[^a-zA-Z0-9_]`)
+
+// prometheusSeries a metric value with its labels, labels are sorted by name
+type prometheusSeries struct {
+	name   string
+	labels [][2]string
+	value  int64
+}
+
+// Prometheus keeps the latest metric values and exposes them in prometheus text format,
+// deltas and resyncs are ignored
+// a batch replaces all values of the metric types it contains, so series of removed entities disappear
+type Prometheus struct {
+	sync.RWMutex
+	// series by metric type and series key
+	series map[string]map[string]prometheusSeries
+}
+
+// NewPrometheus creates a prometheus sink
+func NewPrometheus() *Prometheus {
+	return &Prometheus{series: map[string]map[string]prometheusSeries{}}
+}
+
+func (p *Prometheus) Name() string {
+	return "prometheus"
+}
+
+func (p *Prometheus) Start(ctx context.Context) error {
+	return nil
+}
+
+func (p *Prometheus) Sync(ctx context.Context) error {
+	return nil
+}
+
+func (p *Prometheus) SendMetrics(metrics []*agent.Metric) error {
+	batch := map[string]map[string]prometheusSeries{}
+	for _, metric := range metrics {
+		series := newPrometheusSeries(metric)
+		byKey, ok := batch[metric.Type]
+		if !ok {
+			byKey = map[string]prometheusSeries{}
+			batch[metric.Type] = byKey
+		}
+		byKey[series.key()] = series
+	}
+
+	p.Lock()
+	defer p.Unlock()
+	for metricType, byKey := range batch {
+		p.series[metricType] = byKey
+	}
+	return nil
+}
+
+func (p *Prometheus) SendEntitiesDeltas(deltas []*agent.Delta) error {
+	return nil
+}
+
+func (p *Prometheus) SendEntitiesResync(resync *agent.EntitiesResync) error {
+	return nil
+}
+
+// ServeHTTP writes the latest values in prometheus text format
+func (p *Prometheus) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	p.RLock()
+	families := map[string][]prometheusSeries{}
+	for _, byKey := range p.series {
+		for _, series := range byKey {
+			families[series.name] = append(families[series.name], series)
+		}
+	}
+	p.RUnlock()
+
+	names := make([]string, 0, len(families))
+	for name := range families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	w.Header().Set("Content-Type", prometheusContentType)
+	writer := bufio.NewWriter(w)
+	for _, name := range names {
+		family := families[name]
+		sort.Slice(family, func(i, j int) bool {
+			return family[i].key() < family[j].key()
+		})
+		fmt.Fprintf(writer, "# TYPE %s gauge\n", name)
+		for _, series := range family {
+			writer.WriteString(series.key())
+			writer.WriteByte(' ')
+			writer.WriteString(strconv.FormatInt(series.value, 10))
+			writer.WriteByte('\n')
+		}
+	}
+	_ = writer.Flush()
+}
+
+// newPrometheusSeries converts a metric, additional tags conflicting with metric fields are prefixed with tag_
+func newPrometheusSeries(metric *agent.Metric) prometheusSeries {
+	labels := map[string]string{}
+	set := func(name string, value string) {
+		if value != "" {
+			labels[name] = value
+		}
+	}
+	set("type", metric.Type)
+	set("node", metric.NodeName)
+	set("node_ip", metric.NodeIP)
+	set("namespace", metric.NamespaceName)
+	set("controller", metric.ControllerName)
+	set("controller_kind", metric.ControllerKind)
+	set("container", metric.ContainerName)
+	set("pod", metric.PodName)
+	for key, value := range metric.AdditionalTags {
+		name := prometheusName(key)
+		if _, ok := labels[name]; ok {
+			name = "tag_" + name
+		}
+		set(name, fmt.Sprint(value))
+	}
+
+	series := prometheusSeries{
+		name:  prometheusNamespace + prometheusName(metric.Name),
+		value: metric.Value,
+	}
+	for name, value := range labels {
+		series.labels = append(series.labels, [2]string{name, value})
+	}
+	sort.Slice(series.labels, func(i, j int) bool {
+		return series.labels[i][0] < series.labels[j][0]
+	})
+	return series
+}
+
+// key the series as written in the text format without its value, it identifies the series
+func (s prometheusSeries) key() string {
+	if len(s.labels) == 0 {
+		return s.name
+	}
+	var builder strings.Builder
+	builder.WriteString(s.name)
+	builder.WriteByte('{')
+	for i, label := range s.labels {
+		if i > 0 {
+			builder.WriteByte(',')
+		}
+		builder.WriteString(label[0])
+		builder.WriteString(`="`)
+		builder.WriteString(prometheusLabelValue(label[1]))
+		builder.WriteByte('"')
+	}
+	builder.WriteByte('}')
+	return builder.String()
+}
+
+// prometheusName converts a name to a valid prometheus metric or label name, e.g. cpu/usage to cpu_usage
+func prometheusName(name string) string {
+	name = prometheusInvalidChars.ReplaceAllString(name, "_")
+	if name != "" && name[0] >= '0' && name[0] <= '9' {
+		name = "_" + name
+	}
+	return name
+}
+
+var prometheusLabelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func prometheusLabelValue(value string) string {
+	return prometheusLabelEscaper.Replace(value)
+}
@@ -0,0 +1,70 @@
+package sink
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/MagalixCorp/magalix-agent/v2/agent"
+)
+
+func TestPrometheus(t *testing.T) {
+	tests := []struct {
+		name    string
+		batches [][]*agent.Metric
+		want    string
+	}{
+		{
+			name: "labels from metric fields and tags",
+			batches: [][]*agent.Metric{{
+				{
+					Name:           "cpu/usage_rate",
+					Type:           "pod_container",
+					NodeName:       "node-1",
+					NamespaceName:  "default",
+					ControllerName: "web",
+					ContainerName:  "nginx",
+					PodName:        "web-1",
+					AdditionalTags: map[string]interface{}{"pod": "conflict", "qos": `a"b`},
+					Value:          42,
+				},
+			}},
+			want: "# TYPE magalix_cpu_usage_rate gauge\n" +
+				`magalix_cpu_usage_rate{container="nginx",controller="web",namespace="default",node="node-1",pod="web-1",qos="a\"b",tag_pod="conflict",type="pod_container"} 42` + "\n",
+		},
+		{
+			name: "batch replaces values of its types only",
+			batches: [][]*agent.Metric{
+				{
+					{Name: "memory/usage", Type: "node", NodeName: "node-1", Value: 1},
+					{Name: "memory/usage", Type: "node", NodeName: "node-2", Value: 2},
+				},
+				{
+					{Name: "runtime/goroutines", Type: "agent", Value: 10},
+				},
+				{
+					{Name: "memory/usage", Type: "node", NodeName: "node-2", Value: 3},
+				},
+			},
+			want: "# TYPE magalix_memory_usage gauge\n" +
+				`magalix_memory_usage{node="node-2",type="node"} 3` + "\n" +
+				"# TYPE magalix_runtime_goroutines gauge\n" +
+				`magalix_runtime_goroutines{type="agent"} 10` + "\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			prometheus := NewPrometheus()
+			for _, batch := range tt.batches {
+				if err := prometheus.SendMetrics(batch); err != nil {
+					t.Fatalf("SendMetrics() error = %v", err)
+				}
+			}
+
+			recorder := httptest.NewRecorder()
+			prometheus.ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+			if got := recorder.Body.String(); got != tt.want {
+				t.Errorf("ServeHTTP() =\n%s\nwant\n%s", got, tt.want)
+			}
+		})
+	}
+}
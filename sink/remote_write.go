@@ -0,0 +1,285 @@
+package sink
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/MagalixCorp/magalix-agent/v2/agent"
+	"github.com/MagalixTechnologies/core/logger"
+	"github.com/golang/snappy"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+const (
+	remoteWriteBackoff    = time.Second
+	remoteWriteMaxBackoff = time.Minute
+	remoteWriteVersion    = "0.1.0"
+)
+
+// RemoteWrite pushes metrics to a prometheus remote write endpoint, deltas and resyncs are ignored
+// metrics are split in the batches sent to the gateway, each batch is a snappy compressed WriteRequest
+// failed requests are retried with backoff in order, the oldest requests are dropped when the retry queue is full
+type RemoteWrite struct {
+	sync.Mutex
+	url            string
+	client         *http.Client
+	externalLabels [][2]string
+	size           int
+	// backoff of the first retry, doubled on each retry
+	backoff time.Duration
+	// pending compressed requests, oldest first
+	pending [][]byte
+	// wake is signaled when a request is queued
+	wake    chan struct{}
+	sending bool
+	dropped int
+}
+
+// NewRemoteWrite creates a remote write sink queuing up to size requests, requests time out after timeout
+// external labels are added to every series unless it has a label with the same name
+func NewRemoteWrite(rawURL string, timeout time.Duration, size int, externalLabels map[string]string) (*RemoteWrite, error) {
+	parsed, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid remote write url, error: %w", err)
+	}
+	if parsed.Scheme != "http" && parsed.Scheme != "https" {
+		return nil, fmt.Errorf("unsupported remote write url scheme %s", parsed.Scheme)
+	}
+	if size <= 0 {
+		size = 1
+	}
+
+	remoteWrite := &RemoteWrite{
+		url:     rawURL,
+		client:  &http.Client{Timeout: timeout},
+		size:    size,
+		backoff: remoteWriteBackoff,
+		wake:    make(chan struct{}, 1),
+	}
+	for name, value := range externalLabels {
+		if name == "" || prometheusName(name) != name {
+			return nil, fmt.Errorf("invalid external label name %q", name)
+		}
+		remoteWrite.externalLabels = append(remoteWrite.externalLabels, [2]string{name, value})
+	}
+	return remoteWrite, nil
+}
+
+func (r *RemoteWrite) Name() string {
+	return "remote-write:" + r.url
+}
+
+// Start sends queued requests until the context is done
+func (r *RemoteWrite) Start(ctx context.Context) error {
+	backoff := r.backoff
+	for {
+		body, ok := r.next()
+		if !ok {
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-r.wake:
+				continue
+			}
+		}
+
+		retry, err := r.post(ctx, body)
+		if err == nil || !retry {
+			if err != nil {
+				logger.Errorw("remote write request rejected, dropping it", "url", r.url, "error", err)
+			}
+			r.done()
+			backoff = r.backoff
+			continue
+		}
+
+		logger.Warnw("unable to send remote write request, retrying", "url", r.url, "backoff", backoff, "error", err)
+		r.Lock()
+		r.sending = false
+		r.Unlock()
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > remoteWriteMaxBackoff {
+			backoff = remoteWriteMaxBackoff
+		}
+	}
+}
+
+// Sync waits until queued requests are sent
+func (r *RemoteWrite) Sync(ctx context.Context) error {
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		r.Lock()
+		idle := len(r.pending) == 0
+		r.Unlock()
+		if idle {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+func (r *RemoteWrite) SendMetrics(metrics []*agent.Metric) error {
+	now := time.Now()
+	for _, batch := range agent.MetricsBatches(metrics, agent.MetricsBatchMaxSize) {
+		r.enqueue(snappy.Encode(nil, encodeWriteRequest(batch, r.externalLabels, now)))
+	}
+	return nil
+}
+
+func (r *RemoteWrite) SendEntitiesDeltas(deltas []*agent.Delta) error {
+	return nil
+}
+
+func (r *RemoteWrite) SendEntitiesResync(resync *agent.EntitiesResync) error {
+	return nil
+}
+
+func (r *RemoteWrite) enqueue(body []byte) {
+	r.Lock()
+	if len(r.pending) >= r.size {
+		// the head is kept while it is being sent
+		drop := 0
+		if r.sending {
+			drop = 1
+		}
+		if drop < len(r.pending) {
+			r.pending = append(r.pending[:drop], r.pending[drop+1:]...)
+			r.dropped++
+			if r.dropped == 1 || r.dropped%100 == 0 {
+				logger.Warnw("remote write queue is full, dropping oldest requests", "url", r.url, "dropped", r.dropped)
+			}
+		}
+	}
+	r.pending = append(r.pending, body)
+	r.Unlock()
+
+	select {
+	case r.wake <- struct{}{}:
+	default:
+	}
+}
+
+// next gets the oldest queued request without removing it, so it is retried until done is called
+func (r *RemoteWrite) next() ([]byte, bool) {
+	r.Lock()
+	defer r.Unlock()
+	if len(r.pending) == 0 {
+		return nil, false
+	}
+	r.sending = true
+	return r.pending[0], true
+}
+
+// done removes the request returned by next
+func (r *RemoteWrite) done() {
+	r.Lock()
+	defer r.Unlock()
+	r.sending = false
+	r.pending[0] = nil
+	r.pending = r.pending[1:]
+}
+
+// post sends a request, retry is set if the request may succeed later
+func (r *RemoteWrite) post(ctx context.Context, body []byte) (retry bool, err error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, r.url, bytes.NewReader(body))
+	if err != nil {
+		return false, fmt.Errorf("unable to create remote write request, error: %w", err)
+	}
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", remoteWriteVersion)
+
+	res, err := r.client.Do(req)
+	if err != nil {
+		return true, fmt.Errorf("unable to post remote write request, error: %w", err)
+	}
+	defer res.Body.Close()
+	message, _ := ioutil.ReadAll(io.LimitReader(res.Body, 512))
+	switch {
+	case res.StatusCode >= 200 && res.StatusCode <= 299:
+		return false, nil
+	case res.StatusCode == http.StatusTooManyRequests || res.StatusCode >= 500:
+		return true, fmt.Errorf("remote write responded with status %d: %s", res.StatusCode, message)
+	default:
+		return false, fmt.Errorf("remote write responded with status %d: %s", res.StatusCode, message)
+	}
+}
+
+// encodeWriteRequest encodes metrics as a prometheus WriteRequest protobuf message
+// metrics without a timestamp are timestamped with now
+//
+//	message WriteRequest { repeated TimeSeries timeseries = 1; }
+//	message TimeSeries { repeated Label labels = 1; repeated Sample samples = 2; }
+//	message Label { string name = 1; string value = 2; }
+//	message Sample { double value = 1; int64 timestamp = 2; }
+func encodeWriteRequest(metrics []*agent.Metric, externalLabels [][2]string, now time.Time) []byte {
+	var request []byte
+	for _, metric := range metrics {
+		series := newPrometheusSeries(metric)
+		labels := append([][2]string{{"__name__", series.name}}, series.labels...)
+		for _, external := range externalLabels {
+			if !hasLabel(labels, external[0]) {
+				labels = append(labels, external)
+			}
+		}
+		sort.Slice(labels, func(i, j int) bool {
+			return labels[i][0] < labels[j][0]
+		})
+
+		timestamp := metric.Timestamp
+		if timestamp.IsZero() {
+			timestamp = now
+		}
+
+		var timeSeries []byte
+		for _, label := range labels {
+			var encoded []byte
+			encoded = protowire.AppendTag(encoded, 1, protowire.BytesType)
+			encoded = protowire.AppendString(encoded, label[0])
+			encoded = protowire.AppendTag(encoded, 2, protowire.BytesType)
+			encoded = protowire.AppendString(encoded, label[1])
+
+			timeSeries = protowire.AppendTag(timeSeries, 1, protowire.BytesType)
+			timeSeries = protowire.AppendBytes(timeSeries, encoded)
+		}
+		var sample []byte
+		sample = protowire.AppendTag(sample, 1, protowire.Fixed64Type)
+		sample = protowire.AppendFixed64(sample, math.Float64bits(float64(series.value)))
+		sample = protowire.AppendTag(sample, 2, protowire.VarintType)
+		sample = protowire.AppendVarint(sample, uint64(timestamp.UnixNano()/int64(time.Millisecond)))
+		timeSeries = protowire.AppendTag(timeSeries, 2, protowire.BytesType)
+		timeSeries = protowire.AppendBytes(timeSeries, sample)
+
+		request = protowire.AppendTag(request, 1, protowire.BytesType)
+		request = protowire.AppendBytes(request, timeSeries)
+	}
+	return request
+}
+
+func hasLabel(labels [][2]string, name string) bool {
+	for _, label := range labels {
+		if label[0] == name {
+			return true
+		}
+	}
+	return false
+}
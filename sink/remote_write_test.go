@@ -0,0 +1,138 @@
+package sink
+
+import (
+	"context"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/MagalixCorp/magalix-agent/v2/agent"
+	"github.com/golang/snappy"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+func TestRemoteWrite(t *testing.T) {
+	tests := []struct {
+		name         string
+		statuses     []int
+		wantRequests int32
+	}{
+		{name: "sent", statuses: []int{204}, wantRequests: 1},
+		{name: "retried on server errors", statuses: []int{500, 429, 204}, wantRequests: 3},
+		{name: "dropped on client errors", statuses: []int{400}, wantRequests: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var requests int32
+			bodies := make(chan []byte, len(tt.statuses))
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				n := atomic.AddInt32(&requests, 1)
+				if req.Header.Get("Content-Encoding") != "snappy" {
+					t.Errorf("Content-Encoding = %q", req.Header.Get("Content-Encoding"))
+				}
+				body, _ := ioutil.ReadAll(req.Body)
+				bodies <- body
+				w.WriteHeader(tt.statuses[n-1])
+			}))
+			defer server.Close()
+
+			remoteWrite, err := NewRemoteWrite(server.URL, time.Second, 10, map[string]string{"cluster_id": "c1", "node": "ignored"})
+			if err != nil {
+				t.Fatalf("NewRemoteWrite() error = %v", err)
+			}
+			remoteWrite.backoff = time.Millisecond
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			go remoteWrite.Start(ctx)
+
+			err = remoteWrite.SendMetrics([]*agent.Metric{{
+				Name:      "cpu/usage_rate",
+				Type:      "node",
+				NodeName:  "node-1",
+				Timestamp: time.Unix(10, 0),
+				Value:     42,
+			}})
+			if err != nil {
+				t.Fatalf("SendMetrics() error = %v", err)
+			}
+
+			syncCtx, cancelSync := context.WithTimeout(ctx, 5*time.Second)
+			defer cancelSync()
+			if err := remoteWrite.Sync(syncCtx); err != nil {
+				t.Fatalf("Sync() error = %v", err)
+			}
+			if got := atomic.LoadInt32(&requests); got != tt.wantRequests {
+				t.Fatalf("requests = %d, want %d", got, tt.wantRequests)
+			}
+
+			decoded, err := snappy.Decode(nil, <-bodies)
+			if err != nil {
+				t.Fatalf("snappy.Decode() error = %v", err)
+			}
+			labels, value, timestamp := decodeTimeSeries(t, decoded)
+			wantLabels := map[string]string{
+				"__name__":   "magalix_cpu_usage_rate",
+				"cluster_id": "c1",
+				"node":       "node-1",
+				"type":       "node",
+			}
+			if len(labels) != len(wantLabels) {
+				t.Errorf("labels = %v, want %v", labels, wantLabels)
+			}
+			for name, want := range wantLabels {
+				if labels[name] != want {
+					t.Errorf("label %s = %q, want %q", name, labels[name], want)
+				}
+			}
+			if value != 42 || timestamp != 10000 {
+				t.Errorf("sample = %v at %d, want 42 at 10000", value, timestamp)
+			}
+		})
+	}
+}
+
+// decodeTimeSeries decodes the only time series of a WriteRequest with one sample
+func decodeTimeSeries(t *testing.T, request []byte) (map[string]string, float64, int64) {
+	fields := consumeFields(t, request)
+	if len(fields[1]) != 1 {
+		t.Fatalf("time series = %d, want 1", len(fields[1]))
+	}
+	series := consumeFields(t, fields[1][0])
+
+	labels := map[string]string{}
+	for _, label := range series[1] {
+		label := consumeFields(t, label)
+		labels[string(label[1][0])] = string(label[2][0])
+	}
+
+	sample := series[2][0]
+	_, _, n := protowire.ConsumeTag(sample)
+	bits, m := protowire.ConsumeFixed64(sample[n:])
+	sample = sample[n+m:]
+	_, _, n = protowire.ConsumeTag(sample)
+	timestamp, _ := protowire.ConsumeVarint(sample[n:])
+	return labels, math.Float64frombits(bits), int64(timestamp)
+}
+
+// consumeFields gets the values of length delimited fields by field number
+func consumeFields(t *testing.T, message []byte) map[protowire.Number][][]byte {
+	fields := map[protowire.Number][][]byte{}
+	for len(message) > 0 {
+		number, typ, n := protowire.ConsumeTag(message)
+		if n < 0 || typ != protowire.BytesType {
+			t.Fatalf("unexpected field %d of type %d", number, typ)
+		}
+		value, m := protowire.ConsumeBytes(message[n:])
+		if m < 0 {
+			t.Fatalf("invalid field %d", number)
+		}
+		fields[number] = append(fields[number], value)
+		message = message[n+m:]
+	}
+	return fields
+}
@@ -0,0 +1,46 @@
+// Package sink implements destinations of agent data in addition to the agent gateway
+package sink
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/MagalixCorp/magalix-agent/v2/agent"
+)
+
+const (
+	RecordTypeMetrics = "metrics"
+	RecordTypeDeltas  = "deltas"
+	RecordTypeResync  = "resync"
+)
+
+// Record data written by json sinks, only the field of its type is set
+type Record struct {
+	Type      string                `json:"type"`
+	Timestamp time.Time             `json:"timestamp"`
+	Metrics   []*agent.Metric       `json:"metrics,omitempty"`
+	Deltas    []*agent.Delta        `json:"deltas,omitempty"`
+	Resync    *agent.EntitiesResync `json:"resync,omitempty"`
+}
+
+// Parse creates a sink from a <type>:<target> specification
+// supported types are file, a json lines file path, webhook, an http(s) url receiving json records,
+// and remote-write, a prometheus remote write url receiving metrics with the external labels
+// size is the max number of requests queued for retries by sinks retrying on their own
+func Parse(spec string, timeout time.Duration, size int, externalLabels map[string]string) (agent.Sink, error) {
+	parts := strings.SplitN(spec, ":", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return nil, fmt.Errorf("invalid sink %q, expected <type>:<target>", spec)
+	}
+	switch parts[0] {
+	case "file":
+		return NewFile(parts[1]), nil
+	case "webhook":
+		return NewWebhook(parts[1], timeout)
+	case "remote-write":
+		return NewRemoteWrite(parts[1], timeout, size, externalLabels)
+	default:
+		return nil, fmt.Errorf("unsupported sink type %s", parts[0])
+	}
+}
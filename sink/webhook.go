@@ -0,0 +1,77 @@
+package sink
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/MagalixCorp/magalix-agent/v2/agent"
+)
+
+// Webhook posts records as json to an http(s) url
+type Webhook struct {
+	url    string
+	client *http.Client
+}
+
+// NewWebhook creates a webhook sink, requests time out after timeout
+func NewWebhook(rawURL string, timeout time.Duration) (*Webhook, error) {
+	parsed, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid webhook url, error: %w", err)
+	}
+	if parsed.Scheme != "http" && parsed.Scheme != "https" {
+		return nil, fmt.Errorf("unsupported webhook url scheme %s", parsed.Scheme)
+	}
+	return &Webhook{
+		url:    rawURL,
+		client: &http.Client{Timeout: timeout},
+	}, nil
+}
+
+func (w *Webhook) Name() string {
+	return "webhook:" + w.url
+}
+
+func (w *Webhook) Start(ctx context.Context) error {
+	return nil
+}
+
+func (w *Webhook) Sync(ctx context.Context) error {
+	return nil
+}
+
+func (w *Webhook) SendMetrics(metrics []*agent.Metric) error {
+	return w.post(Record{Type: RecordTypeMetrics, Timestamp: time.Now().UTC(), Metrics: metrics})
+}
+
+func (w *Webhook) SendEntitiesDeltas(deltas []*agent.Delta) error {
+	return w.post(Record{Type: RecordTypeDeltas, Timestamp: time.Now().UTC(), Deltas: deltas})
+}
+
+func (w *Webhook) SendEntitiesResync(resync *agent.EntitiesResync) error {
+	return w.post(Record{Type: RecordTypeResync, Timestamp: time.Now().UTC(), Resync: resync})
+}
+
+func (w *Webhook) post(record Record) error {
+	body, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("unable to encode record, error: %w", err)
+	}
+	res, err := w.client.Post(w.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("unable to post record to webhook, error: %w", err)
+	}
+	defer res.Body.Close()
+	_, _ = io.Copy(ioutil.Discard, res.Body)
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("webhook responded with status %d", res.StatusCode)
+	}
+	return nil
+}
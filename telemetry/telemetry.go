@@ -0,0 +1,266 @@
+// Package telemetry collects measurements of the agent itself, they are sent as metrics of the agent type
+package telemetry
+
+import (
+	"context"
+	"runtime"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/MagalixCorp/magalix-agent/v2/agent"
+	"github.com/MagalixCorp/magalix-agent/v2/client"
+	"github.com/MagalixCorp/magalix-agent/v2/gateway"
+	"github.com/MagalixCorp/magalix-agent/v2/proto"
+	"github.com/MagalixTechnologies/core/logger"
+)
+
+// TypeAgent type of metrics measuring the agent itself
+const TypeAgent = "agent"
+
+// GatewayStats stats of packets sent to the agent gateway and commands received from it
+type GatewayStats interface {
+	PipeStats() client.PipeStats
+	SendLatencies() map[proto.PacketKind]client.SendLatency
+	Throughput() client.Throughput
+	CommandStats() map[proto.PacketKind]gateway.CommandStats
+}
+
+// EntitiesStats stats of watched entities
+type EntitiesStats interface {
+	InformerCounts() map[string]int
+	DeltasQueueLength() int
+}
+
+// ScrapeStats stats of scraping metrics from nodes
+type ScrapeStats interface {
+	ScrapeDurations() map[string]time.Duration
+}
+
+// ExecutorStats stats of executing automations
+type ExecutorStats interface {
+	QueueLength() int
+	SubmitTimeouts() int
+}
+
+// Measurement a collected value, tags identify what it measures
+type Measurement struct {
+	Name  string            `json:"name"`
+	Node  string            `json:"node,omitempty"`
+	Tags  map[string]string `json:"tags,omitempty"`
+	Value int64             `json:"value"`
+}
+
+// Snapshot measurements collected at once
+type Snapshot struct {
+	Timestamp    time.Time     `json:"timestamp"`
+	Measurements []Measurement `json:"measurements"`
+}
+
+// Collector collects telemetry every interval and sends it through the metrics handler
+// stats sources are optional, nil sources are skipped
+type Collector struct {
+	sync.Mutex
+
+	interval time.Duration
+	gateway  GatewayStats
+	entities EntitiesStats
+	scrapes  ScrapeStats
+	executor ExecutorStats
+
+	sendMetrics  agent.MetricsHandler
+	cancelWorker context.CancelFunc
+
+	// latencies and commands at the previous collection, averages are computed over the interval
+	latencies map[proto.PacketKind]client.SendLatency
+	commands  map[proto.PacketKind]gateway.CommandStats
+	latest    Snapshot
+}
+
+// NewCollector creates a collector
+func NewCollector(
+	interval time.Duration,
+	gateway GatewayStats,
+	entities EntitiesStats,
+	scrapes ScrapeStats,
+	executor ExecutorStats,
+) *Collector {
+	return &Collector{
+		interval:  interval,
+		gateway:   gateway,
+		entities:  entities,
+		scrapes:   scrapes,
+		executor:  executor,
+		latencies: map[proto.PacketKind]client.SendLatency{},
+	}
+}
+
+func (c *Collector) SetMetricsHandler(handler agent.MetricsHandler) {
+	if handler == nil {
+		panic("metrics handler is nil")
+	}
+	c.sendMetrics = handler
+}
+
+// Start collects and sends telemetry every interval until the context is done
+func (c *Collector) Start(ctx context.Context) error {
+	if c.cancelWorker != nil {
+		c.cancelWorker()
+	}
+	cancelCtx, cancel := context.WithCancel(ctx)
+	c.cancelWorker = cancel
+
+	// the first collection is only kept for the local endpoint and as a baseline of averages
+	c.Collect()
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-cancelCtx.Done():
+			return nil
+		case <-ticker.C:
+			snapshot := c.Collect()
+			if c.sendMetrics == nil {
+				continue
+			}
+			if err := c.sendMetrics(toMetrics(snapshot)); err != nil {
+				logger.Errorw("unable to send agent telemetry", "error", err)
+			}
+		}
+	}
+}
+
+func (c *Collector) Stop() error {
+	if c.cancelWorker == nil {
+		return nil
+	}
+	c.cancelWorker()
+	return nil
+}
+
+// Latest gets the last collected telemetry
+func (c *Collector) Latest() Snapshot {
+	c.Lock()
+	defer c.Unlock()
+	return c.latest
+}
+
+// Collect collects telemetry and keeps it as the latest
+func (c *Collector) Collect() Snapshot {
+	c.Lock()
+	defer c.Unlock()
+
+	snapshot := Snapshot{Timestamp: time.Now().UTC()}
+	add := func(name string, value int64, tags ...string) {
+		measurement := Measurement{Name: name, Value: value}
+		if len(tags) > 0 {
+			measurement.Tags = map[string]string{}
+			for i := 0; i+1 < len(tags); i += 2 {
+				measurement.Tags[tags[i]] = tags[i+1]
+			}
+		}
+		snapshot.Measurements = append(snapshot.Measurements, measurement)
+	}
+
+	if c.gateway != nil {
+		stats := c.gateway.PipeStats()
+		for kind, usage := range stats.PendingKinds {
+			add("pipe/pending_packets", int64(usage.Packages), "kind", kind.String())
+			add("pipe/pending_bytes", int64(usage.Bytes), "kind", kind.String())
+		}
+		for kind, usage := range stats.Evicted {
+			add("pipe/evicted_packets_total", int64(usage.Packages), "kind", kind.String())
+			add("pipe/evicted_bytes_total", int64(usage.Bytes), "kind", kind.String())
+		}
+		add("pipe/dropped_packets_total", int64(stats.Dropped))
+
+		latencies := c.gateway.SendLatencies()
+		for kind, latency := range latencies {
+			previous := c.latencies[kind]
+			add("gateway/sent_packets_total", latency.Count, "kind", kind.String())
+			if count := latency.Count - previous.Count; count > 0 {
+				average := (latency.Total - previous.Total) / time.Duration(count)
+				add("gateway/send_latency_ms", average.Milliseconds(), "kind", kind.String())
+			}
+		}
+		c.latencies = latencies
+
+		throughput := c.gateway.Throughput()
+		add("gateway/bytes_per_second", int64(throughput.BytesPerSecond))
+		for kind, bytes := range throughput.Bytes {
+			add("gateway/sent_bytes_total", bytes, "kind", kind.String())
+		}
+		add("gateway/throttled_ms_total", throughput.Throttled.Milliseconds())
+
+		commands := c.gateway.CommandStats()
+		for kind, stats := range commands {
+			previous := c.commands[kind]
+			add("commands/calls_total", int64(stats.Calls), "kind", kind.String())
+			add("commands/failures_total", int64(stats.Failures), "kind", kind.String())
+			add("commands/panics_total", int64(stats.Panics), "kind", kind.String())
+			add("commands/timeouts_total", int64(stats.Timeouts), "kind", kind.String())
+			add("commands/max_duration_ms", stats.MaxDuration.Milliseconds(), "kind", kind.String())
+			if calls := stats.Calls - previous.Calls; calls > 0 {
+				average := (stats.Duration - previous.Duration) / time.Duration(calls)
+				add("commands/duration_ms", average.Milliseconds(), "kind", kind.String())
+			}
+		}
+		c.commands = commands
+	}
+
+	if c.entities != nil {
+		for resource, count := range c.entities.InformerCounts() {
+			add("entities/informer_objects", int64(count), "resource", resource)
+		}
+		add("entities/deltas_queue_length", int64(c.entities.DeltasQueueLength()))
+	}
+
+	if c.scrapes != nil {
+		for node, duration := range c.scrapes.ScrapeDurations() {
+			snapshot.Measurements = append(snapshot.Measurements, Measurement{
+				Name:  "kubelet/scrape_duration_ms",
+				Node:  node,
+				Value: duration.Milliseconds(),
+			})
+		}
+	}
+
+	if c.executor != nil {
+		add("executor/queue_length", int64(c.executor.QueueLength()))
+		add("executor/submit_timeouts_total", int64(c.executor.SubmitTimeouts()))
+	}
+
+	var memory runtime.MemStats
+	runtime.ReadMemStats(&memory)
+	add("runtime/goroutines", int64(runtime.NumGoroutine()))
+	add("runtime/heap_alloc_bytes", int64(memory.HeapAlloc))
+	add("runtime/heap_inuse_bytes", int64(memory.HeapInuse))
+
+	sort.SliceStable(snapshot.Measurements, func(i, j int) bool {
+		return snapshot.Measurements[i].Name < snapshot.Measurements[j].Name
+	})
+	c.latest = snapshot
+	return snapshot
+}
+
+// toMetrics converts a snapshot to metrics of the agent type
+func toMetrics(snapshot Snapshot) []*agent.Metric {
+	metrics := make([]*agent.Metric, 0, len(snapshot.Measurements))
+	for _, measurement := range snapshot.Measurements {
+		metric := &agent.Metric{
+			Name:      measurement.Name,
+			Type:      TypeAgent,
+			NodeName:  measurement.Node,
+			Timestamp: snapshot.Timestamp,
+			Value:     measurement.Value,
+		}
+		if len(measurement.Tags) > 0 {
+			metric.AdditionalTags = make(map[string]interface{}, len(measurement.Tags))
+			for key, value := range measurement.Tags {
+				metric.AdditionalTags[key] = value
+			}
+		}
+		metrics = append(metrics, metric)
+	}
+	return metrics
+}
@@ -0,0 +1,122 @@
+package telemetry
+
+import (
+	"testing"
+	"time"
+
+	"github.com/MagalixCorp/magalix-agent/v2/client"
+	"github.com/MagalixCorp/magalix-agent/v2/gateway"
+	"github.com/MagalixCorp/magalix-agent/v2/proto"
+)
+
+type testGateway struct {
+	latencies map[proto.PacketKind]client.SendLatency
+	commands  map[proto.PacketKind]gateway.CommandStats
+}
+
+func (g *testGateway) PipeStats() client.PipeStats {
+	return client.PipeStats{
+		PendingKinds: map[proto.PacketKind]client.PipeUsage{
+			proto.PacketKindLogs: {Packages: 2, Bytes: 100},
+		},
+		Evicted: map[proto.PacketKind]client.PipeUsage{
+			proto.PacketKindLogs: {Packages: 1, Bytes: 40},
+		},
+		Dropped: 3,
+	}
+}
+
+func (g *testGateway) SendLatencies() map[proto.PacketKind]client.SendLatency {
+	return g.latencies
+}
+
+func (g *testGateway) Throughput() client.Throughput {
+	return client.Throughput{
+		BytesPerSecond: 512.5,
+		Bytes:          map[proto.PacketKind]int64{proto.PacketKindLogs: 1024},
+		Throttled:      1500 * time.Millisecond,
+	}
+}
+
+func (g *testGateway) CommandStats() map[proto.PacketKind]gateway.CommandStats {
+	return g.commands
+}
+
+type testExecutor struct{}
+
+func (testExecutor) QueueLength() int    { return 5 }
+func (testExecutor) SubmitTimeouts() int { return 2 }
+
+func TestCollector_Collect(t *testing.T) {
+	gw := &testGateway{
+		latencies: map[proto.PacketKind]client.SendLatency{
+			proto.PacketKindLogs: {Count: 2, Total: 200 * time.Millisecond},
+		},
+		commands: map[proto.PacketKind]gateway.CommandStats{
+			proto.PacketKindRestart: {Calls: 1, Duration: 100 * time.Millisecond},
+		},
+	}
+	collector := NewCollector(time.Minute, gw, nil, nil, testExecutor{})
+	collector.Collect()
+
+	gw.latencies = map[proto.PacketKind]client.SendLatency{
+		proto.PacketKindLogs: {Count: 4, Total: 600 * time.Millisecond},
+	}
+	gw.commands = map[proto.PacketKind]gateway.CommandStats{
+		proto.PacketKindRestart: {
+			Calls:       5,
+			Failures:    3,
+			Panics:      1,
+			Timeouts:    1,
+			Duration:    900 * time.Millisecond,
+			MaxDuration: 400 * time.Millisecond,
+		},
+	}
+	snapshot := collector.Collect()
+
+	tests := []struct {
+		name  string
+		tags  map[string]string
+		value int64
+	}{
+		{name: "pipe/pending_packets", tags: map[string]string{"kind": "logs"}, value: 2},
+		{name: "pipe/pending_bytes", tags: map[string]string{"kind": "logs"}, value: 100},
+		{name: "pipe/evicted_packets_total", tags: map[string]string{"kind": "logs"}, value: 1},
+		{name: "pipe/evicted_bytes_total", tags: map[string]string{"kind": "logs"}, value: 40},
+		{name: "pipe/dropped_packets_total", value: 3},
+		{name: "gateway/sent_packets_total", tags: map[string]string{"kind": "logs"}, value: 4},
+		// average over the interval, 400ms for 2 packets
+		{name: "gateway/send_latency_ms", tags: map[string]string{"kind": "logs"}, value: 200},
+		{name: "gateway/bytes_per_second", value: 512},
+		{name: "gateway/sent_bytes_total", tags: map[string]string{"kind": "logs"}, value: 1024},
+		{name: "gateway/throttled_ms_total", value: 1500},
+		{name: "commands/calls_total", tags: map[string]string{"kind": "restart"}, value: 5},
+		{name: "commands/failures_total", tags: map[string]string{"kind": "restart"}, value: 3},
+		{name: "commands/panics_total", tags: map[string]string{"kind": "restart"}, value: 1},
+		{name: "commands/timeouts_total", tags: map[string]string{"kind": "restart"}, value: 1},
+		{name: "commands/max_duration_ms", tags: map[string]string{"kind": "restart"}, value: 400},
+		// average over the interval, 800ms for 4 commands
+		{name: "commands/duration_ms", tags: map[string]string{"kind": "restart"}, value: 200},
+		{name: "executor/queue_length", value: 5},
+		{name: "executor/submit_timeouts_total", value: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, measurement := range snapshot.Measurements {
+				if measurement.Name != tt.name || measurement.Tags["kind"] != tt.tags["kind"] {
+					continue
+				}
+				if measurement.Value != tt.value {
+					t.Fatalf("%s = %d, want %d", tt.name, measurement.Value, tt.value)
+				}
+				return
+			}
+			t.Fatalf("%s is not collected", tt.name)
+		})
+	}
+
+	metrics := toMetrics(snapshot)
+	if len(metrics) != len(snapshot.Measurements) || metrics[0].Type != TypeAgent {
+		t.Fatalf("toMetrics() = %+v", metrics)
+	}
+}
@@ -139,7 +139,7 @@ func MustParseInt(args map[string]interface{}, flag string) int {
 }
 
 func GetSanitizedArgs() []string {
-	sensitive := []string{"--client-secret"}
+	sensitive := []string{"--client-secret", "--proxy-password"}
 
 	args := []string{}
 